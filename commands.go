@@ -0,0 +1,431 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/namsral/flag"
+	"github.com/pkg/errors"
+	"github.com/sardap/zendesk/db"
+	"github.com/sardap/zendesk/output"
+)
+
+// Prefix of the environment variables the flags of a command can be set
+// with, like ZENDESK_ORGS_FILE, so common names like FORMAT aren't picked up
+const envPrefix = "ZENDESK"
+
+// rawFlags are flag values which are checked and turned into Args once the
+// flags are parsed
+type rawFlags struct {
+	duplicates string
+	sortBy     string
+	fields     string
+	query      string
+	tenant     string
+}
+
+// command is a subcommand like zendesk get user 74
+type command struct {
+	name Command
+	// args is what goes after the flags in the usage line
+	args        string
+	description string
+	// dataset is set if the command loads the dataset given by the shared
+	// flags
+	dataset bool
+	// flags adds the command's own flags
+	flags func(fs *flag.FlagSet, result *Args, raw *rawFlags)
+	// positional reads the arguments after the flags
+	positional func(result *Args, raw *rawFlags, positional []string) error
+}
+
+var commands = []*command{
+	{
+		name:        CommandQuery,
+		args:        "RESOURCE FIELD VALUE",
+		description: "finds the records whose FIELD matches VALUE along with their related records",
+		dataset:     true,
+		flags: func(fs *flag.FlagSet, result *Args, raw *rawFlags) {
+			outputFlags(fs, result, "output format. "+queryFormats)
+			fs.StringVar(&raw.sortBy, "sort", "", "comma separated field paths to sort the results by like organization.name. prefix with - to sort descending")
+			fs.StringVar(&raw.fields, "fields", "", "comma separated field paths to list for each result like _id,assignee.email")
+		},
+		positional: func(result *Args, raw *rawFlags, positional []string) error {
+			if err := checkFormatter(*result); err != nil {
+				return err
+			}
+			query, err := parseQuery(strings.Join(positional, " "), raw)
+			result.Query = query
+			return err
+		},
+	},
+	{
+		name:        CommandGet,
+		args:        "RESOURCE ID",
+		description: "gets a single record along with its related records",
+		dataset:     true,
+		flags: func(fs *flag.FlagSet, result *Args, raw *rawFlags) {
+			outputFlags(fs, result, "output format. "+queryFormats)
+			fs.StringVar(&raw.fields, "fields", "", "comma separated field paths to list like _id,assignee.email")
+		},
+		positional: func(result *Args, raw *rawFlags, positional []string) error {
+			if err := checkFormatter(*result); err != nil {
+				return err
+			}
+			if len(positional) != 2 {
+				return usageErrorf("get needs a resource and an id please check get -h")
+			}
+			resource := db.ResourceType(positional[0])
+			if err := checkResource(resource); err != nil {
+				return err
+			}
+			result.Query = db.Query{
+				Conditions: []db.Condition{&db.IDMatchCondition{Resource: resource, Target: positional[1]}},
+				Fields:     splitList(raw.fields),
+			}
+			return nil
+		},
+	},
+	{
+		name:        CommandFields,
+		args:        "[RESOURCE]",
+		description: "lists the fields of a resource, or every resource, which can be searched and the relations paths can follow",
+		flags:       textFormatFlag,
+		positional: func(result *Args, raw *rawFlags, positional []string) error {
+			if len(positional) > 1 {
+				return usageErrorf("fields takes at most one resource please check fields -h")
+			}
+			if len(positional) == 1 {
+				result.Resource = db.ResourceType(positional[0])
+				return checkResource(result.Resource)
+			}
+			return nil
+		},
+	},
+	{
+		name:        CommandStats,
+		description: "counts the records of each resource and how many have dangling foreign keys or duplicate ids",
+		dataset:     true,
+		flags:       textFormatFlag,
+		positional:  noArgs(CommandStats),
+	},
+	{
+		name:        CommandValidate,
+		description: "prints any dangling foreign keys and duplicate ids. exits with 1 if there are any",
+		dataset:     true,
+		flags:       textFormatFlag,
+		positional:  noArgs(CommandValidate),
+	},
+	{
+		name:        CommandSnapshot,
+		args:        "OUTPUT",
+		description: "writes the loaded data to OUTPUT so it can be loaded quickly with -snapshot",
+		dataset:     true,
+		positional: func(result *Args, raw *rawFlags, positional []string) error {
+			if len(positional) != 1 {
+				return usageErrorf("no output file given for snapshot please check snapshot -h")
+			}
+			result.SnapshotOut = positional[0]
+			return nil
+		},
+	},
+	{
+		name: CommandDiff,
+		args: "BEFORE AFTER",
+		description: fmt.Sprintf(
+			"lists the records added, removed and modified going from BEFORE to AFTER which are "+
+				"each a snapshot or a directory holding %s, %s and %s and optionally %s and %s",
+			organizationsFileName, usersFileName, ticketsFileName, groupsFileName, ticketCommentsFileName,
+		),
+		flags: textFormatFlag,
+		positional: func(result *Args, raw *rawFlags, positional []string) error {
+			if len(positional) != 2 {
+				return usageErrorf("invalid or no datasets given for diff please check diff -h")
+			}
+			return setDiffArgs(result, positional[0], positional[1])
+		},
+	},
+}
+
+func lookupCommand(name Command) (*command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+
+	return nil, false
+}
+
+func noArgs(name Command) func(result *Args, raw *rawFlags, positional []string) error {
+	return func(result *Args, raw *rawFlags, positional []string) error {
+		if len(positional) > 0 {
+			return usageErrorf("%s doesn't take any arguments please check %s -h", name, name)
+		}
+		return nil
+	}
+}
+
+// sharedFlags are the flags every command takes. They can also be set from
+// the environment or the config file so a dataset only has to be given once
+func sharedFlags(fs *flag.FlagSet, result *Args, raw *rawFlags) {
+	fs.String(
+		flag.DefaultConfigFlagname, "",
+		"path to a file of shared flags to use when they aren't given, one \"name value\" per line",
+	)
+	fs.StringVar(
+		&result.DataDir, "data_dir", "",
+		fmt.Sprintf(
+			"directory holding %s, %s, %s and optionally %s and %s. "+
+				"if it holds a %s that's loaded instead. files given with their own flags are used over the ones in it",
+			organizationsFileName, usersFileName, ticketsFileName, groupsFileName, ticketCommentsFileName, db.ManifestFileName,
+		),
+	)
+	fs.StringVar(&result.Manifest, "manifest", "", "path to a manifest naming the files each resource is split across and their formats")
+	fs.StringVar(&result.OrganizationsFile, "orgs_file", "", "path to organizations json file")
+	fs.StringVar(&result.UsersFile, "users_file", "", "path to users json file")
+	fs.StringVar(&result.TicketsFile, "tickets_file", "", "path to tickets json file")
+	fs.StringVar(&result.GroupsFile, "groups_file", "", "optional path to groups json file")
+	fs.StringVar(&result.TicketCommentsFile, "ticket_comments_file", "", "optional path to ticket comments json file")
+	fs.StringVar(&result.Snapshot, "snapshot", "", "path to a snapshot to load instead of the json files")
+	fs.StringVar(
+		&result.TenantsDir, "tenants_dir", "",
+		fmt.Sprintf(
+			"directory holding a dataset for each tenant instead of a single one. "+
+				"each is a directory like -data_dir takes or a snapshot ending in %s, named after the tenant like initech",
+			snapshotExt,
+		),
+	)
+	fs.StringVar(
+		&raw.tenant, "tenant", "",
+		"comma separated names or globs like init* of the tenants in -tenants_dir to use. every tenant by default. "+
+			"queries are run against each with the results tagged with their tenant",
+	)
+	fs.BoolVar(&result.Lenient, "lenient", false, "skip records which fail to load and print a report of them")
+	fs.BoolVar(&result.Strict, "strict", false, "fail to load if any foreign keys don't resolve")
+	fs.StringVar(
+		&raw.duplicates, "duplicates", string(db.DuplicateKeepLast),
+		fmt.Sprintf(
+			"what to do with records which have the same id. %s, %s, %s (latest created_at), %s or %s",
+			db.DuplicateKeepLast, db.DuplicateKeepFirst, db.DuplicateKeepNewest, db.DuplicateMerge, db.DuplicateError,
+		),
+	)
+	fs.StringVar(
+		&result.ErrorFormat, "error_format", ErrorFormatText,
+		fmt.Sprintf("how errors are written to stderr, %s or %s for programs running this one", ErrorFormatText, ErrorFormatJSON),
+	)
+}
+
+var queryFormats = fmt.Sprintf(
+	"%s (default), %s, %s, %s, %s or %s with -template",
+	output.FormatJSON, output.FormatNDJSON, output.FormatTable, output.FormatCSV, output.FormatYAML, output.FormatTemplate,
+)
+
+// outputFlags are the flags of commands which print query results
+func outputFlags(fs *flag.FlagSet, result *Args, formatUsage string) {
+	fs.StringVar(&result.Format, "format", "", formatUsage)
+	fs.StringVar(&result.Template, "template", "", "go text/template the template format runs with the query result, e.g. \"{{range .Target}}{{.Name}} {{end}}\"")
+	fs.BoolVar(
+		&result.Meta, "meta", false,
+		"include the query, match count, time taken and dataset paths and checksums with the results. "+
+			"left out by default so the same query gives the same output every run",
+	)
+}
+
+func textFormatFlag(fs *flag.FlagSet, result *Args, raw *rawFlags) {
+	fs.StringVar(&result.Format, "format", "", fmt.Sprintf("output format. %s (default) or %s", FormatText, FormatJSON))
+}
+
+// printFlags writes the flags the same way PrintDefaults does
+func printFlags(w io.Writer, fs *flag.FlagSet, shared bool, isShared map[string]bool) {
+	fs.VisitAll(func(f *flag.Flag) {
+		if isShared[f.Name] != shared {
+			return
+		}
+		format := "  -%s=%q: %s\n"
+		if boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && boolFlag.IsBoolFlag() {
+			format = "  -%s=%s: %s\n"
+		}
+		fmt.Fprintf(w, format, f.Name, f.DefValue, f.Usage)
+	})
+}
+
+func (c *command) usage(fs *flag.FlagSet) {
+	isShared := make(map[string]bool)
+	shared := flag.NewFlagSet("", flag.ContinueOnError)
+	sharedFlags(shared, &Args{}, &rawFlags{})
+	shared.VisitAll(func(f *flag.Flag) { isShared[f.Name] = true })
+
+	fmt.Fprintf(os.Stderr, "Usage: %s %s [flags] %s\n%s\n", os.Args[0], c.name, c.args, c.description)
+	if c.flags != nil {
+		fmt.Fprintf(os.Stderr, "\nFlags:\n")
+		printFlags(os.Stderr, fs, false, isShared)
+	}
+	fmt.Fprintf(os.Stderr,
+		"\nShared flags, which can also be set with environment variables like %s_ORGS_FILE or in the -%s file:\n",
+		envPrefix, flag.DefaultConfigFlagname,
+	)
+	printFlags(os.Stderr, fs, true, isShared)
+}
+
+// parse parses the flags and arguments given after the command name
+func (c *command) parse(arguments []string) (Args, error) {
+	result := Args{Command: c.name}
+	var raw rawFlags
+
+	fs := flag.NewFlagSetWithEnvPrefix(string(c.name), envPrefix, flag.ContinueOnError)
+	sharedFlags(fs, &result, &raw)
+	if c.flags != nil {
+		c.flags(fs, &result, &raw)
+	}
+	// Errors are reported with WriteError so -error_format applies to them
+	// and the usage is only printed when asked for
+	fs.SetOutput(io.Discard)
+	fs.Usage = func() {}
+	if err := fs.Parse(arguments); err != nil {
+		if err == flag.ErrHelp {
+			c.usage(fs)
+		}
+		return result, &Error{Kind: ErrUsage, Cause: errors.Wrap(err, "please check -h")}
+	}
+
+	if err := result.check(&raw); err != nil {
+		return result, err
+	}
+	if c.dataset {
+		if err := result.checkDataset(); err != nil {
+			return result, err
+		}
+	}
+	if err := c.parseArgs(&result, &raw, fs.Args()); err != nil {
+		return result, err
+	}
+
+	return result, nil
+}
+
+func (c *command) parseArgs(result *Args, raw *rawFlags, positional []string) error {
+	switch c.name {
+	case CommandFields, CommandStats, CommandValidate, CommandDiff:
+		if err := checkTextFormat(c.name, result.Format); err != nil {
+			return err
+		}
+	}
+
+	return c.positional(result, raw, positional)
+}
+
+func checkTextFormat(name Command, format string) error {
+	switch format {
+	case "", FormatText, FormatJSON:
+		return nil
+	}
+
+	return usageErrorf("invalid format %s for %s please check -h", format, name)
+}
+
+func checkResource(resource db.ResourceType) error {
+	if _, err := db.LookupResource(resource); err != nil {
+		return &Error{Kind: ErrUsage, Cause: errors.Wrapf(err, "valid resources are %s", resourceNames())}
+	}
+
+	return nil
+}
+
+type fieldInfo struct {
+	Name string       `json:"name"`
+	Kind db.FieldKind `json:"type"`
+}
+
+type relationInfo struct {
+	Name   string          `json:"name"`
+	Target db.ResourceType `json:"resource"`
+}
+
+type resourceFields struct {
+	Resource  db.ResourceType `json:"resource"`
+	Fields    []fieldInfo     `json:"fields"`
+	Relations []relationInfo  `json:"relations"`
+}
+
+func describeFields(resource db.ResourceType) (*resourceFields, error) {
+	fields, err := db.Fields(resource)
+	if err != nil {
+		return nil, err
+	}
+	relations, err := db.Relations(resource)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &resourceFields{Resource: resource, Fields: []fieldInfo{}, Relations: []relationInfo{}}
+	for _, field := range fields {
+		result.Fields = append(result.Fields, fieldInfo{field.Name, field.Kind})
+	}
+	for _, relation := range relations {
+		result.Relations = append(result.Relations, relationInfo{relation.Name, relation.Target})
+	}
+
+	return result, nil
+}
+
+// listFields runs the fields command
+func listFields(args Args, stdout io.Writer) error {
+	resources := db.Resources()
+	if args.Resource != "" {
+		resources = []db.ResourceType{args.Resource}
+	}
+
+	var described []*resourceFields
+	for _, resource := range resources {
+		fields, err := describeFields(resource)
+		if err != nil {
+			return &Error{Kind: ErrUsage, Cause: err}
+		}
+		described = append(described, fields)
+	}
+
+	if args.Format == FormatJSON {
+		jsonBytes, _ := json.MarshalIndent(described, "", "\t")
+		_, err := fmt.Fprintf(stdout, "%s\n", jsonBytes)
+		return err
+	}
+
+	for i, fields := range described {
+		if i > 0 {
+			fmt.Fprintln(stdout)
+		}
+		if len(described) > 1 {
+			fmt.Fprintf(stdout, "%s\n", fields.Resource)
+		}
+		tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(tw, "field\ttype\n")
+		for _, field := range fields.Fields {
+			fmt.Fprintf(tw, "%s\t%s\n", field.Name, field.Kind)
+		}
+		for _, relation := range fields.Relations {
+			fmt.Fprintf(tw, "%s.*\trelation to %s\n", relation.Name, relation.Target)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// printStats runs the stats command
+func printStats(database *db.DB, args Args, stdout io.Writer) error {
+	stats := database.Stats()
+	if args.Format == FormatJSON {
+		jsonBytes, _ := json.MarshalIndent(stats, "", "\t")
+		_, err := fmt.Fprintf(stdout, "%s\n", jsonBytes)
+		return err
+	}
+
+	return stats.Write(stdout)
+}
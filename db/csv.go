@@ -0,0 +1,268 @@
+package db
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrMixedResources error
+)
+
+func init() {
+	ErrMixedResources = fmt.Errorf("all records must be the same resource")
+}
+
+const DefaultListDelimiter = ";"
+
+type CSVOptions struct {
+	// Mapping from CSV header to json field name. Headers missing from the
+	// mapping are taken to already be the json field name
+	Mapping map[string]string `json:"mapping,omitempty"`
+	// ListDelimiter separates the values of list fields like tags and
+	// domain_names. Defaults to DefaultListDelimiter. A delimiter or \ in a
+	// value is escaped with \. Imports always unescape list cells, so a \ in
+	// a list item of a CSV not written by WriteCSV, like a Windows path, has
+	// to be doubled or it's dropped. Other cells are left as they are
+	ListDelimiter string `json:"list_delimiter,omitempty"`
+}
+
+func (c CSVOptions) delimiter() string {
+	if c.ListDelimiter == "" {
+		return DefaultListDelimiter
+	}
+	return c.ListDelimiter
+}
+
+func (c CSVOptions) field(header string) string {
+	if field, ok := c.Mapping[header]; ok {
+		return field
+	}
+	return header
+}
+
+// header is the header mapped onto field. The first in order is used if
+// several are, so the header is the same every time
+func (c CSVOptions) header(field string) string {
+	result, found := field, false
+	for header, mapped := range c.Mapping {
+		if mapped == field && (!found || header < result) {
+			result, found = header, true
+		}
+	}
+	return result
+}
+
+// splitList splits a list cell on the delimiter, leaving out delimiters
+// escaped with \
+func splitList(cell, delimiter string) []string {
+	var result []string
+	var item strings.Builder
+	for i := 0; i < len(cell); i++ {
+		switch {
+		case cell[i] == '\\' && i+1 < len(cell):
+			i++
+			item.WriteByte(cell[i])
+		case strings.HasPrefix(cell[i:], delimiter):
+			result = append(result, item.String())
+			item.Reset()
+			i += len(delimiter) - 1
+		default:
+			item.WriteByte(cell[i])
+		}
+	}
+
+	return append(result, item.String())
+}
+
+// EscapeListItem escapes \ and the delimiter so a list cell joined with the
+// delimiter is split back into its items on import
+func EscapeListItem(item, delimiter string) string {
+	item = strings.ReplaceAll(item, `\`, `\\`)
+	return strings.ReplaceAll(item, delimiter, `\`+delimiter)
+}
+
+// csvValue converts a cell into the value json expects for the field type
+func csvValue(field *Field, cell, delimiter string) (interface{}, error) {
+	switch field.Kind {
+	case FieldTime:
+		// Parsed by ZendeskTime.UnmarshalJSON
+		return cell, nil
+	case FieldList:
+		return splitList(cell, delimiter), nil
+	case FieldIntList:
+		var result []int64
+		for _, item := range splitList(cell, delimiter) {
+			id, err := strconv.ParseInt(item, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, id)
+		}
+		return result, nil
+	case FieldBool:
+		return strconv.ParseBool(cell)
+	case FieldInt:
+		return strconv.ParseInt(cell, 10, 64)
+	}
+
+	return cell, nil
+}
+
+// ImportCSV adds a record to the DB for every row of r. The first row is the
+// header, which is mapped onto json field names with opts.Mapping. Empty
+// cells are left as the zero value. It's Import with FormatCSV
+func (d *DB) ImportCSV(resource ResourceType, r io.Reader, opts CSVOptions) error {
+	return d.Import(resource, r, LoadOptions{Format: FormatCSV, CSV: opts})
+}
+
+// csv adds a record for every row of r after the header
+func (i *importer) csv(r io.Reader) error {
+	if _, err := Fields(i.resource); err != nil {
+		return err
+	}
+
+	reader := csv.NewReader(r)
+	headers, err := reader.Read()
+	if err != nil {
+		return errors.Wrap(err, "unable to read csv header")
+	}
+
+	columns := make([]*Field, len(headers))
+	for j, header := range headers {
+		field, err := LookupField(i.resource, i.opts.CSV.field(header))
+		if err == nil && field.Kind == FieldExtra {
+			err = errors.Wrapf(ErrFieldMissing, "extra attributes like %s can't be imported", field.Name)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "csv header %s", header)
+		}
+		columns[j] = field
+	}
+
+	for rowNum := 1; ; rowNum++ {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		index := i.index
+		i.index++
+
+		field, err := i.csvRow(columns, row)
+		if err != nil {
+			if err := i.skip(i.loadError(index, 0, field, errors.Wrapf(err, "row %d", rowNum))); err != nil {
+				return err
+			}
+			continue
+		}
+		i.added(0)
+	}
+}
+
+// csvRow adds the record in the row. On failure it returns the field which
+// failed to parse if it was one
+func (i *importer) csvRow(columns []*Field, row []string) (string, error) {
+	record := make(map[string]interface{})
+	for j, cell := range row {
+		if cell == "" {
+			continue
+		}
+		value, err := csvValue(columns[j], cell, i.opts.CSV.delimiter())
+		if err != nil {
+			return columns[j].Name, err
+		}
+		record[columns[j].Name] = value
+	}
+
+	recordJson, err := json.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+
+	return "", i.add(recordJson)
+}
+
+// csvCell formats a decoded json value as a cell
+func csvCell(value interface{}, delimiter string) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []interface{}:
+		cells := make([]string, len(v))
+		for i, item := range v {
+			cells[i] = EscapeListItem(csvCell(item, delimiter), delimiter)
+		}
+		return strings.Join(cells, delimiter)
+	}
+
+	return fmt.Sprintf("%v", value)
+}
+
+// WriteCSV writes the records as a CSV with a header row. All the records
+// must be the same resource.
+func WriteCSV(w io.Writer, records []Data, opts CSVOptions) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	resource := records[0].GetResourceType()
+	fields, err := Fields(resource)
+	if err != nil {
+		return err
+	}
+
+	writer := csv.NewWriter(w)
+
+	headers := make([]string, len(fields))
+	for i, field := range fields {
+		headers[i] = opts.header(field.Name)
+	}
+	if err := writer.Write(headers); err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		if record.GetResourceType() != resource {
+			return errors.Wrapf(ErrMixedResources, "%s and %s", resource, record.GetResourceType())
+		}
+
+		recordJson, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		dec := json.NewDecoder(bytes.NewReader(recordJson))
+		dec.UseNumber()
+		var values map[string]interface{}
+		if err := dec.Decode(&values); err != nil {
+			return err
+		}
+
+		row := make([]string, len(fields))
+		for i, field := range fields {
+			row[i] = csvCell(values[field.Name], opts.delimiter())
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// WriteCSV writes one row per target
+func (q *QueryResult) WriteCSV(w io.Writer, opts CSVOptions) error {
+	return WriteCSV(w, q.Target, opts)
+}
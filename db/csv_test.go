@@ -0,0 +1,127 @@
+package db_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/sardap/zendesk/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImportCSV(t *testing.T) {
+	input := "Org ID,Name,Domains,Created,shared_tickets,tags\n" +
+		"101,Enthaze,kage.com|ecratic.com|endipin.com|zentix.com,2016-05-21T11:10:28 -10:00,false,Fulton|West|Rodriguez|Farley\n" +
+		"102,Nutralab,,,true,\n"
+
+	database := db.New()
+	err := database.ImportCSV(db.ResourceOrganization, strings.NewReader(input), db.CSVOptions{
+		Mapping: map[string]string{
+			"Org ID":  "_id",
+			"Name":    "name",
+			"Domains": "domain_names",
+			"Created": "created_at",
+		},
+		ListDelimiter: "|",
+	})
+	assert.NoError(t, err, "error importing csv")
+
+	org, err := database.GetOrganization(101)
+	assert.NoError(t, err, "org missing after csv import")
+	assert.Equal(t, expectedOrg.Name, org.Name)
+	assert.Equal(t, expectedOrg.DomainNames, org.DomainNames)
+	assert.True(t, expectedOrg.CreatedAt.Equal(org.CreatedAt.Time), "created_at not parsed")
+	assert.Equal(t, expectedOrg.Tags, org.Tags)
+
+	org, err = database.GetOrganization(102)
+	assert.NoError(t, err, "org missing after csv import")
+	assert.True(t, org.SharedTickets)
+	assert.False(t, org.CreatedAt.IsSet(), "empty time should be left unset")
+	assert.Empty(t, org.Tags)
+
+	// Unknown header
+	err = db.New().ImportCSV(db.ResourceOrganization, strings.NewReader("garbage\n1\n"), db.CSVOptions{})
+	assert.ErrorIs(t, err, db.ErrFieldMissing)
+
+	// Bad values
+	err = db.New().ImportCSV(db.ResourceUser, strings.NewReader("_id,active\n1,sarda.dev\n"), db.CSVOptions{})
+	assert.Error(t, err, "bool should fail to parse")
+
+	err = db.New().ImportCSV(db.ResourceTicket, strings.NewReader("_id,due_at\n1,sarda.dev\n"), db.CSVOptions{})
+	assert.Error(t, err, "time should fail to parse")
+
+	// Bad rows are skipped when lenient
+	var report db.LoadReport
+	database = db.New()
+	err = database.Import(db.ResourceUser, strings.NewReader("_id,active\n1,sarda.dev\n2,true\n"), db.LoadOptions{
+		Format:  db.FormatCSV,
+		Lenient: true,
+		Report:  &report,
+	})
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(report.Skipped)) {
+		assert.Equal(t, 0, report.Skipped[0].Index)
+		assert.Equal(t, "active", report.Skipped[0].Field)
+	}
+	_, err = database.GetUser(2)
+	assert.NoError(t, err, "rows after a bad one are still loaded")
+}
+
+func TestWriteCSV(t *testing.T) {
+	database := createLoadedDB()
+
+	query := db.Query{
+		Conditions: []db.Condition{
+			&db.FulLMatchCondition{
+				Resource:  db.ResourceTicket,
+				Connector: db.ConnectorTypeUnion,
+				Field:     "type",
+				Match:     "incident",
+			},
+		},
+	}
+	result, err := query.Resolve(database)
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	err = result.WriteCSV(&buf, db.CSVOptions{})
+	assert.NoError(t, err, "error writing csv")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, len(result.Target)+1, len(lines), "should be one row per target plus header")
+	assert.True(t, strings.HasPrefix(lines[0], "_id,url,external_id,created_at,type"), "header wrong %s", lines[0])
+
+	// Round trip
+	copied := db.New()
+	err = copied.ImportCSV(db.ResourceTicket, &buf, db.CSVOptions{})
+	assert.NoError(t, err, "error importing written csv")
+	for _, target := range result.Target {
+		original := target.(*db.Ticket)
+		ticket, err := copied.GetTicket(original.ID)
+		if assert.NoError(t, err) {
+			assert.Equal(t, original.Tags, ticket.Tags)
+			assert.Equal(t, original.SubmitterID, ticket.SubmitterID)
+			assert.Equal(t, original.HasIncidents, ticket.HasIncidents)
+			assert.True(t, original.DueAt.Equal(ticket.DueAt.Time))
+		}
+	}
+
+	// Delimiters in list items are escaped
+	buf.Reset()
+	org := &db.Organization{ID: 1, Tags: []string{"a;b", `c\`, "d"}}
+	mapping := db.CSVOptions{Mapping: map[string]string{"tags": "tags", "Tags": "tags", "labels": "tags"}}
+	assert.NoError(t, db.WriteCSV(&buf, []db.Data{org}, mapping))
+	assert.True(t, strings.HasPrefix(buf.String(), "_id,url,external_id,name,domain_names,created_at,details,shared_tickets,Tags\n"), "the first header mapped to a field is used")
+	assert.Contains(t, buf.String(), `,a\;b;c\\;d`+"\n")
+	copied = db.New()
+	assert.NoError(t, copied.ImportCSV(db.ResourceOrganization, &buf, mapping))
+	copiedOrg, err := copied.GetOrganization(1)
+	if assert.NoError(t, err) {
+		assert.Equal(t, org.Tags, copiedOrg.Tags)
+	}
+
+	// Mixed resources
+	usr, _ := database.GetUser(1)
+	err = db.WriteCSV(&bytes.Buffer{}, []db.Data{result.Target[0], usr}, db.CSVOptions{})
+	assert.ErrorIs(t, err, db.ErrMixedResources)
+}
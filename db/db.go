@@ -4,6 +4,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 )
@@ -11,20 +15,118 @@ import (
 var (
 	ErrNotFound          error
 	ErrInvalidForeignKey error
+	ErrReadOnly          error
 )
 
 func init() {
 	ErrNotFound = fmt.Errorf("no entry found")
 	ErrInvalidForeignKey = fmt.Errorf("invalid foreign key")
+	ErrReadOnly = fmt.Errorf("the DB can't be changed while a query is resolving")
 }
 
-type DB struct {
+// store is the state shared by a DB and its read views
+type store struct {
+	// writers hold mu for the whole of a change so readers never see part of
+	// one
+	mu      sync.RWMutex
 	tickets map[string]*Ticket
 	orgs    map[int64]*Organization
 	users   map[int64]*User
+	// back references keyed by the foreign key so they resolve no matter
+	// which side is added first
+	orgUsers   map[int64][]int64
+	orgTickets map[int64][]string
+	assigned   map[int64][]string
+	submitted  map[int64][]string
+	// how many times each key has been added over an existing record
+	duplicates map[ResourceType]map[string]int
+	// versions of records which have changed over time
+	history map[ResourceType]map[string][]Version
+	// records of every other registered resource by key
+	others map[ResourceType]map[string]Data
+	// records linking to each record through a registered Relation
+	refs map[ResourceType]map[string][]recordRef
+	// inputs the records were imported from
+	sources []Source
+	// changes are logged here when set
+	wal *WAL
+	// Seq of the last log entry applied, which is saved in snapshots
+	walSeq uint64
+	// change feed
+	subsMu sync.Mutex
+	subs   []*Subscription
+}
+
+type DB struct {
+	*store
+	// view is set on DBs which can't be changed. Either the DB handed to
+	// conditions while a query resolves, where the read lock is already held
+	// for the whole query so it isn't taken again, or a past state from AsOf
+	view bool
+}
+
+func (d *DB) rlock() {
+	if !d.view {
+		d.mu.RLock()
+	}
+}
+
+func (d *DB) runlock() {
+	if !d.view {
+		d.mu.RUnlock()
+	}
+}
+
+// read calls fn with a view of the DB which can't change until fn returns
+func (d *DB) read(fn func(view *DB) error) error {
+	if d.view {
+		return fn(d)
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return fn(&DB{store: d.store, view: true})
+}
+
+// write calls fn with the write lock held then sends the events fn returns
+// to subscribers. Sending never waits on a subscriber so it's done before
+// the lock is released, which keeps events in the order the changes were
+// applied
+func (d *DB) write(fn func() ([]ChangeEvent, error)) error {
+	if d.view {
+		return ErrReadOnly
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	events, err := fn()
+	view := &DB{store: d.store, view: true}
+	for _, event := range events {
+		d.publish(event, view)
+	}
+
+	return err
+}
+
+func (d *DB) noteDuplicate(resource ResourceType, key string) {
+	d.noteDuplicates(resource, key, 1)
+}
+
+func (d *DB) noteDuplicates(resource ResourceType, key string, count int) {
+	if d.duplicates == nil {
+		d.duplicates = make(map[ResourceType]map[string]int)
+	}
+	if d.duplicates[resource] == nil {
+		d.duplicates[resource] = make(map[string]int)
+	}
+	d.duplicates[resource][key] += count
 }
 
 func (d *DB) GetOrganization(id int64) (*Organization, error) {
+	d.rlock()
+	defer d.runlock()
+
 	result, ok := d.orgs[id]
 	if !ok {
 		return nil, errors.Wrapf(ErrNotFound, "%d", id)
@@ -34,6 +136,9 @@ func (d *DB) GetOrganization(id int64) (*Organization, error) {
 }
 
 func (d *DB) GetUser(id int64) (*User, error) {
+	d.rlock()
+	defer d.runlock()
+
 	result, ok := d.users[id]
 	if !ok {
 		return nil, errors.Wrapf(ErrNotFound, "%d", id)
@@ -43,6 +148,9 @@ func (d *DB) GetUser(id int64) (*User, error) {
 }
 
 func (d *DB) GetTicket(id string) (*Ticket, error) {
+	d.rlock()
+	defer d.runlock()
+
 	result, ok := d.tickets[id]
 	if !ok {
 		return nil, errors.Wrapf(ErrNotFound, "%s", id)
@@ -51,108 +159,439 @@ func (d *DB) GetTicket(id string) (*Ticket, error) {
 	return result, nil
 }
 
-func (d *DB) AddOrganization(toAdd Organization) error {
-	if toAdd.users == nil {
-		toAdd.users = make([]int64, 0)
+func removeInt64(ary []int64, value int64) []int64 {
+	for i, val := range ary {
+		if val == value {
+			return append(ary[:i:i], ary[i+1:]...)
+		}
 	}
-	if toAdd.tickets == nil {
-		toAdd.tickets = make([]string, 0)
+	return ary
+}
+
+func removeString(ary []string, value string) []string {
+	for i, val := range ary {
+		if val == value {
+			return append(ary[:i:i], ary[i+1:]...)
+		}
 	}
-	d.orgs[toAdd.ID] = &toAdd
+	return ary
+}
 
-	return nil
+func (d *DB) linkUser(usr *User) {
+	d.orgUsers[usr.OrganizationID] = append(d.orgUsers[usr.OrganizationID], usr.ID)
 }
 
-func (d *DB) AddUser(toAdd User) error {
-	if toAdd.assignee == nil {
-		toAdd.assignee = make([]string, 0)
+func (d *DB) unlinkUser(usr *User) {
+	d.orgUsers[usr.OrganizationID] = removeInt64(d.orgUsers[usr.OrganizationID], usr.ID)
+}
+
+func (d *DB) linkTicket(ticket *Ticket) {
+	d.orgTickets[ticket.OrganizationID] = append(d.orgTickets[ticket.OrganizationID], ticket.ID)
+	d.submitted[ticket.SubmitterID] = append(d.submitted[ticket.SubmitterID], ticket.ID)
+	d.assigned[ticket.AssigneeID] = append(d.assigned[ticket.AssigneeID], ticket.ID)
+}
+
+func (d *DB) unlinkTicket(ticket *Ticket) {
+	d.orgTickets[ticket.OrganizationID] = removeString(d.orgTickets[ticket.OrganizationID], ticket.ID)
+	d.submitted[ticket.SubmitterID] = removeString(d.submitted[ticket.SubmitterID], ticket.ID)
+	d.assigned[ticket.AssigneeID] = removeString(d.assigned[ticket.AssigneeID], ticket.ID)
+}
+
+type Op string
+
+const (
+	OpAdd    Op = "add"
+	OpUpdate Op = "update"
+	OpDelete Op = "delete"
+)
+
+// get returns the record with the key or nil
+func (d *DB) get(resource ResourceType, key string) Data {
+	switch resource {
+	case ResourceOrganization:
+		id, _ := strconv.ParseInt(key, 10, 64)
+		if org, ok := d.orgs[id]; ok {
+			return org
+		}
+	case ResourceUser:
+		id, _ := strconv.ParseInt(key, 10, 64)
+		if usr, ok := d.users[id]; ok {
+			return usr
+		}
+	case ResourceTicket:
+		if ticket, ok := d.tickets[key]; ok {
+			return ticket
+		}
+	default:
+		if record, ok := d.others[resource][key]; ok {
+			return record
+		}
 	}
-	if toAdd.submitter == nil {
-		toAdd.submitter = make([]string, 0)
+
+	return nil
+}
+
+// records lists every record of the resource
+func (d *DB) records(resource ResourceType) []Data {
+	var result []Data
+	switch resource {
+	case ResourceOrganization:
+		result = make([]Data, 0, len(d.orgs))
+		for _, org := range d.orgs {
+			result = append(result, org)
+		}
+	case ResourceUser:
+		result = make([]Data, 0, len(d.users))
+		for _, usr := range d.users {
+			result = append(result, usr)
+		}
+	case ResourceTicket:
+		result = make([]Data, 0, len(d.tickets))
+		for _, ticket := range d.tickets {
+			result = append(result, ticket)
+		}
+	default:
+		result = make([]Data, 0, len(d.others[resource]))
+		for _, record := range d.others[resource] {
+			result = append(result, record)
+		}
 	}
 
-	d.users[toAdd.ID] = &toAdd
-	// resolve foreign keys
-	if org, err := d.GetOrganization(toAdd.OrganizationID); err == nil {
-		org.users = append(org.users, toAdd.ID)
+	return result
+}
+
+// sortedRecords lists every record of the resource in key order
+func (d *DB) sortedRecords(resource ResourceType) []Data {
+	result := d.records(resource)
+	sort.Slice(result, func(i, j int) bool { return keyLess(result[i].GetKey(), result[j].GetKey()) })
+
+	return result
+}
+
+// put stores the record over any existing one with the same key
+func (d *DB) put(record Data) {
+	resource, key := record.GetResourceType(), record.GetKey()
+	if existing := d.get(resource, key); existing != nil {
+		d.unlinkRelations(existing)
 	}
+	defer d.linkRelations(record)
 
-	return nil
+	switch val := record.(type) {
+	case *Organization:
+		d.orgs[val.ID] = val
+	case *User:
+		if existing, ok := d.users[val.ID]; ok {
+			d.unlinkUser(existing)
+		}
+		d.users[val.ID] = val
+		d.linkUser(val)
+	case *Ticket:
+		if existing, ok := d.tickets[val.ID]; ok {
+			d.unlinkTicket(existing)
+		}
+		d.tickets[val.ID] = val
+		d.linkTicket(val)
+	default:
+		if d.others[resource] == nil {
+			d.others[resource] = make(map[string]Data)
+		}
+		d.others[resource][key] = record
+	}
 }
 
-func (d *DB) AddTicket(toAdd Ticket) error {
-	d.tickets[toAdd.ID] = &toAdd
+// remove deletes the record with the same key as record
+func (d *DB) remove(record Data) {
+	resource, key := record.GetResourceType(), record.GetKey()
+	if existing := d.get(resource, key); existing != nil {
+		d.unlinkRelations(existing)
+	}
 
-	// resolve foreign keys
-	if org, err := d.GetOrganization(toAdd.OrganizationID); err == nil {
-		org.tickets = append(org.tickets, toAdd.ID)
+	switch val := record.(type) {
+	case *Organization:
+		delete(d.orgs, val.ID)
+	case *User:
+		if existing, ok := d.users[val.ID]; ok {
+			d.unlinkUser(existing)
+		}
+		delete(d.users, val.ID)
+	case *Ticket:
+		if existing, ok := d.tickets[val.ID]; ok {
+			d.unlinkTicket(existing)
+		}
+		delete(d.tickets, val.ID)
+	default:
+		delete(d.others[resource], key)
 	}
+}
 
-	if usr, err := d.GetUser(toAdd.SubmitterID); err == nil {
-		usr.submitter = append(usr.submitter, toAdd.ID)
+// apply makes the change to the maps and back references as of at. dated is
+// set for versions from a dated export, see remember. A change older than
+// the latest version of the record only goes into its history so nothing is
+// applied and false is returned
+func (d *DB) apply(op Op, record Data, at time.Time, dated bool) (ChangeEvent, bool) {
+	event := ChangeEvent{Before: d.get(record.GetResourceType(), record.GetKey())}
+	if !d.remember(op, record, event.Before, at, dated) {
+		return event, false
 	}
 
-	if usr, err := d.GetUser(toAdd.AssigneeID); err == nil {
-		usr.assignee = append(usr.assignee, toAdd.ID)
+	if op == OpDelete {
+		d.remove(record)
+		event.Type = ChangeDelete
+	} else {
+		d.put(record)
+		event.After = record
+		event.Type = ChangeUpdate
+		if event.Before == nil {
+			event.Type = ChangeInsert
+		}
 	}
 
-	return nil
+	return event, true
 }
 
-func Create(orgsReader, usersReader, ticketsReader io.Reader) (*DB, error) {
-	result := &DB{
-		tickets: make(map[string]*Ticket),
-		orgs:    make(map[int64]*Organization),
-		users:   make(map[int64]*User),
+// commit is where every single change to the DB goes through. The change is
+// written to the write ahead log if there is one before it is applied. The
+// write lock must be held
+func (d *DB) commit(op Op, record Data, at time.Time, dated bool) ([]ChangeEvent, error) {
+	if d.wal != nil {
+		if err := d.wal.append(op, record, at, dated); err != nil {
+			return nil, err
+		}
+		d.walSeq = d.wal.seq
 	}
 
-	// Organizations
-	orgsJson, err := io.ReadAll(orgsReader)
-	if err != nil {
-		return nil, err
+	if event, ok := d.apply(op, record, at, dated); ok {
+		return []ChangeEvent{event}, nil
 	}
+	return nil, nil
+}
 
-	var orgs []Organization
-	if err := json.Unmarshal(orgsJson, &orgs); err != nil {
-		return nil, err
+// add returns if there was already a record with the same key. raw is the
+// json toAdd was parsed from, if it was, for DuplicateMerge. When dated is
+// set toAdd is a version from an export taken at at, so it only collides
+// with records from the same export
+func (d *DB) add(toAdd Data, raw json.RawMessage, policy DuplicatePolicy, at time.Time, dated bool) (bool, error) {
+	exists := false
+	err := d.write(func() ([]ChangeEvent, error) {
+		resource, key := toAdd.GetResourceType(), toAdd.GetKey()
+		existing := d.get(resource, key)
+		if dated {
+			existing = d.versionFrom(resource, key, at)
+		}
+		if existing != nil {
+			exists = true
+			d.noteDuplicate(resource, key)
+			if keep, err := resolveDuplicate(policy, existing, toAdd, raw); err != nil || !keep {
+				return nil, err
+			}
+		}
+
+		return d.commit(OpAdd, toAdd, at, dated)
+	})
+
+	return exists, err
+}
+
+func (d *DB) update(toUpdate Data) error {
+	return d.write(func() ([]ChangeEvent, error) {
+		if d.get(toUpdate.GetResourceType(), toUpdate.GetKey()) == nil {
+			return nil, errors.Wrapf(ErrNotFound, "%s", toUpdate.GetKey())
+		}
+
+		return d.commit(OpUpdate, toUpdate, time.Now(), false)
+	})
+}
+
+func (d *DB) delete(resource ResourceType, key string) error {
+	return d.write(func() ([]ChangeEvent, error) {
+		existing := d.get(resource, key)
+		if existing == nil {
+			return nil, errors.Wrapf(ErrNotFound, "%s", key)
+		}
+
+		return d.commit(OpDelete, existing, time.Now(), false)
+	})
+}
+
+// AddOrganization replaces any organization with the same ID
+func (d *DB) AddOrganization(toAdd Organization) error {
+	_, err := d.add(&toAdd, nil, DuplicateKeepLast, time.Now(), false)
+	return err
+}
+
+// AddUser replaces any user with the same ID
+func (d *DB) AddUser(toAdd User) error {
+	_, err := d.add(&toAdd, nil, DuplicateKeepLast, time.Now(), false)
+	return err
+}
+
+// AddTicket replaces any ticket with the same ID
+func (d *DB) AddTicket(toAdd Ticket) error {
+	_, err := d.add(&toAdd, nil, DuplicateKeepLast, time.Now(), false)
+	return err
+}
+
+// UpdateOrganization replaces an existing organization
+func (d *DB) UpdateOrganization(toUpdate Organization) error {
+	return d.update(&toUpdate)
+}
+
+// UpdateUser replaces an existing user
+func (d *DB) UpdateUser(toUpdate User) error {
+	return d.update(&toUpdate)
+}
+
+// UpdateTicket replaces an existing ticket
+func (d *DB) UpdateTicket(toUpdate Ticket) error {
+	return d.update(&toUpdate)
+}
+
+// DeleteOrganization removes an organization. Users and tickets in it keep
+// their organization_id
+func (d *DB) DeleteOrganization(id int64) error {
+	return d.delete(ResourceOrganization, strconv.FormatInt(id, 10))
+}
+
+// DeleteUser removes a user. Tickets keep their submitter_id and assignee_id
+func (d *DB) DeleteUser(id int64) error {
+	return d.delete(ResourceUser, strconv.FormatInt(id, 10))
+}
+
+func (d *DB) DeleteTicket(id string) error {
+	return d.delete(ResourceTicket, id)
+}
+
+// recordKey checks the resource is registered and puts an int key in the
+// form GetKey gives
+func recordKey(resource ResourceType, key string) (string, error) {
+	found, err := LookupResource(resource)
+	if err != nil {
+		return "", err
 	}
-	for _, org := range orgs {
-		if err := result.AddOrganization(org); err != nil {
-			return nil, err
+	if found.Key == KeyInt {
+		id, err := strconv.ParseInt(key, 10, 64)
+		if err != nil {
+			return "", errors.Wrapf(ErrInvalidMatch, "given ID %s must be a number and base 10", key)
 		}
+		key = strconv.FormatInt(id, 10)
 	}
 
-	// Users
-	usersJson, err := io.ReadAll(usersReader)
+	return key, nil
+}
+
+// GetRecord gets a record of any registered resource
+func (d *DB) GetRecord(resource ResourceType, key string) (Data, error) {
+	key, err := recordKey(resource, key)
 	if err != nil {
 		return nil, err
 	}
 
-	var users []User
-	if err := json.Unmarshal(usersJson, &users); err != nil {
-		return nil, err
+	d.rlock()
+	defer d.runlock()
+
+	result := d.get(resource, key)
+	if result == nil {
+		return nil, errors.Wrapf(ErrNotFound, "%s", key)
 	}
-	for _, user := range users {
-		if err := result.AddUser(user); err != nil {
-			return nil, err
-		}
+
+	return result, nil
+}
+
+// AddRecord replaces any record of a registered resource with the same key
+func (d *DB) AddRecord(toAdd Data) error {
+	if _, err := LookupResource(toAdd.GetResourceType()); err != nil {
+		return err
+	}
+
+	_, err := d.add(toAdd, nil, DuplicateKeepLast, time.Now(), false)
+	return err
+}
+
+// UpdateRecord replaces an existing record of a registered resource
+func (d *DB) UpdateRecord(toUpdate Data) error {
+	if _, err := LookupResource(toUpdate.GetResourceType()); err != nil {
+		return err
 	}
 
-	// Tickets
-	ticketsJson, err := io.ReadAll(ticketsReader)
+	return d.update(toUpdate)
+}
+
+// DeleteRecord removes a record of a registered resource
+func (d *DB) DeleteRecord(resource ResourceType, key string) error {
+	key, err := recordKey(resource, key)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	var tickets []Ticket
-	if err := json.Unmarshal(ticketsJson, &tickets); err != nil {
+	return d.delete(resource, key)
+}
+
+func New() *DB {
+	return &DB{store: &store{
+		tickets:    make(map[string]*Ticket),
+		orgs:       make(map[int64]*Organization),
+		users:      make(map[int64]*User),
+		orgUsers:   make(map[int64][]int64),
+		orgTickets: make(map[int64][]string),
+		assigned:   make(map[int64][]string),
+		submitted:  make(map[int64][]string),
+		others:     make(map[ResourceType]map[string]Data),
+		refs:       make(map[ResourceType]map[string][]recordRef),
+	}}
+}
+
+func Create(orgsReader, usersReader, ticketsReader io.Reader) (*DB, error) {
+	return CreateWithOptions(orgsReader, usersReader, ticketsReader, LoadOptions{})
+}
+
+func CreateWithOptions(orgsReader, usersReader, ticketsReader io.Reader, opts LoadOptions) (*DB, error) {
+	return CreateResources(map[ResourceType]io.Reader{
+		ResourceOrganization: orgsReader,
+		ResourceUser:         usersReader,
+		ResourceTicket:       ticketsReader,
+	}, opts)
+}
+
+// CreateResources imports each resource from its reader in the order the
+// resources were registered. Resources without a reader are left empty
+func CreateResources(readers map[ResourceType]io.Reader, opts LoadOptions) (*DB, error) {
+	result := New()
+	if err := importResources(result, readers, opts); err != nil {
 		return nil, err
 	}
-	for _, ticket := range tickets {
-		if err := result.AddTicket(ticket); err != nil {
-			return nil, err
+
+	return result, nil
+}
+
+// importResources is the loading CreateResources and CreateSharded share
+func importResources(database Database, readers map[ResourceType]io.Reader, opts LoadOptions) error {
+	for resource := range readers {
+		if _, err := LookupResource(resource); err != nil {
+			return err
+		}
+	}
+	for _, resource := range resourceOrder {
+		r, ok := readers[resource]
+		if !ok || r == nil {
+			continue
+		}
+		if err := database.Import(resource, r, opts); err != nil {
+			return err
 		}
 	}
 
-	return result, nil
+	return checkStrict(database, opts)
+}
+
+// checkStrict fails with ErrInvalidForeignKey if opts.Strict is set and any
+// foreign keys don't resolve
+func checkStrict(database Database, opts LoadOptions) error {
+	if !opts.Strict {
+		return nil
+	}
+	if dangling := database.Validate().Dangling; len(dangling) > 0 {
+		return errors.Wrapf(ErrInvalidForeignKey, "%s", dangling[0])
+	}
+
+	return nil
 }
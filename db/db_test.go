@@ -126,3 +126,107 @@ func TestGetTicket(t *testing.T) {
 	_, err = database.GetTicket("mr-garbage")
 	assert.ErrorIs(t, err, db.ErrNotFound, "Missing notFoundm Error")
 }
+
+func TestAddOutOfOrder(t *testing.T) {
+	database := createBlankDb()
+
+	// Children before parents
+	err := database.AddTicket(db.Ticket{ID: "a", OrganizationID: 101, SubmitterID: 1, AssigneeID: 2})
+	assert.NoError(t, err, "error adding ticket")
+	err = database.AddUser(db.User{ID: 1, OrganizationID: 101})
+	assert.NoError(t, err, "error adding user")
+	err = database.AddUser(db.User{ID: 2, OrganizationID: 101})
+	assert.NoError(t, err, "error adding user")
+	err = database.AddOrganization(db.Organization{ID: 101})
+	assert.NoError(t, err, "error adding org")
+
+	org, _ := database.GetOrganization(101)
+	assert.Equal(t, 3, len(org.GetRelated(database)), "org should have both users and the ticket")
+
+	submitter, _ := database.GetUser(1)
+	assert.Equal(t, 2, len(submitter.GetRelated(database)), "submitter should have the org and ticket")
+
+	assignee, _ := database.GetUser(2)
+	assert.Equal(t, 2, len(assignee.GetRelated(database)), "assignee should have the org and ticket")
+
+	ticket, _ := database.GetTicket("a")
+	assert.Equal(t, 3, len(ticket.GetRelated(database)), "ticket should have the org and both users")
+
+	// Same result as loading in order
+	loaded := createLoadedDB()
+	reversed := db.New()
+	for _, id := range []string{"436bf9b0-1147-4c0a-8439-6f79833bff5b", "1a227508-9f39-427c-8f57-1b72f3fab87c"} {
+		ticket, _ := loaded.GetTicket(id)
+		reversed.AddTicket(*ticket)
+		for _, related := range ticket.GetRelated(loaded) {
+			switch val := related.(type) {
+			case *db.User:
+				reversed.AddUser(*val)
+			case *db.Organization:
+				reversed.AddOrganization(*val)
+			}
+		}
+	}
+	for _, id := range []string{"436bf9b0-1147-4c0a-8439-6f79833bff5b", "1a227508-9f39-427c-8f57-1b72f3fab87c"} {
+		expected, _ := loaded.GetTicket(id)
+		actual, _ := reversed.GetTicket(id)
+		assert.Equal(t, len(expected.GetRelated(loaded)), len(actual.GetRelated(reversed)), "related missmatch for %s", id)
+	}
+}
+
+func TestUpdateAndDelete(t *testing.T) {
+	database := createLoadedDB()
+
+	// Update
+	usr, _ := database.GetUser(1)
+	updated := *usr
+	updated.Name = "Paul Sarda"
+	updated.OrganizationID = 101
+	err := database.UpdateUser(updated)
+	assert.NoError(t, err, "error updating user")
+
+	usr, _ = database.GetUser(1)
+	assert.Equal(t, "Paul Sarda", usr.Name)
+	org, _ := database.GetOrganization(101)
+	assert.Equal(t, 9, len(org.GetRelated(database)), "updated user should have moved org")
+	org, _ = database.GetOrganization(119)
+	for _, related := range org.GetRelated(database) {
+		assert.False(t, related.GetResourceType() == db.ResourceUser && related.GetKey() == "1",
+			"updated user should have left old org",
+		)
+	}
+
+	err = database.UpdateUser(db.User{ID: 1000})
+	assert.ErrorIs(t, err, db.ErrNotFound, "update should need an existing user")
+	err = database.UpdateOrganization(db.Organization{ID: 1000})
+	assert.ErrorIs(t, err, db.ErrNotFound, "update should need an existing org")
+	err = database.UpdateTicket(db.Ticket{ID: "mr-garbage"})
+	assert.ErrorIs(t, err, db.ErrNotFound, "update should need an existing ticket")
+
+	// Delete
+	ticket, _ := database.GetTicket("436bf9b0-1147-4c0a-8439-6f79833bff5b")
+	err = database.DeleteTicket(ticket.ID)
+	assert.NoError(t, err, "error deleting ticket")
+	_, err = database.GetTicket(ticket.ID)
+	assert.ErrorIs(t, err, db.ErrNotFound)
+	assignee, _ := database.GetUser(ticket.AssigneeID)
+	for _, related := range assignee.GetRelated(database) {
+		assert.NotEqual(t, ticket.ID, related.GetKey(), "deleted ticket still related")
+	}
+
+	err = database.DeleteUser(1)
+	assert.NoError(t, err, "error deleting user")
+	_, err = database.GetUser(1)
+	assert.ErrorIs(t, err, db.ErrNotFound)
+	org, _ = database.GetOrganization(101)
+	assert.Equal(t, 8, len(org.GetRelated(database)), "deleted user still related")
+
+	err = database.DeleteOrganization(101)
+	assert.NoError(t, err, "error deleting org")
+	_, err = database.GetOrganization(101)
+	assert.ErrorIs(t, err, db.ErrNotFound)
+
+	assert.ErrorIs(t, database.DeleteOrganization(101), db.ErrNotFound)
+	assert.ErrorIs(t, database.DeleteUser(1), db.ErrNotFound)
+	assert.ErrorIs(t, database.DeleteTicket(ticket.ID), db.ErrNotFound)
+}
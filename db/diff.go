@@ -0,0 +1,241 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+)
+
+// FieldDiff is a field which has a different value
+type FieldDiff struct {
+	Field  string      `json:"field"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+	// Added and Removed are the items which changed in list fields like tags
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// RecordDiff is a record which was added, removed or modified. Record is
+// the added or removed record and Fields the changes to a modified one
+type RecordDiff struct {
+	Resource ResourceType `json:"resource"`
+	Key      string       `json:"key"`
+	Record   Data         `json:"record,omitempty"`
+	Fields   []FieldDiff  `json:"fields,omitempty"`
+}
+
+type DiffReport struct {
+	Added    []RecordDiff `json:"added"`
+	Removed  []RecordDiff `json:"removed"`
+	Modified []RecordDiff `json:"modified"`
+}
+
+// Empty is true if the datasets are the same
+func (r *DiffReport) Empty() bool {
+	return len(r.Added) == 0 && len(r.Removed) == 0 && len(r.Modified) == 0
+}
+
+func diffValue(value interface{}) string {
+	if str, ok := value.(string); ok {
+		return fmt.Sprintf("%q", str)
+	}
+	if value == nil {
+		return "null"
+	}
+	valueJson, _ := json.Marshal(value)
+	return string(valueJson)
+}
+
+// Write writes the report as text. Added records are prefixed with +,
+// removed with - and modified with ~ followed by the changed fields.
+func (r *DiffReport) Write(w io.Writer) error {
+	for _, added := range r.Added {
+		if _, err := fmt.Fprintf(w, "+ %s %s\n", added.Resource, added.Key); err != nil {
+			return err
+		}
+	}
+	for _, removed := range r.Removed {
+		if _, err := fmt.Fprintf(w, "- %s %s\n", removed.Resource, removed.Key); err != nil {
+			return err
+		}
+	}
+	for _, modified := range r.Modified {
+		if _, err := fmt.Fprintf(w, "~ %s %s\n", modified.Resource, modified.Key); err != nil {
+			return err
+		}
+		for _, field := range modified.Fields {
+			var err error
+			if field.Added != nil || field.Removed != nil {
+				_, err = fmt.Fprintf(w, "\t%s: +%v -%v\n", field.Field, field.Added, field.Removed)
+			} else {
+				_, err = fmt.Fprintf(w, "\t%s: %s -> %s\n", field.Field, diffValue(field.Before), diffValue(field.After))
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "%d added, %d removed, %d modified\n", len(r.Added), len(r.Removed), len(r.Modified))
+	return err
+}
+
+// recordValues decodes a record into its json fields
+func recordValues(record Data) (map[string]interface{}, error) {
+	recordJson, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(recordJson))
+	dec.UseNumber()
+
+	var result map[string]interface{}
+	if err := dec.Decode(&result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// listChanges returns the items only in after and the items only in before
+func listChanges(before, after []interface{}) ([]string, []string) {
+	count := func(list []interface{}) map[string]int {
+		result := make(map[string]int)
+		for _, item := range list {
+			result[fmt.Sprintf("%v", item)]++
+		}
+		return result
+	}
+	beforeCount, afterCount := count(before), count(after)
+
+	added, removed := []string{}, []string{}
+	for _, item := range after {
+		key := fmt.Sprintf("%v", item)
+		if beforeCount[key] > 0 {
+			beforeCount[key]--
+		} else {
+			added = append(added, key)
+		}
+	}
+	for _, item := range before {
+		key := fmt.Sprintf("%v", item)
+		if afterCount[key] > 0 {
+			afterCount[key]--
+		} else {
+			removed = append(removed, key)
+		}
+	}
+
+	return added, removed
+}
+
+// diffRecords lists the fields which differ in declaration order followed
+// by the extra attributes which differ in name order
+func diffRecords(before, after Data) ([]FieldDiff, error) {
+	fields, err := Fields(before.GetResourceType())
+	if err != nil {
+		return nil, err
+	}
+	beforeValues, err := recordValues(before)
+	if err != nil {
+		return nil, err
+	}
+	afterValues, err := recordValues(after)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []FieldDiff
+	for _, field := range fields {
+		beforeValue, afterValue := beforeValues[field.Name], afterValues[field.Name]
+		if reflect.DeepEqual(beforeValue, afterValue) {
+			continue
+		}
+
+		change := FieldDiff{Field: field.Name, Before: beforeValue, After: afterValue}
+		if field.Kind == FieldList || field.Kind == FieldIntList {
+			beforeList, _ := beforeValue.([]interface{})
+			afterList, _ := afterValue.([]interface{})
+			change.Added, change.Removed = listChanges(beforeList, afterList)
+			if len(change.Added) == 0 && len(change.Removed) == 0 {
+				// Only the order changed
+				change.Added, change.Removed = nil, nil
+			}
+		}
+		result = append(result, change)
+	}
+
+	// Extra attributes are in the json alongside the fields
+	declared := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		declared[field.Name] = true
+	}
+	var extra []string
+	for _, values := range []map[string]interface{}{beforeValues, afterValues} {
+		for name := range values {
+			if !declared[name] {
+				declared[name] = true
+				extra = append(extra, name)
+			}
+		}
+	}
+	sort.Strings(extra)
+	for _, name := range extra {
+		beforeValue, afterValue := beforeValues[name], afterValues[name]
+		if compareExtra(beforeValue, afterValue) != 0 {
+			result = append(result, FieldDiff{Field: name, Before: beforeValue, After: afterValue})
+		}
+	}
+
+	return result, nil
+}
+
+// Diff lists the records which were added, removed or modified going from
+// before to after. Records are matched by ID.
+func Diff(before, after *DB) (*DiffReport, error) {
+	result := &DiffReport{Added: []RecordDiff{}, Removed: []RecordDiff{}, Modified: []RecordDiff{}}
+	if before.store == after.store {
+		return result, nil
+	}
+
+	// The locks are always taken in the same order so Diffs going opposite
+	// ways can't each hold one while a writer waits on the other
+	first, second := before, after
+	if reflect.ValueOf(after.store).Pointer() < reflect.ValueOf(before.store).Pointer() {
+		first, second = after, before
+	}
+	first.rlock()
+	defer first.runlock()
+	second.rlock()
+	defer second.runlock()
+
+	for _, resource := range resourceOrder {
+		for _, record := range after.sortedRecords(resource) {
+			if before.get(resource, record.GetKey()) == nil {
+				result.Added = append(result.Added, RecordDiff{Resource: resource, Key: record.GetKey(), Record: record})
+			}
+		}
+
+		for _, record := range before.sortedRecords(resource) {
+			changed := after.get(resource, record.GetKey())
+			if changed == nil {
+				result.Removed = append(result.Removed, RecordDiff{Resource: resource, Key: record.GetKey(), Record: record})
+				continue
+			}
+
+			fields, err := diffRecords(record, changed)
+			if err != nil {
+				return nil, err
+			}
+			if len(fields) > 0 {
+				result.Modified = append(result.Modified, RecordDiff{Resource: resource, Key: record.GetKey(), Fields: fields})
+			}
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,102 @@
+package db_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/sardap/zendesk/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiff(t *testing.T) {
+	before := createBlankDb()
+	before.AddOrganization(db.Organization{ID: 101, Name: "Enthaze", DomainNames: []string{"kage.com", "ecratic.com"}})
+	before.AddOrganization(db.Organization{ID: 102, Name: "Nutralab"})
+	before.AddUser(db.User{ID: 1, Name: "a", Tags: []string{"x", "y"}})
+	before.AddTicket(db.Ticket{ID: "a", Status: "open", AssigneeID: 1})
+
+	after := createBlankDb()
+	after.AddOrganization(db.Organization{ID: 101, Name: "Enthaze", DomainNames: []string{"kage.com", "zentix.com"}})
+	after.AddUser(db.User{ID: 1, Name: "a", Tags: []string{"y", "x"}})
+	after.AddUser(db.User{ID: 2, Name: "b"})
+	after.AddTicket(db.Ticket{ID: "a", Status: "solved", AssigneeID: 2})
+
+	report, err := db.Diff(before, after)
+	assert.NoError(t, err)
+	assert.False(t, report.Empty())
+
+	if assert.Equal(t, 1, len(report.Added)) {
+		assert.Equal(t, db.ResourceUser, report.Added[0].Resource)
+		assert.Equal(t, "2", report.Added[0].Key)
+	}
+	if assert.Equal(t, 1, len(report.Removed)) {
+		assert.Equal(t, db.ResourceOrganization, report.Removed[0].Resource)
+		assert.Equal(t, "102", report.Removed[0].Key)
+	}
+	if assert.Equal(t, 3, len(report.Modified), "org domains, user tag order and ticket should be modified") {
+		org := report.Modified[0]
+		assert.Equal(t, "101", org.Key)
+		if assert.Equal(t, 1, len(org.Fields)) {
+			assert.Equal(t, "domain_names", org.Fields[0].Field)
+			assert.Equal(t, []string{"zentix.com"}, org.Fields[0].Added)
+			assert.Equal(t, []string{"ecratic.com"}, org.Fields[0].Removed)
+		}
+
+		usr := report.Modified[1]
+		if assert.Equal(t, 1, len(usr.Fields)) {
+			assert.Equal(t, "tags", usr.Fields[0].Field)
+			assert.Nil(t, usr.Fields[0].Added, "reordering shouldn't add or remove tags")
+		}
+
+		ticket := report.Modified[2]
+		if assert.Equal(t, 2, len(ticket.Fields)) {
+			assert.Equal(t, "status", ticket.Fields[0].Field)
+			assert.Equal(t, "open", ticket.Fields[0].Before)
+			assert.Equal(t, "solved", ticket.Fields[0].After)
+			assert.Equal(t, "assignee_id", ticket.Fields[1].Field)
+			assert.Equal(t, json.Number("1"), ticket.Fields[1].Before)
+		}
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, report.Write(&buf))
+	assert.Contains(t, buf.String(), "+ user 2\n")
+	assert.Contains(t, buf.String(), "- organization 102\n")
+	assert.Contains(t, buf.String(), "\tstatus: \"open\" -> \"solved\"\n")
+	assert.Contains(t, buf.String(), "\tdomain_names: +[zentix.com] -[ecratic.com]\n")
+	assert.Contains(t, buf.String(), "1 added, 1 removed, 3 modified\n")
+
+	_, err = json.Marshal(report)
+	assert.NoError(t, err)
+
+	// Extra attributes
+	before = createBlankDb()
+	before.AddUser(db.User{ID: 1, Extra: map[string]json.RawMessage{
+		"user_fields":    json.RawMessage(`{"tier": "vip"}`),
+		"iana_time_zone": json.RawMessage(`"Australia/Melbourne"`),
+		"seats":          json.RawMessage(`10`),
+	}})
+	after = createBlankDb()
+	after.AddUser(db.User{ID: 1, Extra: map[string]json.RawMessage{
+		"user_fields":        json.RawMessage(`{"tier": "basic"}`),
+		"seats":              json.RawMessage(`10.0`),
+		"ticket_restriction": json.RawMessage(`"requested"`),
+	}})
+	report, err = db.Diff(before, after)
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(report.Modified)) {
+		var names []string
+		for _, field := range report.Modified[0].Fields {
+			names = append(names, field.Field)
+		}
+		assert.Equal(t, []string{"iana_time_zone", "ticket_restriction", "user_fields"}, names, "10 and 10.0 are the same number")
+		assert.Equal(t, "Australia/Melbourne", report.Modified[0].Fields[0].Before)
+		assert.Nil(t, report.Modified[0].Fields[0].After)
+	}
+
+	// Same data
+	report, err = db.Diff(createLoadedDB(), createLoadedDB())
+	assert.NoError(t, err)
+	assert.True(t, report.Empty())
+}
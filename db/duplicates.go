@@ -0,0 +1,160 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrDuplicateKey  error
+	ErrInvalidPolicy error
+)
+
+func init() {
+	ErrDuplicateKey = fmt.Errorf("duplicate key")
+	ErrInvalidPolicy = fmt.Errorf("unknown duplicate policy")
+}
+
+// DuplicatePolicy decides what happens when a record is added with the same
+// key as an existing one
+type DuplicatePolicy string
+
+const (
+	// DuplicateKeepLast replaces the existing record. This is the default
+	DuplicateKeepLast DuplicatePolicy = "last"
+	// DuplicateKeepFirst ignores the new record
+	DuplicateKeepFirst DuplicatePolicy = "first"
+	// DuplicateKeepNewest keeps whichever record has the latest created_at
+	DuplicateKeepNewest DuplicatePolicy = "newest"
+	// DuplicateMerge keeps the existing record's attributes the new record
+	// doesn't give, combines their lists and merges objects like user_fields
+	// key by key. An attribute the new record gives wins even if it's false
+	// or empty
+	DuplicateMerge DuplicatePolicy = "merge"
+	// DuplicateError fails with ErrDuplicateKey
+	DuplicateError DuplicatePolicy = "error"
+)
+
+func createdAt(record interface{}) time.Time {
+	switch val := record.(type) {
+	case *Organization:
+		return val.CreatedAt.Time
+	case *User:
+		return val.CreatedAt.Time
+	case *Ticket:
+		return val.CreatedAt.Time
+	}
+	return time.Time{}
+}
+
+func mergeStrings(existing, toAdd []string) []string {
+	result := append([]string{}, existing...)
+	for _, val := range toAdd {
+		found, _ := matchStringArray(result, val)
+		if !found {
+			result = append(result, val)
+		}
+	}
+	return result
+}
+
+// mergeObjects lays given over existing, merging json objects in both key by
+// key all the way down. Anything else given replaces what's there
+func mergeObjects(existing, given json.RawMessage) (json.RawMessage, error) {
+	var existingObj, givenObj map[string]json.RawMessage
+	if json.Unmarshal(existing, &existingObj) != nil || json.Unmarshal(given, &givenObj) != nil {
+		return given, nil
+	}
+	// null unmarshals into a nil map
+	if existingObj == nil || givenObj == nil {
+		return given, nil
+	}
+
+	for name, value := range givenObj {
+		merged, err := mergeObjects(existingObj[name], value)
+		if err != nil {
+			return nil, err
+		}
+		existingObj[name] = merged
+	}
+
+	return json.Marshal(existingObj)
+}
+
+// mergeRecord sets toAdd to the existing record with the attributes given in
+// raw, the json toAdd was parsed from, laid over it. A given attribute wins
+// even if it's false, empty or 0, except string lists which are combined and
+// objects which are merged with mergeObjects. Every attribute of toAdd is
+// taken to be given if raw is nil
+func mergeRecord(existing, toAdd Data, raw json.RawMessage) error {
+	existingJson, err := json.Marshal(existing)
+	if err != nil {
+		return err
+	}
+	if raw == nil {
+		if raw, err = json.Marshal(toAdd); err != nil {
+			return err
+		}
+	}
+
+	var merged, given map[string]json.RawMessage
+	if err := json.Unmarshal(existingJson, &merged); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw, &given); err != nil {
+		return err
+	}
+	for name, value := range given {
+		field, err := LookupField(toAdd.GetResourceType(), name)
+		if err != nil || field.Kind != FieldList {
+			if merged[name], err = mergeObjects(merged[name], value); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var existingList, addList []string
+		json.Unmarshal(merged[name], &existingList)
+		if err := json.Unmarshal(value, &addList); err != nil {
+			return err
+		}
+		if merged[name], err = json.Marshal(mergeStrings(existingList, addList)); err != nil {
+			return err
+		}
+	}
+
+	mergedJson, err := json.Marshal(merged)
+	if err != nil {
+		return err
+	}
+	record := reflect.ValueOf(toAdd).Elem()
+	record.Set(reflect.Zero(record.Type()))
+
+	return json.Unmarshal(mergedJson, toAdd)
+}
+
+// resolveDuplicate returns if toAdd should replace existing. toAdd may be
+// modified by the policy. raw is the json toAdd was parsed from if it was
+func resolveDuplicate(policy DuplicatePolicy, existing, toAdd Data, raw json.RawMessage) (bool, error) {
+	switch policy {
+	case DuplicateKeepLast, "":
+		return true, nil
+	case DuplicateKeepFirst:
+		return false, nil
+	case DuplicateKeepNewest:
+		return !createdAt(toAdd).Before(createdAt(existing)), nil
+	case DuplicateMerge:
+		if err := mergeRecord(existing, toAdd, raw); err != nil {
+			return false, err
+		}
+		return true, nil
+	case DuplicateError:
+		return false, errors.Wrapf(ErrDuplicateKey, "%s %s", toAdd.GetResourceType(), toAdd.GetKey())
+	}
+
+	return false, errors.Wrapf(ErrInvalidPolicy, "%s", policy)
+}
@@ -0,0 +1,182 @@
+package db_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sardap/zendesk/db"
+	"github.com/stretchr/testify/assert"
+)
+
+const duplicateUsers = `[
+  {"_id": 1, "name": "first", "organization_id": 101, "created_at": "2016-04-15T05:19:46 -10:00", "tags": ["a", "b"]},
+  {"_id": 2, "name": "other", "organization_id": 101},
+  {"_id": 1, "organization_id": 102, "created_at": "2015-04-15T05:19:46 -10:00", "email": "a@b.com", "tags": ["b", "c"]}
+]`
+
+func TestDuplicatePolicies(t *testing.T) {
+	testCases := []struct {
+		policy db.DuplicatePolicy
+		check  func(usr *db.User)
+	}{
+		{
+			policy: db.DuplicateKeepLast,
+			check: func(usr *db.User) {
+				assert.Equal(t, "", usr.Name)
+				assert.Equal(t, int64(102), usr.OrganizationID)
+			},
+		},
+		{
+			policy: db.DuplicateKeepFirst,
+			check: func(usr *db.User) {
+				assert.Equal(t, "first", usr.Name)
+				assert.Equal(t, int64(101), usr.OrganizationID)
+			},
+		},
+		{
+			policy: db.DuplicateKeepNewest,
+			check: func(usr *db.User) {
+				assert.Equal(t, "first", usr.Name)
+				assert.Equal(t, int64(101), usr.OrganizationID)
+			},
+		},
+		{
+			policy: db.DuplicateMerge,
+			check: func(usr *db.User) {
+				assert.Equal(t, "first", usr.Name)
+				assert.Equal(t, "a@b.com", usr.Email)
+				assert.Equal(t, int64(102), usr.OrganizationID)
+				assert.Equal(t, []string{"a", "b", "c"}, usr.Tags)
+				assert.Equal(t, 2015, usr.CreatedAt.Year())
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		var report db.LoadReport
+		database := db.New()
+		database.AddOrganization(db.Organization{ID: 101})
+		database.AddOrganization(db.Organization{ID: 102})
+		err := database.Import(db.ResourceUser, strings.NewReader(duplicateUsers), db.LoadOptions{
+			Duplicates: testCase.policy,
+			Report:     &report,
+		})
+		assert.NoErrorf(t, err, "policy %s", testCase.policy)
+		assert.Equalf(t, []db.DuplicateKey{{Resource: db.ResourceUser, Key: "1", Count: 2}}, report.Duplicates,
+			"policy %s", testCase.policy,
+		)
+
+		usr, err := database.GetUser(1)
+		assert.NoError(t, err)
+		testCase.check(usr)
+
+		// Back references shouldn't pile up or point at the replaced record
+		org, _ := database.GetOrganization(usr.OrganizationID)
+		otherID := int64(101)
+		if usr.OrganizationID == 101 {
+			otherID = 102
+		}
+		other, _ := database.GetOrganization(otherID)
+		orgUsers := len(org.GetRelated(database))
+		otherUsers := len(other.GetRelated(database))
+		if usr.OrganizationID == 101 {
+			assert.Equalf(t, 2, orgUsers, "policy %s", testCase.policy)
+			assert.Equalf(t, 0, otherUsers, "policy %s", testCase.policy)
+		} else {
+			assert.Equalf(t, 1, orgUsers, "policy %s", testCase.policy)
+			assert.Equalf(t, 1, otherUsers, "policy %s", testCase.policy)
+		}
+	}
+
+	// Error
+	err := db.New().Import(db.ResourceUser, strings.NewReader(duplicateUsers), db.LoadOptions{
+		Duplicates: db.DuplicateError,
+	})
+	assert.ErrorIs(t, err, db.ErrDuplicateKey)
+	var loadErr *db.LoadError
+	if assert.ErrorAs(t, err, &loadErr) {
+		assert.Equal(t, 2, loadErr.Index)
+	}
+
+	// Lenient skips the duplicate
+	var report db.LoadReport
+	database := db.New()
+	err = database.Import(db.ResourceUser, strings.NewReader(duplicateUsers), db.LoadOptions{
+		Duplicates: db.DuplicateError,
+		Lenient:    true,
+		Report:     &report,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(report.Skipped))
+	usr, _ := database.GetUser(1)
+	assert.Equal(t, "first", usr.Name)
+}
+
+func TestMergeGivenZeroValues(t *testing.T) {
+	users := `[
+  {"_id": 1, "name": "first", "active": true, "tags": ["a"], "role": "admin"},
+  {"_id": 1, "name": "", "active": false, "tags": []}
+]`
+	database := db.New()
+	err := database.Import(db.ResourceUser, strings.NewReader(users), db.LoadOptions{
+		Duplicates: db.DuplicateMerge,
+	})
+	assert.NoError(t, err)
+
+	usr, err := database.GetUser(1)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "", usr.Name)
+		assert.False(t, usr.Active)
+		assert.Equal(t, []string{"a"}, usr.Tags)
+		assert.Equal(t, "admin", usr.Role)
+	}
+}
+
+func TestMergeNestedObjects(t *testing.T) {
+	tickets := `[
+  {"_id": "a", "custom_fields": {"priority": {"level": 1, "team": "ops"}, "region": "apac"}},
+  {"_id": "a", "custom_fields": {"priority": {"level": 2}, "product": null}}
+]`
+	database := db.New()
+	err := database.Import(db.ResourceTicket, strings.NewReader(tickets), db.LoadOptions{
+		Duplicates: db.DuplicateMerge,
+	})
+	assert.NoError(t, err)
+
+	ticket, err := database.GetTicket("a")
+	if assert.NoError(t, err) {
+		assert.JSONEq(t,
+			`{"priority": {"level": 2, "team": "ops"}, "region": "apac", "product": null}`,
+			string(ticket.Extra["custom_fields"]),
+		)
+	}
+
+	users := `[
+  {"_id": 1, "user_fields": {"b": 2}},
+  {"_id": 1, "user_fields": {"a": 1}}
+]`
+	database = db.New()
+	err = database.Import(db.ResourceUser, strings.NewReader(users), db.LoadOptions{
+		Duplicates: db.DuplicateMerge,
+	})
+	assert.NoError(t, err)
+
+	usr, err := database.GetUser(1)
+	if assert.NoError(t, err) {
+		assert.JSONEq(t, `{"a": 1, "b": 2}`, string(usr.Extra["user_fields"]))
+	}
+}
+
+func TestAddReplacesLinks(t *testing.T) {
+	database := createBlankDb()
+	database.AddUser(db.User{ID: 1})
+	database.AddUser(db.User{ID: 2})
+	database.AddTicket(db.Ticket{ID: "a", AssigneeID: 1})
+	database.AddTicket(db.Ticket{ID: "a", AssigneeID: 2})
+	database.AddTicket(db.Ticket{ID: "a", AssigneeID: 2})
+
+	usr, _ := database.GetUser(1)
+	assert.Equal(t, 0, len(usr.GetRelated(database)), "old assignee should have lost the ticket")
+	usr, _ = database.GetUser(2)
+	assert.Equal(t, 1, len(usr.GetRelated(database)), "new assignee should have the ticket once")
+}
@@ -0,0 +1,502 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sardap/zendesk/utility"
+)
+
+type FieldKind string
+
+const (
+	FieldString FieldKind = "string"
+	FieldInt    FieldKind = "int"
+	FieldBool   FieldKind = "bool"
+	FieldTime   FieldKind = "time"
+	// FieldList is a list of strings like tags
+	FieldList FieldKind = "list"
+	// FieldIntList is a list of ids like group_memberships
+	FieldIntList FieldKind = "int_list"
+	// FieldExtra is a path into an attribute the struct has no field for
+	// like custom_fields.360001234. It holds whatever json the record has
+	FieldExtra FieldKind = "extra"
+)
+
+var (
+	zendeskTimeType = reflect.TypeOf(utility.ZendeskTime{})
+	extraType       = reflect.TypeOf(map[string]json.RawMessage{})
+)
+
+// Field is a json field of a resource. The accessors read it from any record
+// of that resource without a hand written switch per type.
+type Field struct {
+	Name string
+	Kind FieldKind
+	// index of the struct field. For FieldExtra the index of the map of
+	// extra attributes
+	index int
+	// path through the extra attribute for FieldExtra
+	path []string
+}
+
+type fieldSet struct {
+	fields []*Field
+	byName map[string]*Field
+	names  []string
+	// every json name the struct has a field for
+	known map[string]bool
+	// index of the map[string]json.RawMessage holding the attributes the
+	// struct has no field for or -1
+	extra int
+}
+
+var fieldRegistry = make(map[ResourceType]*fieldSet)
+
+func fieldKind(typ reflect.Type) (FieldKind, bool) {
+	switch {
+	case typ == zendeskTimeType:
+		return FieldTime, true
+	case typ.Kind() == reflect.String:
+		return FieldString, true
+	case typ.Kind() == reflect.Int64:
+		return FieldInt, true
+	case typ.Kind() == reflect.Bool:
+		return FieldBool, true
+	case typ.Kind() == reflect.Slice && typ.Elem().Kind() == reflect.String:
+		return FieldList, true
+	case typ.Kind() == reflect.Slice && typ.Elem().Kind() == reflect.Int64:
+		return FieldIntList, true
+	}
+
+	return "", false
+}
+
+// registerFields builds the fields of a resource from the json tags of its
+// struct. Fields of types which can't be matched are left out.
+func registerFields(resource ResourceType, record interface{}) {
+	typ := reflect.TypeOf(record)
+	set := &fieldSet{byName: make(map[string]*Field), known: make(map[string]bool), extra: -1}
+
+	for i := 0; i < typ.NumField(); i++ {
+		if typ.Field(i).Type == extraType {
+			set.extra = i
+			continue
+		}
+		name := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		set.known[name] = true
+		kind, ok := fieldKind(typ.Field(i).Type)
+		if !ok {
+			continue
+		}
+
+		field := &Field{Name: name, Kind: kind, index: i}
+		set.fields = append(set.fields, field)
+		set.byName[name] = field
+		set.names = append(set.names, name)
+	}
+
+	fieldRegistry[resource] = set
+}
+
+// Fields lists the fields of a resource in declaration order
+func Fields(resource ResourceType) ([]*Field, error) {
+	set, ok := fieldRegistry[resource]
+	if !ok {
+		return nil, errors.Wrapf(ErrInvalidResouce, "%s", resource)
+	}
+
+	return set.fields, nil
+}
+
+// LookupField fails with ErrFieldMissing listing the valid fields if the
+// resource has no field called name. A dotted name like user_fields.tier is
+// a path into an extra attribute if the resource keeps them
+func LookupField(resource ResourceType, name string) (*Field, error) {
+	set, ok := fieldRegistry[resource]
+	if !ok {
+		return nil, errors.Wrapf(ErrInvalidResouce, "%s", resource)
+	}
+
+	field, ok := set.byName[name]
+	if !ok {
+		path := strings.Split(name, ".")
+		if len(path) > 1 && set.extra >= 0 && !set.known[path[0]] {
+			return &Field{Name: name, Kind: FieldExtra, index: set.extra, path: path}, nil
+		}
+		return nil, errors.Wrapf(ErrFieldMissing,
+			"%s has no field %s, valid fields are %s", resource, name, strings.Join(set.names, ", "),
+		)
+	}
+
+	return field, nil
+}
+
+// unknownFields returns the attributes of the json object which the
+// resource has no field for or nil if there aren't any
+func unknownFields(resource ResourceType, data []byte) (map[string]json.RawMessage, error) {
+	var result map[string]json.RawMessage
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+
+	for name, value := range result {
+		if fieldRegistry[resource].known[name] {
+			delete(result, name)
+			continue
+		}
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, value); err != nil {
+			return nil, err
+		}
+		result[name] = compact.Bytes()
+	}
+	if len(result) == 0 {
+		return nil, nil
+	}
+
+	return result, nil
+}
+
+// withExtra adds the extra attributes to the end of a json object in name
+// order
+func withExtra(data []byte, extra map[string]json.RawMessage) ([]byte, error) {
+	if len(extra) == 0 {
+		return data, nil
+	}
+
+	names := make([]string, 0, len(extra))
+	for name := range extra {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	buf.Write(data[:len(data)-1])
+	for i, name := range names {
+		if i > 0 || len(data) > 2 {
+			buf.WriteByte(',')
+		}
+		nameJson, err := json.Marshal(name)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(nameJson)
+		buf.WriteByte(':')
+		buf.Write(extra[name])
+	}
+	buf.WriteByte('}')
+
+	return buf.Bytes(), nil
+}
+
+func (f *Field) value(record Data) reflect.Value {
+	return reflect.ValueOf(record).Elem().Field(f.index)
+}
+
+// Value returns the field as a string, int64, bool, time.Time or []string
+// depending on its Kind
+func (f *Field) Value(record Data) interface{} {
+	switch f.Kind {
+	case FieldExtra:
+		return f.Extra(record)
+	case FieldString:
+		return f.String(record)
+	case FieldInt:
+		return f.Int(record)
+	case FieldBool:
+		return f.Bool(record)
+	case FieldTime:
+		return f.Time(record)
+	case FieldList:
+		return f.List(record)
+	case FieldIntList:
+		return f.IntList(record)
+	}
+
+	return nil
+}
+
+func (f *Field) String(record Data) string {
+	return f.value(record).String()
+}
+
+func (f *Field) Int(record Data) int64 {
+	return f.value(record).Int()
+}
+
+func (f *Field) Bool(record Data) bool {
+	return f.value(record).Bool()
+}
+
+// Time and List go through a pointer to the field since converting the
+// field itself to an interface allocates
+
+func (f *Field) Time(record Data) time.Time {
+	return f.value(record).Addr().Interface().(*utility.ZendeskTime).Time
+}
+
+func (f *Field) List(record Data) []string {
+	return *f.value(record).Addr().Interface().(*[]string)
+}
+
+func (f *Field) IntList(record Data) []int64 {
+	return *f.value(record).Addr().Interface().(*[]int64)
+}
+
+// Extra decodes the value at the path or returns nil if the record doesn't
+// have it. Numbers are json.Number. Going into a list picks the item with
+// that id, and its value if it has one, so custom_fields.360001234 is the
+// value of the custom field with id 360001234
+func (f *Field) Extra(record Data) interface{} {
+	extra := *f.value(record).Addr().Interface().(*map[string]json.RawMessage)
+	raw, ok := extra[f.path[0]]
+	if !ok {
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var result interface{}
+	if err := dec.Decode(&result); err != nil {
+		return nil
+	}
+
+	for _, name := range f.path[1:] {
+		switch val := result.(type) {
+		case map[string]interface{}:
+			result = val[name]
+		case []interface{}:
+			result = nil
+			for _, item := range val {
+				obj, ok := item.(map[string]interface{})
+				if !ok || fmt.Sprint(obj["id"]) != name {
+					continue
+				}
+				result = obj
+				if value, ok := obj["value"]; ok {
+					result = value
+				}
+				break
+			}
+		default:
+			return nil
+		}
+	}
+
+	return result
+}
+
+// hasExtra is true if the record has the attribute at the start of the path
+func (f *Field) hasExtra(record Data) bool {
+	_, ok := (*f.value(record).Addr().Interface().(*map[string]json.RawMessage))[f.path[0]]
+	return ok
+}
+
+// matchExtra compares value with a decoded json value according to its type.
+// Lists match if any item does and a missing value matches ""
+func matchExtra(actual interface{}, value string) bool {
+	switch val := actual.(type) {
+	case nil:
+		return value == ""
+	case string:
+		return val == value
+	case json.Number:
+		expected, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return false
+		}
+		number, err := val.Float64()
+		return err == nil && number == expected
+	case bool:
+		expected, err := strconv.ParseBool(value)
+		return err == nil && val == expected
+	case []interface{}:
+		for _, item := range val {
+			if matchExtra(item, value) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Match parses value as the field's kind and compares it with the record's
+// value. Lists match if any item is value.
+func (f *Field) Match(record Data, value string) (bool, error) {
+	match, err := f.matchFunc(value)
+	if err != nil {
+		return false, err
+	}
+
+	return match(record), nil
+}
+
+// matchFunc parses value once so it can be matched against many records
+func (f *Field) matchFunc(value string) (func(record Data) bool, error) {
+	switch f.Kind {
+	case FieldInt:
+		expected, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "given value should be base 10")
+		}
+		return func(record Data) bool { return f.Int(record) == expected }, nil
+	case FieldBool:
+		expected, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(record Data) bool { return f.Bool(record) == expected }, nil
+	case FieldTime:
+		expected, err := time.Parse(utility.ZendeskTimeFormat, value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "time should be in %s format", utility.ZendeskTimeFormat)
+		}
+		return func(record Data) bool { return f.Time(record).Equal(expected) }, nil
+	case FieldList:
+		return func(record Data) bool {
+			for _, item := range f.List(record) {
+				if item == value {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case FieldIntList:
+		expected, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "given value should be base 10")
+		}
+		return func(record Data) bool {
+			for _, item := range f.IntList(record) {
+				if item == expected {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case FieldExtra:
+		return func(record Data) bool { return matchExtra(f.Extra(record), value) }, nil
+	}
+
+	return func(record Data) bool { return f.String(record) == value }, nil
+}
+
+// Compare returns -1, 0 or 1 if a's value is less, equal or greater than
+// b's. Lists compare item by item.
+func (f *Field) Compare(a, b Data) int {
+	switch f.Kind {
+	case FieldInt:
+		return compareInt64(f.Int(a), f.Int(b))
+	case FieldBool:
+		return compareBool(f.Bool(a), f.Bool(b))
+	case FieldTime:
+		aTime, bTime := f.Time(a), f.Time(b)
+		if aTime.Before(bTime) {
+			return -1
+		} else if aTime.After(bTime) {
+			return 1
+		}
+		return 0
+	case FieldList:
+		aList, bList := f.List(a), f.List(b)
+		for i := 0; i < len(aList) && i < len(bList); i++ {
+			if result := strings.Compare(aList[i], bList[i]); result != 0 {
+				return result
+			}
+		}
+		return compareInt64(int64(len(aList)), int64(len(bList)))
+	case FieldIntList:
+		aList, bList := f.IntList(a), f.IntList(b)
+		for i := 0; i < len(aList) && i < len(bList); i++ {
+			if result := compareInt64(aList[i], bList[i]); result != 0 {
+				return result
+			}
+		}
+		return compareInt64(int64(len(aList)), int64(len(bList)))
+	case FieldExtra:
+		return compareExtra(f.Extra(a), f.Extra(b))
+	}
+
+	return strings.Compare(f.String(a), f.String(b))
+}
+
+// compareExtra compares decoded json values. Numbers compare as numbers and
+// a missing value is less than any other. Values of different types or
+// which aren't numbers, strings or bools compare as json
+func compareExtra(a, b interface{}) int {
+	switch aVal := a.(type) {
+	case nil:
+		if b == nil {
+			return 0
+		}
+		return -1
+	case json.Number:
+		if bVal, ok := b.(json.Number); ok {
+			aNumber, aErr := aVal.Float64()
+			bNumber, bErr := bVal.Float64()
+			if aErr == nil && bErr == nil {
+				if aNumber < bNumber {
+					return -1
+				} else if aNumber > bNumber {
+					return 1
+				}
+				return 0
+			}
+		}
+	case string:
+		if bVal, ok := b.(string); ok {
+			return strings.Compare(aVal, bVal)
+		}
+	case bool:
+		if bVal, ok := b.(bool); ok {
+			return compareBool(aVal, bVal)
+		}
+	}
+	if b == nil {
+		return 1
+	}
+
+	aJson, _ := json.Marshal(a)
+	bJson, _ := json.Marshal(b)
+	return bytes.Compare(aJson, bJson)
+}
+
+func compareInt64(a, b int64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+func compareBool(a, b bool) int {
+	if a == b {
+		return 0
+	} else if !a {
+		return -1
+	}
+	return 1
+}
+
+// matchField matches any record against a field found in the registry
+func matchField(record Data, field, value string) (bool, error) {
+	found, err := LookupField(record.GetResourceType(), field)
+	if err != nil {
+		return false, err
+	}
+
+	return found.Match(record, value)
+}
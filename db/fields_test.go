@@ -0,0 +1,142 @@
+package db_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/sardap/zendesk/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFields(t *testing.T) {
+	fields, err := db.Fields(db.ResourceOrganization)
+	assert.NoError(t, err)
+	names := make([]string, len(fields))
+	for i, field := range fields {
+		names[i] = field.Name
+	}
+	assert.Equal(t, []string{
+		"_id", "url", "external_id", "name", "domain_names", "created_at", "details", "shared_tickets", "tags",
+	}, names, "fields should come from the json tags in declaration order")
+
+	_, err = db.Fields("garbage")
+	assert.ErrorIs(t, err, db.ErrInvalidResouce)
+
+	_, err = db.LookupField(db.ResourceTicket, "garbage")
+	assert.ErrorIs(t, err, db.ErrFieldMissing)
+	assert.Contains(t, err.Error(), "valid fields are _id, url, external_id, created_at, type", "error should list fields")
+
+	// Typed accessors
+	testCases := []struct {
+		resource db.ResourceType
+		record   db.Data
+		field    string
+		kind     db.FieldKind
+		value    interface{}
+	}{
+		{db.ResourceOrganization, &expectedOrg, "_id", db.FieldInt, int64(101)},
+		{db.ResourceOrganization, &expectedOrg, "domain_names", db.FieldList, expectedOrg.DomainNames},
+		{db.ResourceUser, &expectedUser, "active", db.FieldBool, true},
+		{db.ResourceTicket, &expectedTicket, "due_at", db.FieldTime, expectedTicket.DueAt.Time},
+		{db.ResourceTicket, &expectedTicket, "_id", db.FieldString, expectedTicket.ID},
+	}
+	for _, testCase := range testCases {
+		field, err := db.LookupField(testCase.resource, testCase.field)
+		if assert.NoErrorf(t, err, "%s %s missing", testCase.resource, testCase.field) {
+			assert.Equal(t, testCase.kind, field.Kind)
+			assert.Equal(t, testCase.value, field.Value(testCase.record))
+		}
+	}
+
+	// Compare
+	field, _ := db.LookupField(db.ResourceUser, "_id")
+	a, b := &db.User{ID: 1}, &db.User{ID: 2}
+	assert.Equal(t, -1, field.Compare(a, b))
+	assert.Equal(t, 1, field.Compare(b, a))
+	assert.Equal(t, 0, field.Compare(a, a))
+	field, _ = db.LookupField(db.ResourceUser, "tags")
+	assert.Equal(t, -1, field.Compare(&db.User{Tags: []string{"a"}}, &db.User{Tags: []string{"a", "b"}}))
+}
+
+func TestExtraFields(t *testing.T) {
+	database := createBlankDb()
+	err := database.Import(db.ResourceTicket, strings.NewReader(`[
+		{"_id": "a", "subject": "x", "brand_id": 7, "custom_fields": [
+			{"id": 360001234, "value": "gold"},
+			{"id": 360005678, "value": 5},
+			{"id": 360009999, "value": ["red", "blue"]},
+			{"id": 360000001, "value": true}
+		]},
+		{"_id": "b", "custom_fields": [{"id": 360001234, "value": "silver"}]}
+	]`), db.LoadOptions{})
+	assert.NoError(t, err)
+	err = database.Import(db.ResourceUser, strings.NewReader(`[
+		{"_id": 1, "user_fields": {"tier": "vip", "seats": 10}}
+	]`), db.LoadOptions{})
+	assert.NoError(t, err)
+
+	// Unknown attributes are kept and written back out
+	ticket, _ := database.GetTicket("a")
+	assert.Equal(t, json.RawMessage("7"), ticket.Extra["brand_id"])
+	assert.NotContains(t, ticket.Extra, "subject")
+	ticketJson, err := json.Marshal(ticket)
+	assert.NoError(t, err)
+	assert.Contains(t, string(ticketJson), `"via":"","brand_id":7,"custom_fields":[{"id":360001234,"value":"gold"}`)
+	var parsed db.Ticket
+	assert.NoError(t, json.Unmarshal(ticketJson, &parsed))
+	assert.Equal(t, *ticket, parsed, "should survive a round trip")
+
+	testCases := []struct {
+		resource db.ResourceType
+		field    string
+		value    string
+		expected []string
+	}{
+		{db.ResourceTicket, "custom_fields.360001234", "gold", []string{"a"}},
+		{db.ResourceTicket, "custom_fields.360001234", "silver", []string{"b"}},
+		{db.ResourceTicket, "custom_fields.360005678", "5.0", []string{"a"}},
+		{db.ResourceTicket, "custom_fields.360009999", "blue", []string{"a"}},
+		{db.ResourceTicket, "custom_fields.360000001", "true", []string{"a"}},
+		{db.ResourceTicket, "custom_fields.360000001", "", []string{"b"}},
+		{db.ResourceUser, "user_fields.tier", "vip", []string{"1"}},
+		{db.ResourceUser, "user_fields.seats", "10", []string{"1"}},
+		{db.ResourceUser, "user_fields.seats", "ten", nil},
+	}
+	for _, testCase := range testCases {
+		cond := db.FulLMatchCondition{Resource: testCase.resource, Field: testCase.field, Match: testCase.value}
+		matches, err := cond.Resolve(database)
+		assert.NoError(t, err)
+		var keys []string
+		for _, match := range matches {
+			keys = append(keys, match.GetKey())
+		}
+		assert.Equalf(t, testCase.expected, keys, "%s %s %s", testCase.resource, testCase.field, testCase.value)
+	}
+
+	cond := db.FulLMatchCondition{Resource: db.ResourceUser, Field: "usr_fields.tier", Match: "vip"}
+	_, err = cond.Resolve(database)
+	assert.ErrorIs(t, err, db.ErrFieldMissing, "nothing has the attribute")
+	_, err = db.LookupField(db.ResourceUser, "tags.x")
+	assert.ErrorIs(t, err, db.ErrFieldMissing, "known fields have no paths")
+
+	// Numbers compare by value rather than as text
+	seats, err := db.LookupField(db.ResourceUser, "user_fields.seats")
+	if assert.NoError(t, err) {
+		nine := &db.User{Extra: map[string]json.RawMessage{"user_fields": json.RawMessage(`{"seats": 9}`)}}
+		ten := &db.User{Extra: map[string]json.RawMessage{"user_fields": json.RawMessage(`{"seats": 10.0}`)}}
+		assert.Equal(t, -1, seats.Compare(nine, ten))
+		assert.Equal(t, 0, seats.Compare(ten, &db.User{Extra: map[string]json.RawMessage{"user_fields": json.RawMessage(`{"seats": 10}`)}}))
+		assert.Equal(t, -1, seats.Compare(&db.User{}, nine), "missing is less than anything")
+	}
+
+	// Snapshots keep them
+	var buf bytes.Buffer
+	assert.NoError(t, database.Save(&buf))
+	loaded, err := db.Load(&buf)
+	if assert.NoError(t, err) {
+		usr, _ := loaded.GetUser(1)
+		assert.JSONEq(t, `{"tier": "vip", "seats": 10}`, string(usr.Extra["user_fields"]))
+	}
+}
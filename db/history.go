@@ -0,0 +1,170 @@
+package db
+
+import (
+	"sort"
+	"time"
+)
+
+// Version is the state of a record from From until the next version
+type Version struct {
+	// From is when the version took effect. Zero means it always has
+	From time.Time `json:"from"`
+	// Record is nil if the record was deleted
+	Record Data `json:"record"`
+}
+
+// remember adds the change to the record's history and returns if it's now
+// the latest version. Only changes which replace or delete a record start
+// its history, along with versions from dated exports which may be loaded
+// in any order. Undated changes to records without a history aren't kept
+// since there is nothing earlier to go back to.
+func (d *DB) remember(op Op, record, before Data, at time.Time, dated bool) bool {
+	resource, key := record.GetResourceType(), record.GetKey()
+
+	versions := d.history[resource][key]
+	if len(versions) == 0 {
+		if at.IsZero() || before == nil && !dated {
+			return true
+		}
+		if before != nil {
+			versions = append(versions, Version{From: createdAt(before), Record: before})
+		}
+	}
+
+	version := Version{From: at}
+	if op != OpDelete {
+		version.Record = record
+	}
+
+	// After any versions from the same moment so the latest change wins
+	i := sort.Search(len(versions), func(i int) bool { return versions[i].From.After(at) })
+	versions = append(versions, Version{})
+	copy(versions[i+1:], versions[i:])
+	versions[i] = version
+
+	if d.history == nil {
+		d.history = make(map[ResourceType]map[string][]Version)
+	}
+	if d.history[resource] == nil {
+		d.history[resource] = make(map[string][]Version)
+	}
+	d.history[resource][key] = versions
+
+	return i == len(versions)-1
+}
+
+// versionFrom returns the record of the version which took effect at at or
+// nil
+func (d *DB) versionFrom(resource ResourceType, key string, at time.Time) Data {
+	versions := d.history[resource][key]
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].From.Equal(at) {
+			return versions[i].Record
+		}
+	}
+
+	return nil
+}
+
+// History lists every version of the record oldest first. A record which
+// has never changed has a single version from its created_at.
+func (d *DB) History(resource ResourceType, key string) []Version {
+	d.rlock()
+	defer d.runlock()
+
+	if versions := d.history[resource][key]; len(versions) > 0 {
+		return append([]Version{}, versions...)
+	}
+	if record := d.get(resource, key); record != nil {
+		return []Version{{From: createdAt(record), Record: record}}
+	}
+
+	return nil
+}
+
+// AsOf returns a read only DB holding every record as it was at t. It
+// shares the records of d, only swapping out those the history index or
+// their created_at say were different at t
+func (d *DB) AsOf(t time.Time) *DB {
+	d.rlock()
+	defer d.runlock()
+
+	result := &DB{store: d.clone(), view: true}
+
+	// Records without a history have been the same since they were created
+	for _, resource := range resourceOrder {
+		for _, record := range d.records(resource) {
+			if len(d.history[resource][record.GetKey()]) == 0 && createdAt(record).After(t) {
+				result.remove(record)
+			}
+		}
+	}
+	for resource, keys := range d.history {
+		for key, versions := range keys {
+			var past Data
+			i := sort.Search(len(versions), func(i int) bool { return versions[i].From.After(t) })
+			if i > 0 {
+				past = versions[i-1].Record
+			}
+
+			current := d.get(resource, key)
+			if past == current {
+				continue
+			}
+			if current != nil {
+				result.remove(current)
+			}
+			if past != nil {
+				result.put(past)
+			}
+		}
+	}
+
+	return result
+}
+
+// clone copies the maps of the store so records can be swapped out without
+// changing d. The records and history are shared. Back references are
+// clipped so appending to them never writes into d's
+func (d *DB) clone() *store {
+	result := New().store
+	result.sources = d.sources
+	result.duplicates = d.duplicates
+	result.history = d.history
+
+	for id, org := range d.orgs {
+		result.orgs[id] = org
+	}
+	for id, usr := range d.users {
+		result.users[id] = usr
+	}
+	for id, ticket := range d.tickets {
+		result.tickets[id] = ticket
+	}
+	for _, refs := range []struct{ from, to map[int64][]string }{
+		{d.orgTickets, result.orgTickets},
+		{d.assigned, result.assigned},
+		{d.submitted, result.submitted},
+	} {
+		for id, keys := range refs.from {
+			refs.to[id] = keys[:len(keys):len(keys)]
+		}
+	}
+	for id, users := range d.orgUsers {
+		result.orgUsers[id] = users[:len(users):len(users)]
+	}
+	for resource, records := range d.others {
+		result.others[resource] = make(map[string]Data, len(records))
+		for key, record := range records {
+			result.others[resource][key] = record
+		}
+	}
+	for resource, keys := range d.refs {
+		result.refs[resource] = make(map[string][]recordRef, len(keys))
+		for key, refs := range keys {
+			result.refs[resource][key] = refs[:len(refs):len(refs)]
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,205 @@
+package db_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sardap/zendesk/db"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	mayExport = `[
+		{"_id": "x", "status": "open", "assignee_id": 1},
+		{"_id": "y", "status": "open", "assignee_id": 1}
+	]`
+	julyExport = `[
+		{"_id": "x", "status": "solved", "assignee_id": 2}
+	]`
+)
+
+func date(value string) time.Time {
+	result, _ := time.Parse("2006-01-02", value)
+	return result
+}
+
+func ticketAsOf(t *testing.T, database *db.DB, id, asOf string) *db.Ticket {
+	query := db.Query{
+		Conditions: []db.Condition{&db.IDMatchCondition{Resource: db.ResourceTicket, Target: id}},
+		AsOf:       date(asOf),
+	}
+	result, err := query.Resolve(database)
+	if err != nil {
+		return nil
+	}
+	assert.Equal(t, 1, len(result.Target))
+	return result.Target[0].(*db.Ticket)
+}
+
+func TestHistoryFromExports(t *testing.T) {
+	for _, reversed := range []bool{false, true} {
+		exports := []struct {
+			input string
+			asOf  string
+		}{{mayExport, "2016-05-01"}, {julyExport, "2016-07-01"}}
+		if reversed {
+			exports[0], exports[1] = exports[1], exports[0]
+		}
+
+		database := createBlankDb()
+		report := &db.LoadReport{}
+		for _, export := range exports {
+			err := database.Import(db.ResourceTicket, strings.NewReader(export.input), db.LoadOptions{
+				AsOf:       date(export.asOf),
+				Report:     report,
+				Duplicates: db.DuplicateError,
+			})
+			assert.NoErrorf(t, err, "error loading export from %s", export.asOf)
+		}
+		assert.Empty(t, report.Duplicates, "versions from different exports aren't duplicates")
+
+		assert.Nil(t, ticketAsOf(t, database, "x", "2016-04-01"), "ticket shouldn't exist before the first export")
+		if ticket := ticketAsOf(t, database, "x", "2016-06-01"); assert.NotNil(t, ticket) {
+			assert.Equal(t, "open", ticket.Status)
+			assert.Equal(t, int64(1), ticket.AssigneeID)
+		}
+		if ticket := ticketAsOf(t, database, "x", "2016-08-01"); assert.NotNil(t, ticket) {
+			assert.Equal(t, "solved", ticket.Status)
+			assert.Equal(t, int64(2), ticket.AssigneeID)
+		}
+		if ticket := ticketAsOf(t, database, "y", "2016-08-01"); assert.NotNil(t, ticket) {
+			assert.Equal(t, "open", ticket.Status, "tickets missing from later exports keep their last version")
+		}
+
+		current, err := database.GetTicket("x")
+		if assert.NoError(t, err) {
+			assert.Equalf(t, "solved", current.Status, "latest export should be current reversed %t", reversed)
+		}
+		assert.Equal(t, 2, len(database.History(db.ResourceTicket, "x")))
+
+		// Conditions see the past state
+		query := db.Query{
+			Conditions: []db.Condition{
+				&db.FulLMatchCondition{
+					Resource:  db.ResourceTicket,
+					Connector: db.ConnectorTypeUnion,
+					Field:     "status",
+					Match:     "open",
+				},
+			},
+			AsOf: date("2016-06-01"),
+		}
+		result, err := query.Resolve(database)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(result.Target), "both tickets were open in june")
+	}
+}
+
+func TestHistoryFromChanges(t *testing.T) {
+	database := createBlankDb()
+	assert.NoError(t, database.AddOrganization(db.Organization{ID: 101}))
+	assert.NoError(t, database.AddUser(db.User{ID: 1, Name: "a", OrganizationID: 101}))
+	time.Sleep(time.Millisecond)
+	before := time.Now()
+	time.Sleep(time.Millisecond)
+
+	assert.NoError(t, database.UpdateUser(db.User{ID: 1, Name: "b", OrganizationID: 101}))
+	assert.NoError(t, database.DeleteOrganization(101))
+
+	past := database.AsOf(before)
+	usr, err := past.GetUser(1)
+	if assert.NoError(t, err, "user should exist in the past") {
+		assert.Equal(t, "a", usr.Name)
+		assert.Equal(t, 1, len(usr.GetRelated(past)), "deleted org should still be related in the past")
+	}
+	assert.ErrorIs(t, past.AddUser(db.User{ID: 2}), db.ErrReadOnly)
+
+	_, err = database.GetOrganization(101)
+	assert.ErrorIs(t, err, db.ErrNotFound)
+	history := database.History(db.ResourceOrganization, "101")
+	if assert.Equal(t, 2, len(history)) {
+		assert.Nil(t, history[1].Record, "last version should be the delete")
+	}
+
+	// Records from before anything was dated have always existed
+	loaded := createLoadedDB()
+	_, err = loaded.AsOf(date("2000-01-01")).GetTicket("436bf9b0-1147-4c0a-8439-6f79833bff5b")
+	assert.ErrorIs(t, err, db.ErrNotFound, "tickets shouldn't exist before created_at")
+	_, err = loaded.AsOf(time.Now()).GetTicket("436bf9b0-1147-4c0a-8439-6f79833bff5b")
+	assert.NoError(t, err)
+}
+
+func TestHistoryOnlyReplacements(t *testing.T) {
+	database := createBlankDb()
+	assert.NoError(t, database.AddUser(db.User{ID: 1, Name: "a"}))
+	assert.NoError(t, database.AddTicket(db.Ticket{ID: "x", AssigneeID: 1}))
+	history := database.History(db.ResourceUser, "1")
+	if assert.Equal(t, 1, len(history)) {
+		assert.True(t, history[0].From.IsZero(), "an insert has nothing earlier to go back to")
+	}
+	time.Sleep(time.Millisecond)
+	before := time.Now()
+	time.Sleep(time.Millisecond)
+
+	assert.NoError(t, database.AddUser(db.User{ID: 1, Name: "b"}))
+	history = database.History(db.ResourceUser, "1")
+	if assert.Equal(t, 2, len(history), "a replacement keeps the version it replaced") {
+		assert.Equal(t, "a", history[0].Record.(*db.User).Name)
+		assert.True(t, history[1].From.After(before))
+	}
+
+	// The past shares the records which didn't change and leaves d alone
+	past := database.AsOf(before)
+	if usr, err := past.GetUser(1); assert.NoError(t, err) {
+		assert.Equal(t, "a", usr.Name)
+		assert.Equal(t, 1, len(usr.GetRelated(past)))
+	}
+	assert.NoError(t, database.AddTicket(db.Ticket{ID: "y", AssigneeID: 1}))
+	if usr, err := database.GetUser(1); assert.NoError(t, err) {
+		assert.Equal(t, "b", usr.Name)
+		assert.Equal(t, 2, len(usr.GetRelated(database)))
+	}
+	usr, _ := past.GetUser(1)
+	assert.Equal(t, 1, len(usr.GetRelated(past)), "changes after AsOf shouldn't show in the past")
+}
+
+func TestHistoryPersisted(t *testing.T) {
+	database := createBlankDb()
+	for _, export := range []struct {
+		input string
+		asOf  string
+	}{{mayExport, "2016-05-01"}, {julyExport, "2016-07-01"}} {
+		database.Import(db.ResourceTicket, strings.NewReader(export.input), db.LoadOptions{AsOf: date(export.asOf)})
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, database.Save(&buf))
+	loaded, err := db.Load(&buf)
+	assert.NoError(t, err)
+	if ticket := ticketAsOf(t, loaded, "x", "2016-06-01"); assert.NotNil(t, ticket, "history not saved") {
+		assert.Equal(t, "open", ticket.Status)
+	}
+
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "zendesk.wal")
+	snapPath := filepath.Join(dir, "zendesk.snap")
+	database, _ = db.Open(snapPath, walPath, db.WALOptions{})
+	database.AddTicket(db.Ticket{ID: "x", Status: "open"})
+	time.Sleep(time.Millisecond)
+	before := time.Now()
+	time.Sleep(time.Millisecond)
+	database.UpdateTicket(db.Ticket{ID: "x", Status: "solved"})
+	database.Close()
+
+	recovered, err := db.Open(snapPath, walPath, db.WALOptions{})
+	assert.NoError(t, err)
+	if ticket, err := recovered.AsOf(before).GetTicket("x"); assert.NoError(t, err, "history not replayed") {
+		assert.Equal(t, "open", ticket.Status)
+	}
+	recovered.Close()
+	os.Remove(walPath)
+}
@@ -0,0 +1,449 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrNotArray      error
+	ErrInvalidFormat error
+)
+
+func init() {
+	ErrNotArray = fmt.Errorf("expected a json array of records")
+	ErrInvalidFormat = fmt.Errorf("invalid input format")
+}
+
+type Format string
+
+const (
+	// FormatAuto works out the format from the start of the input
+	FormatAuto Format = ""
+	// FormatJSON is a single top level array of records
+	FormatJSON Format = "json"
+	// FormatNDJSON is one record object per line
+	FormatNDJSON Format = "ndjson"
+	// FormatExport is one or more Zendesk incremental export pages
+	// {"tickets": [...], "next_page": ...}
+	FormatExport Format = "export"
+	// FormatCSV is a header row then a row per record, read according to
+	// LoadOptions.CSV. It's never worked out from the input so must be given
+	FormatCSV Format = "csv"
+)
+
+// Keys which can appear at the top level of an incremental export page
+var exportPageKeys = map[string]bool{
+	"next_page":     true,
+	"previous_page": true,
+	"count":         true,
+	"end_time":      true,
+	"end_of_stream": true,
+	"after_url":     true,
+	"after_cursor":  true,
+	"before_url":    true,
+	"before_cursor": true,
+}
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Progress is passed to a ProgressFunc after each record is inserted
+type Progress struct {
+	Resource ResourceType
+	// Records inserted so far for this resource
+	Records int
+	// Offset is how many bytes of the (decompressed) input have been consumed
+	Offset int64
+}
+
+type ProgressFunc func(p Progress)
+
+type LoadOptions struct {
+	// Progress is called after every record is inserted. Can be nil
+	Progress ProgressFunc
+	// Format of the input. Gzip compression is always detected
+	Format Format
+	// CSV is how FormatCSV input is read
+	CSV CSVOptions
+	// Lenient skips records which fail to parse or insert instead of
+	// stopping the load. Malformed json still stops the load
+	Lenient bool
+	// Report collects the skipped records and load counts. Can be nil
+	Report *LoadReport
+	// Duplicates decides what happens to records with the same key as an
+	// existing record. Defaults to DuplicateKeepLast
+	Duplicates DuplicatePolicy
+	// Strict makes Create fail with ErrInvalidForeignKey if any foreign keys
+	// don't resolve once everything is loaded
+	Strict bool
+	// AsOf is when the export being loaded was taken. Loading several dated
+	// exports builds up each record's history, see Query.AsOf. Records loaded
+	// without a date are taken to have been as they are since created_at
+	AsOf time.Time
+}
+
+// exportKey is the key holding the records in an incremental export page
+func exportKey(resource ResourceType) string {
+	return fmt.Sprintf("%ss", resource)
+}
+
+// decompress transparently unwraps gzip compressed input
+func decompress(r io.Reader) (*bufio.Reader, error) {
+	br := bufio.NewReader(r)
+
+	magic, _ := br.Peek(len(gzipMagic))
+	if !bytes.Equal(magic, gzipMagic) {
+		return br, nil
+	}
+
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, err
+	}
+
+	return bufio.NewReader(gz), nil
+}
+
+// detectFormat looks at the start of the input to work out its format. An
+// object is taken to be an export page if its first key is the resource list
+// or one of the paging keys, otherwise it's a record from a NDJSON file.
+func detectFormat(resource ResourceType, br *bufio.Reader) Format {
+	peek, _ := br.Peek(512)
+
+	dec := json.NewDecoder(bytes.NewReader(peek))
+	tok, err := dec.Token()
+	if err != nil {
+		return FormatJSON
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '{' {
+		return FormatJSON
+	}
+
+	tok, err = dec.Token()
+	if err != nil {
+		return FormatNDJSON
+	}
+	if key, ok := tok.(string); ok && (key == exportKey(resource) || exportPageKeys[key]) {
+		return FormatExport
+	}
+
+	return FormatNDJSON
+}
+
+// addFunc adds a record and returns if there was already one with its key.
+// DB.add and ShardedDB.add are both one
+type addFunc func(toAdd Data, raw json.RawMessage, policy DuplicatePolicy, at time.Time, dated bool) (bool, error)
+
+type importer struct {
+	insert   addFunc
+	resource ResourceType
+	dec      *json.Decoder
+	opts     LoadOptions
+	file     string
+	lines    *lineCounter
+	index    int
+	count    int
+}
+
+// add parses a single record and adds it to the DB
+func (i *importer) add(raw []byte) error {
+	record, err := newRecord(i.resource)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(raw, record); err != nil {
+		return err
+	}
+	exists, err := i.insert(record, raw, i.opts.Duplicates, i.opts.AsOf, !i.opts.AsOf.IsZero())
+	if exists && i.opts.Report != nil {
+		i.opts.Report.duplicate(i.resource, record.GetKey())
+	}
+
+	return err
+}
+
+// badField finds the first field of raw which fails to parse on its own
+func (i *importer) badField(raw []byte) string {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return ""
+	}
+
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		single, _ := json.Marshal(map[string]json.RawMessage{key: fields[key]})
+		record, err := newRecord(i.resource)
+		if err != nil {
+			return ""
+		}
+		if err := json.Unmarshal(single, record); err != nil {
+			return key
+		}
+	}
+
+	return ""
+}
+
+func (i *importer) loadError(index int, offset int64, field string, err error) *LoadError {
+	result := &LoadError{
+		File:     i.file,
+		Resource: i.resource,
+		Index:    index,
+		Offset:   offset,
+		Field:    field,
+		Err:      err,
+	}
+	if i.lines != nil {
+		result.Line = i.lines.lineAt(offset)
+	}
+
+	return result
+}
+
+// record decodes the next record and adds it to the DB
+func (i *importer) record() error {
+	index := i.index
+	i.index++
+
+	var raw json.RawMessage
+	if err := i.dec.Decode(&raw); err != nil {
+		// The stream can't be resumed so this is fatal even when lenient
+		offset := i.dec.InputOffset()
+		if syntaxErr, ok := err.(*json.SyntaxError); ok {
+			offset = syntaxErr.Offset
+		}
+		return i.loadError(index, offset, "", err)
+	}
+	start := i.dec.InputOffset() - int64(len(raw))
+
+	if err := i.add(raw); err != nil {
+		return i.skip(i.loadError(index, start, i.badField(raw), err))
+	}
+	if i.lines != nil {
+		i.lines.advance(start)
+	}
+	i.added(i.dec.InputOffset())
+
+	return nil
+}
+
+// skip returns the error unless the load is lenient, in which case the
+// record is reported as skipped and the load goes on
+func (i *importer) skip(loadErr *LoadError) error {
+	if !i.opts.Lenient {
+		return loadErr
+	}
+	if i.opts.Report != nil {
+		i.opts.Report.Skipped = append(i.opts.Report.Skipped, loadErr)
+	}
+
+	return nil
+}
+
+// added counts a record which was added, offset bytes into the input
+func (i *importer) added(offset int64) {
+	i.count++
+	if i.opts.Report != nil {
+		i.opts.Report.loaded(i.resource)
+	}
+	if i.opts.Progress != nil {
+		i.opts.Progress(Progress{
+			Resource: i.resource,
+			Records:  i.count,
+			Offset:   offset,
+		})
+	}
+}
+
+func (i *importer) expectDelim(expected json.Delim, onErr error) error {
+	tok, err := i.dec.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != expected {
+		return onErr
+	}
+
+	return nil
+}
+
+func (i *importer) array() error {
+	if err := i.expectDelim('[', ErrNotArray); err != nil {
+		return err
+	}
+
+	for i.dec.More() {
+		if err := i.record(); err != nil {
+			return err
+		}
+	}
+
+	return i.expectDelim(']', ErrNotArray)
+}
+
+func (i *importer) ndjson() error {
+	for i.dec.More() {
+		if err := i.record(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (i *importer) export() error {
+	key := exportKey(i.resource)
+
+	for i.dec.More() {
+		pageErr := errors.Wrap(ErrInvalidFormat, "export page should be an object")
+		if err := i.expectDelim('{', pageErr); err != nil {
+			return err
+		}
+
+		for i.dec.More() {
+			tok, err := i.dec.Token()
+			if err != nil {
+				return err
+			}
+
+			if tok == key {
+				if err := i.array(); err != nil {
+					return err
+				}
+				continue
+			}
+
+			// Paging info isn't needed
+			var skip json.RawMessage
+			if err := i.dec.Decode(&skip); err != nil {
+				return err
+			}
+		}
+
+		if err := i.expectDelim('}', pageErr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Import streams resource records from r into the DB one record at a time so
+// the whole input is never held in memory. The input can be a json array,
+// NDJSON, Zendesk incremental export pages or a CSV given with FormatCSV,
+// optionally gzip compressed.
+func (d *DB) Import(resource ResourceType, r io.Reader, opts LoadOptions) error {
+	source, err := importRecords(resource, r, opts, d.add)
+	if err != nil {
+		return err
+	}
+	d.addSource(source)
+
+	return nil
+}
+
+// importRecords parses every record in r and adds it with insert
+func importRecords(resource ResourceType, r io.Reader, opts LoadOptions, insert addFunc) (Source, error) {
+	hash := sha256.New()
+	br, err := decompress(io.TeeReader(r, hash))
+	if err != nil {
+		return Source{}, err
+	}
+
+	format := opts.Format
+	if format == FormatAuto {
+		format = detectFormat(resource, br)
+	}
+
+	lines := newLineCounter(br)
+	imp := &importer{
+		insert:   insert,
+		resource: resource,
+		dec:      json.NewDecoder(lines),
+		opts:     opts,
+		file:     fileName(r),
+		lines:    lines,
+	}
+
+	switch format {
+	case FormatJSON:
+		err = imp.array()
+	case FormatNDJSON:
+		err = imp.ndjson()
+	case FormatExport:
+		err = imp.export()
+	case FormatCSV:
+		imp.lines = nil
+		err = imp.csv(lines)
+	default:
+		return Source{}, errors.Wrapf(ErrInvalidFormat, "%s", format)
+	}
+	if err != nil {
+		return Source{}, err
+	}
+
+	// Parsing stops at the last record so anything after it still needs
+	// hashing
+	if _, err := io.Copy(hash, r); err != nil {
+		return Source{}, err
+	}
+
+	return Source{
+		Resource: resource,
+		File:     imp.file,
+		SHA256:   hex.EncodeToString(hash.Sum(nil)),
+		Records:  imp.count,
+	}, nil
+}
+
+// Source is an input records were imported from
+type Source struct {
+	Resource ResourceType `json:"resource"`
+	// File is empty if the input wasn't read from a file
+	File string `json:"file,omitempty"`
+	// SHA256 is the checksum of the input as given, before decompressing
+	SHA256 string `json:"sha256"`
+	// Records is how many records were added from the input
+	Records int `json:"records"`
+}
+
+// fileName is the name of r if it's a file
+func fileName(r io.Reader) string {
+	if named, ok := r.(interface{ Name() string }); ok {
+		return named.Name()
+	}
+
+	return ""
+}
+
+func (d *DB) addSource(source Source) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.sources = append(d.sources, source)
+}
+
+// Sources lists every input imported into the DB in the order they were
+// imported
+func (d *DB) Sources() []Source {
+	d.rlock()
+	defer d.runlock()
+
+	return append([]Source(nil), d.sources...)
+}
@@ -0,0 +1,196 @@
+package db_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/sardap/zendesk/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImport(t *testing.T) {
+	database := db.New()
+
+	ticketsFile, _ := os.Open("db_testdata/tickets.json")
+	defer ticketsFile.Close()
+	info, _ := ticketsFile.Stat()
+
+	var updates []db.Progress
+	err := database.Import(db.ResourceTicket, ticketsFile, db.LoadOptions{
+		Progress: func(p db.Progress) {
+			updates = append(updates, p)
+		},
+	})
+	assert.NoError(t, err, "error importing tickets")
+	assert.Equal(t, 200, len(updates), "progress should be reported for each ticket")
+	for i, update := range updates {
+		assert.Equal(t, db.ResourceTicket, update.Resource)
+		assert.Equal(t, i+1, update.Records)
+		if i > 0 {
+			assert.Greater(t, update.Offset, updates[i-1].Offset, "offset should always grow")
+		}
+	}
+	assert.LessOrEqual(t, updates[len(updates)-1].Offset, info.Size())
+
+	_, err = database.GetTicket("436bf9b0-1147-4c0a-8439-6f79833bff5b")
+	assert.NoError(t, err, "imported ticket missing")
+
+	// Not an array
+	err = database.Import(db.ResourceUser, bytes.NewBufferString(`{"_id": 1}`), db.LoadOptions{Format: db.FormatJSON})
+	assert.ErrorIs(t, err, db.ErrNotArray)
+
+	// Truncated array
+	err = database.Import(db.ResourceUser, bytes.NewBufferString(`[{"_id": 1}, {"_id"`), db.LoadOptions{})
+	assert.Error(t, err)
+
+	// Invalid resource
+	err = database.Import("garbage", bytes.NewBufferString(`[{"_id": 1}]`), db.LoadOptions{})
+	assert.ErrorIs(t, err, db.ErrInvalidResouce)
+}
+
+func TestCreateWithOptions(t *testing.T) {
+	orgsFile, usersFile, ticketsFile := getFiles()
+	defer orgsFile.Close()
+	defer usersFile.Close()
+	defer ticketsFile.Close()
+
+	counts := make(map[db.ResourceType]int)
+	database, err := db.CreateWithOptions(orgsFile, usersFile, ticketsFile, db.LoadOptions{
+		Progress: func(p db.Progress) {
+			counts[p.Resource] = p.Records
+		},
+	})
+	assert.NoError(t, err, "error creating database")
+	assert.Equal(t, 25, counts[db.ResourceOrganization])
+	assert.Equal(t, 75, counts[db.ResourceUser])
+	assert.Equal(t, 200, counts[db.ResourceTicket])
+
+	org, _ := database.GetOrganization(101)
+	assert.Equal(t, 8, len(org.GetRelated(database)), "foreign keys not resolved")
+}
+
+func gzipString(s string) *bytes.Buffer {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(s))
+	w.Close()
+	return &buf
+}
+
+func TestImportFormats(t *testing.T) {
+	array := `[{"_id": 1, "name": "a"}, {"_id": 2, "name": "b"}, {"_id": 3, "name": "c"}]`
+	ndjson := "{\"_id\": 1, \"name\": \"a\"}\n{\"_id\": 2, \"name\": \"b\"}\n\n{\"_id\": 3, \"name\": \"c\"}\n"
+	export := `{"users": [{"_id": 1, "name": "a"}, {"_id": 2, "name": "b"}], "next_page": "https://initech.zendesk.com/api/v2/incremental/users.json?start_time=2", "count": 2, "end_of_stream": false}
+{"count": 1, "users": [{"_id": 3, "name": "c"}], "next_page": null, "end_of_stream": true}`
+
+	testCases := []struct {
+		name   string
+		input  string
+		format db.Format
+	}{
+		{name: "array", input: array},
+		{name: "ndjson", input: ndjson},
+		{name: "export", input: export},
+		{name: "explicit array", input: array, format: db.FormatJSON},
+		{name: "explicit ndjson", input: ndjson, format: db.FormatNDJSON},
+		{name: "explicit export", input: export, format: db.FormatExport},
+	}
+
+	for _, testCase := range testCases {
+		for _, compressed := range []bool{false, true} {
+			var input *bytes.Buffer
+			if compressed {
+				input = gzipString(testCase.input)
+			} else {
+				input = bytes.NewBufferString(testCase.input)
+			}
+
+			database := db.New()
+			err := database.Import(db.ResourceUser, input, db.LoadOptions{Format: testCase.format})
+			assert.NoErrorf(t, err, "error importing %s gzip %t", testCase.name, compressed)
+
+			for id, name := range map[int64]string{1: "a", 2: "b", 3: "c"} {
+				usr, err := database.GetUser(id)
+				if assert.NoErrorf(t, err, "user %d missing from %s gzip %t", id, testCase.name, compressed) {
+					assert.Equal(t, name, usr.Name)
+				}
+			}
+		}
+	}
+
+	// Wrong explicit format
+	err := db.New().Import(db.ResourceUser, bytes.NewBufferString(ndjson), db.LoadOptions{Format: db.FormatJSON})
+	assert.ErrorIs(t, err, db.ErrNotArray)
+
+	err = db.New().Import(db.ResourceUser, bytes.NewBufferString(array), db.LoadOptions{Format: "garbage"})
+	assert.ErrorIs(t, err, db.ErrInvalidFormat)
+
+	err = db.New().Import(db.ResourceUser, bytes.NewBufferString(array), db.LoadOptions{Format: db.FormatExport})
+	assert.ErrorIs(t, err, db.ErrInvalidFormat)
+}
+
+func TestImportDiagnostics(t *testing.T) {
+	input := `[
+  {"_id": "a", "due_at": "2016-07-31T02:37:50 -10:00"},
+  {"_id": "b", "due_at": "sarda.dev"},
+  {"_id": "c", "has_incidents": "yes"},
+  {"_id": "d"}
+]`
+
+	// Strict
+	err := db.New().Import(db.ResourceTicket, bytes.NewBufferString(input), db.LoadOptions{})
+	var loadErr *db.LoadError
+	if assert.ErrorAs(t, err, &loadErr) {
+		assert.Equal(t, db.ResourceTicket, loadErr.Resource)
+		assert.Equal(t, 1, loadErr.Index)
+		assert.Equal(t, 3, loadErr.Line)
+		assert.Equal(t, int64(strings.Index(input, `{"_id": "b"`)), loadErr.Offset)
+		assert.Equal(t, "due_at", loadErr.Field)
+		assert.Contains(t, loadErr.Error(), "ticket record 1 (line 3, byte")
+	}
+
+	// Lenient
+	var report db.LoadReport
+	database := db.New()
+	err = database.Import(db.ResourceTicket, bytes.NewBufferString(input), db.LoadOptions{
+		Lenient: true,
+		Report:  &report,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, report.Loaded[db.ResourceTicket])
+	if assert.Equal(t, 2, len(report.Skipped)) {
+		assert.Equal(t, "due_at", report.Skipped[0].Field)
+		assert.Equal(t, 3, report.Skipped[0].Line)
+		assert.Equal(t, "has_incidents", report.Skipped[1].Field)
+		assert.Equal(t, 4, report.Skipped[1].Line)
+	}
+	for _, id := range []string{"a", "d"} {
+		_, err := database.GetTicket(id)
+		assert.NoErrorf(t, err, "ticket %s should have loaded", id)
+	}
+	_, err = database.GetTicket("b")
+	assert.ErrorIs(t, err, db.ErrNotFound)
+
+	// Malformed json stops even a lenient load
+	err = db.New().Import(db.ResourceTicket, bytes.NewBufferString("{\"_id\": \"a\"}\n{\"_id\": tru}\n"), db.LoadOptions{
+		Lenient: true,
+	})
+	if assert.ErrorAs(t, err, &loadErr) {
+		assert.Equal(t, 1, loadErr.Index)
+		assert.Equal(t, 2, loadErr.Line)
+	}
+
+	// File name comes from the reader
+	f, _ := os.CreateTemp("", "tickets*.json")
+	defer os.Remove(f.Name())
+	f.WriteString(input)
+	f.Seek(0, 0)
+	err = db.New().Import(db.ResourceTicket, f, db.LoadOptions{})
+	f.Close()
+	if assert.ErrorAs(t, err, &loadErr) {
+		assert.Equal(t, f.Name(), loadErr.File)
+	}
+}
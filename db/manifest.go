@@ -0,0 +1,134 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrInvalidManifest error
+)
+
+func init() {
+	ErrInvalidManifest = fmt.Errorf("invalid manifest")
+}
+
+// ManifestFileName is what a manifest in a dataset directory is called
+const ManifestFileName = "manifest.json"
+
+// Shard is one of the files a resource is split across
+type Shard struct {
+	// Path is relative to the manifest's directory unless it's absolute
+	Path string `json:"path"`
+	// Format of the file. Worked out from the start of the file if empty,
+	// except for FormatCSV which has to be given
+	Format Format `json:"format,omitempty"`
+	// CSV is how the file is read if it's FormatCSV
+	CSV CSVOptions `json:"csv,omitempty"`
+}
+
+// Manifest names the files a dataset is split across, e.g.
+//
+//	{"resources": {"ticket": [{"path": "tickets-1.json"}, {"path": "tickets-2.ndjson.gz", "format": "ndjson"}]}}
+//
+// CSV shards give how their header maps onto fields, e.g.
+//
+//	{"path": "users.csv", "format": "csv", "csv": {"mapping": {"Name": "name"}, "list_delimiter": "|"}}
+type Manifest struct {
+	Resources map[ResourceType][]Shard `json:"resources"`
+	// Dir is the directory relative paths are from
+	Dir string `json:"-"`
+}
+
+// ReadManifest reads a manifest and checks its resources and formats
+func ReadManifest(path string) (*Manifest, error) {
+	manifestJson, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Manifest{Dir: filepath.Dir(path)}
+	if err := json.Unmarshal(manifestJson, result); err != nil {
+		return nil, errors.Wrapf(ErrInvalidManifest, "%s: %s", path, err)
+	}
+	if err := result.check(); err != nil {
+		return nil, errors.Wrapf(err, "%s", path)
+	}
+
+	return result, nil
+}
+
+func (m *Manifest) check() error {
+	if len(m.Resources) == 0 {
+		return errors.Wrap(ErrInvalidManifest, "no resources given")
+	}
+
+	for resource, shards := range m.Resources {
+		if _, err := LookupResource(resource); err != nil {
+			return errors.Wrap(ErrInvalidManifest, err.Error())
+		}
+		for _, shard := range shards {
+			if shard.Path == "" {
+				return errors.Wrapf(ErrInvalidManifest, "%s shard has no path", resource)
+			}
+			switch shard.Format {
+			case FormatAuto, FormatJSON, FormatNDJSON, FormatExport, FormatCSV:
+			default:
+				return errors.Wrapf(ErrInvalidManifest, "%s has an unknown format %s", shard.Path, shard.Format)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ShardPath is where the shard's file is
+func (m *Manifest) ShardPath(shard Shard) string {
+	if filepath.IsAbs(shard.Path) {
+		return shard.Path
+	}
+
+	return filepath.Join(m.Dir, shard.Path)
+}
+
+func (d *DB) importShard(resource ResourceType, path string, opts LoadOptions) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return d.Import(resource, f, opts)
+}
+
+// CreateFromManifest loads every shard into one DB. Resources are loaded in
+// the order they were registered and each resource's shards in the order
+// they're listed, so opts.Duplicates decides between records repeated
+// across shards.
+func CreateFromManifest(manifest *Manifest, opts LoadOptions) (*DB, error) {
+	if err := manifest.check(); err != nil {
+		return nil, err
+	}
+
+	result := New()
+	for _, resource := range resourceOrder {
+		for _, shard := range manifest.Resources[resource] {
+			shardOpts := opts
+			shardOpts.Format = shard.Format
+			shardOpts.CSV = shard.CSV
+			if err := result.importShard(resource, manifest.ShardPath(shard), shardOpts); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := checkStrict(result, opts); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
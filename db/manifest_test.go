@@ -0,0 +1,88 @@
+package db_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sardap/zendesk/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeManifest(t *testing.T, dir string, manifest string) string {
+	path := filepath.Join(dir, db.ManifestFileName)
+	assert.NoError(t, ioutil.WriteFile(path, []byte(manifest), 0644))
+	return path
+}
+
+func TestManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"orgs.json":         `[{"_id": 101, "name": "Enthaze"}]`,
+		"users-1.ndjson":    `{"_id": 1, "name": "Francisca Rasmussen", "organization_id": 101}` + "\n",
+		"users-2.ndjson.gz": gzipString(`{"_id": 2, "name": "Cross Barlow", "organization_id": 101}` + "\n").String(),
+		"tickets/a.json":    `{"tickets": [{"_id": "a", "organization_id": 101, "submitter_id": 1, "assignee_id": 2}], "end_of_stream": true}`,
+		"tickets/b.json":    `[{"_id": "b", "organization_id": 101, "submitter_id": 2, "assignee_id": 3}]`,
+		"groups.csv":        "Group ID,Name\n1,Support\n",
+	}
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "tickets"), 0755))
+	for name, contents := range files {
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644))
+	}
+
+	path := writeManifest(t, dir, `{"resources": {
+		"ticket": [{"path": "tickets/a.json", "format": "export"}, {"path": "tickets/b.json"}],
+		"user": [{"path": "users-1.ndjson", "format": "ndjson"}, {"path": "users-2.ndjson.gz"}],
+		"organization": [{"path": "orgs.json"}],
+		"group": [{"path": "groups.csv", "format": "csv", "csv": {"mapping": {"Group ID": "_id", "Name": "name"}}}]
+	}}`)
+	manifest, err := db.ReadManifest(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, filepath.Join(dir, "tickets/a.json"), manifest.ShardPath(manifest.Resources[db.ResourceTicket][0]))
+
+	database, err := db.CreateFromManifest(manifest, db.LoadOptions{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	org, err := database.GetOrganization(101)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(org.GetRelated(database)), "users and tickets from every shard are linked")
+	group, err := database.GetRecord(db.ResourceGroup, "1")
+	if assert.NoError(t, err, "csv shard loaded") {
+		assert.Equal(t, "Support", group.(*db.Group).Name)
+	}
+	sources := database.Sources()
+	if assert.Equal(t, 6, len(sources)) {
+		assert.Equal(t, db.ResourceOrganization, sources[0].Resource, "loaded in registration order")
+		assert.Equal(t, filepath.Join(dir, "users-2.ndjson.gz"), sources[2].File)
+		assert.Equal(t, 1, sources[2].Records)
+	}
+
+	_, err = db.CreateFromManifest(manifest, db.LoadOptions{Strict: true})
+	assert.ErrorIs(t, err, db.ErrInvalidForeignKey, "assignee 3 isn't in any shard")
+
+	invalid := []string{
+		`{"resources": {}}`,
+		`{"resources": {"garbage": [{"path": "orgs.json"}]}}`,
+		`{"resources": {"organization": [{"path": ""}]}}`,
+		`{"resources": {"organization": [{"path": "orgs.json", "format": "xml"}]}}`,
+		`{"resources": [`,
+	}
+	for _, manifestJson := range invalid {
+		_, err := db.ReadManifest(writeManifest(t, dir, manifestJson))
+		assert.ErrorIsf(t, err, db.ErrInvalidManifest, "%s", manifestJson)
+	}
+
+	manifest, err = db.ReadManifest(writeManifest(t, dir, `{"resources": {"organization": [{"path": "missing.json"}]}}`))
+	assert.NoError(t, err)
+	_, err = db.CreateFromManifest(manifest, db.LoadOptions{})
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
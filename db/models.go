@@ -1,30 +1,12 @@
 package db
 
 import (
+	"encoding/json"
 	"fmt"
-	"strconv"
-	"time"
 
-	"github.com/pkg/errors"
 	"github.com/sardap/zendesk/utility"
 )
 
-func matchBool(expected bool, value string) (bool, error) {
-	b, err := strconv.ParseBool(value)
-	if err != nil {
-		return false, err
-	}
-	return b == expected, nil
-}
-
-func matchTime(expected time.Time, value string) (bool, error) {
-	t, err := time.Parse(utility.ZendeskTimeFormat, value)
-	if err != nil {
-		return false, errors.Wrapf(err, "time should be in %s format", utility.ZendeskTimeFormat)
-	}
-	return t.Equal(expected), nil
-}
-
 func matchStringArray(ary []string, value string) (bool, error) {
 	for _, name := range ary {
 		if name == value {
@@ -34,15 +16,6 @@ func matchStringArray(ary []string, value string) (bool, error) {
 	return false, nil
 }
 
-func matchInt64(i int64, value string) (bool, error) {
-	parsedInt, err := strconv.ParseInt(value, 10, 64)
-	if err != nil {
-		return false, errors.Wrapf(err, "given value should be base 10")
-	}
-
-	return i == parsedInt, nil
-}
-
 type Data interface {
 	GetKey() string
 	GetResourceType() ResourceType
@@ -59,9 +32,30 @@ type Organization struct {
 	Details       string              `json:"details"`
 	SharedTickets bool                `json:"shared_tickets"`
 	Tags          []string            `json:"tags"`
-	// foreign keys
-	users   []int64
-	tickets []string
+	// Extra holds the attributes there's no field for like
+	// organization_fields so they're written back out
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+func (o *Organization) UnmarshalJSON(data []byte) error {
+	type organization Organization
+	if err := json.Unmarshal(data, (*organization)(o)); err != nil {
+		return err
+	}
+
+	extra, err := unknownFields(ResourceOrganization, data)
+	o.Extra = extra
+	return err
+}
+
+func (o *Organization) MarshalJSON() ([]byte, error) {
+	type organization Organization
+	data, err := json.Marshal((*organization)(o))
+	if err != nil {
+		return nil, err
+	}
+
+	return withExtra(data, o.Extra)
 }
 
 func (o *Organization) GetKey() string {
@@ -82,37 +76,23 @@ func (o *Organization) GetRelated(db *DB) []Data {
 	for _, ticket := range o.getTickets(db) {
 		result = append(result, ticket)
 	}
+	result = append(result, db.Linked(o)...)
 
 	return result
 }
 
 func (o *Organization) Match(field, value string) (bool, error) {
-	switch field {
-	case "url":
-		return o.URL == value, nil
-	case "external_id":
-		return o.ExternalID == value, nil
-	case "name":
-		return o.Name == value, nil
-	case "domain_names":
-		return matchStringArray(o.DomainNames, value)
-	case "created_at":
-		return matchTime(o.CreatedAt.Time, value)
-	case "details":
-		return o.Details == value, nil
-	case "shared_tickets":
-		return matchBool(o.SharedTickets, value)
-	case "tags":
-		return matchStringArray(o.Tags, value)
-	}
-
-	return false, ErrFieldMissing
+	return matchField(o, field, value)
 }
 
 func (o *Organization) getUsers(db *DB) []*User {
 	var result []*User
 
-	for _, id := range o.users {
+	db.rlock()
+	ids := db.orgUsers[o.ID]
+	db.runlock()
+
+	for _, id := range ids {
 		if usr, err := db.GetUser(id); err == nil {
 			result = append(result, usr)
 		}
@@ -124,7 +104,11 @@ func (o *Organization) getUsers(db *DB) []*User {
 func (o *Organization) getTickets(db *DB) []*Ticket {
 	var result []*Ticket
 
-	for _, id := range o.tickets {
+	db.rlock()
+	ids := db.orgTickets[o.ID]
+	db.runlock()
+
+	for _, id := range ids {
 		if ticket, err := db.GetTicket(id); err == nil {
 			result = append(result, ticket)
 		}
@@ -153,9 +137,32 @@ type User struct {
 	Tags           []string            `json:"tags"`
 	Suspended      bool                `json:"suspended"`
 	Role           string              `json:"role"`
-	// foreign keys
-	assignee  []string
-	submitter []string
+	// GroupMemberships are the ids of the groups the user is in
+	GroupMemberships []int64 `json:"group_memberships"`
+	// Extra holds the attributes there's no field for like user_fields so
+	// they're written back out
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+func (u *User) UnmarshalJSON(data []byte) error {
+	type user User
+	if err := json.Unmarshal(data, (*user)(u)); err != nil {
+		return err
+	}
+
+	extra, err := unknownFields(ResourceUser, data)
+	u.Extra = extra
+	return err
+}
+
+func (u *User) MarshalJSON() ([]byte, error) {
+	type user User
+	data, err := json.Marshal((*user)(u))
+	if err != nil {
+		return nil, err
+	}
+
+	return withExtra(data, u.Extra)
 }
 
 func (u *User) GetResourceType() ResourceType {
@@ -180,57 +187,23 @@ func (u *User) GetRelated(db *DB) []Data {
 	for _, sub := range u.getSubmitter(db) {
 		result = append(result, sub)
 	}
+	result = append(result, db.Linked(u)...)
 
 	return result
 }
 
 func (u *User) Match(field, value string) (bool, error) {
-	switch field {
-	case "url":
-		return u.URL == value, nil
-	case "external_id":
-		return u.ExternalID == value, nil
-	case "name":
-		return u.Name == value, nil
-	case "alias":
-		return u.Alias == value, nil
-	case "created_at":
-		return matchTime(u.CreatedAt.Time, value)
-	case "active":
-		return matchBool(u.Active, value)
-	case "verified":
-		return matchBool(u.Verified, value)
-	case "shared":
-		return matchBool(u.Shared, value)
-	case "locale":
-		return u.Locale == value, nil
-	case "timezone":
-		return u.Timezone == value, nil
-	case "last_login_at":
-		return matchTime(u.LastLoginAt.Time, value)
-	case "email":
-		return u.Email == value, nil
-	case "phone":
-		return u.Phone == value, nil
-	case "signature":
-		return u.Signature == value, nil
-	case "organization_id":
-		return matchInt64(u.OrganizationID, value)
-	case "tags":
-		return matchStringArray(u.Tags, value)
-	case "suspended":
-		return matchBool(u.Suspended, value)
-	case "role":
-		return u.Role == value, nil
-	}
-
-	return false, ErrFieldMissing
+	return matchField(u, field, value)
 }
 
 func (u *User) getAssignee(db *DB) []*Ticket {
 	var result []*Ticket
 
-	for _, id := range u.assignee {
+	db.rlock()
+	ids := db.assigned[u.ID]
+	db.runlock()
+
+	for _, id := range ids {
 		if ticket, err := db.GetTicket(id); err == nil {
 			result = append(result, ticket)
 		}
@@ -242,7 +215,11 @@ func (u *User) getAssignee(db *DB) []*Ticket {
 func (u *User) getSubmitter(db *DB) []*Ticket {
 	var result []*Ticket
 
-	for _, id := range u.submitter {
+	db.rlock()
+	ids := db.submitted[u.ID]
+	db.runlock()
+
+	for _, id := range ids {
 		if ticket, err := db.GetTicket(id); err == nil {
 			result = append(result, ticket)
 		}
@@ -268,6 +245,30 @@ type Ticket struct {
 	HasIncidents   bool                `json:"has_incidents"`
 	DueAt          utility.ZendeskTime `json:"due_at"`
 	Via            string              `json:"via"`
+	// Extra holds the attributes there's no field for like custom_fields so
+	// they're written back out
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+func (t *Ticket) UnmarshalJSON(data []byte) error {
+	type ticket Ticket
+	if err := json.Unmarshal(data, (*ticket)(t)); err != nil {
+		return err
+	}
+
+	extra, err := unknownFields(ResourceTicket, data)
+	t.Extra = extra
+	return err
+}
+
+func (t *Ticket) MarshalJSON() ([]byte, error) {
+	type ticket Ticket
+	data, err := json.Marshal((*ticket)(t))
+	if err != nil {
+		return nil, err
+	}
+
+	return withExtra(data, t.Extra)
 }
 
 func (t *Ticket) GetKey() string {
@@ -290,42 +291,65 @@ func (t *Ticket) GetRelated(db *DB) []Data {
 	if assUsr, err := db.GetUser(t.AssigneeID); err == nil {
 		result = append(result, assUsr)
 	}
+	result = append(result, db.Linked(t)...)
+
 	return result
 }
 
 func (t *Ticket) Match(field, value string) (bool, error) {
-	switch field {
-	case "url":
-		return t.URL == value, nil
-	case "external_id":
-		return t.ExternalID == value, nil
-	case "created_at":
-		return matchTime(t.CreatedAt.Time, value)
-	case "type":
-		return t.Type == value, nil
-	case "subject":
-		return t.Subject == value, nil
-	case "description":
-		return t.Description == value, nil
-	case "priority":
-		return t.Priority == value, nil
-	case "status":
-		return t.Status == value, nil
-	case "submitter_id":
-		return matchInt64(t.SubmitterID, value)
-	case "assignee_id":
-		return matchInt64(t.AssigneeID, value)
-	case "organization_id":
-		return matchInt64(t.OrganizationID, value)
-	case "tags":
-		return matchStringArray(t.Tags, value)
-	case "has_incidents":
-		return matchBool(t.HasIncidents, value)
-	case "due_at":
-		return matchTime(t.DueAt.Time, value)
-	case "via":
-		return t.Via == value, nil
-	}
+	return matchField(t, field, value)
+}
+
+type Group struct {
+	ID          int64               `json:"_id"`
+	URL         string              `json:"url"`
+	Name        string              `json:"name"`
+	Description string              `json:"description"`
+	Default     bool                `json:"default"`
+	Deleted     bool                `json:"deleted"`
+	CreatedAt   utility.ZendeskTime `json:"created_at"`
+	UpdatedAt   utility.ZendeskTime `json:"updated_at"`
+}
+
+func (g *Group) GetKey() string {
+	return fmt.Sprintf("%d", g.ID)
+}
+
+func (g *Group) GetResourceType() ResourceType {
+	return ResourceGroup
+}
+
+// GetRelated returns the group's members
+func (g *Group) GetRelated(db *DB) []Data {
+	return db.Linked(g)
+}
+
+func (g *Group) Match(field, value string) (bool, error) {
+	return matchField(g, field, value)
+}
+
+type TicketComment struct {
+	ID        int64               `json:"_id"`
+	TicketID  string              `json:"ticket_id"`
+	AuthorID  int64               `json:"author_id"`
+	Body      string              `json:"body"`
+	Public    bool                `json:"public"`
+	CreatedAt utility.ZendeskTime `json:"created_at"`
+}
+
+func (c *TicketComment) GetKey() string {
+	return fmt.Sprintf("%d", c.ID)
+}
+
+func (c *TicketComment) GetResourceType() ResourceType {
+	return ResourceTicketComment
+}
+
+// GetRelated returns the comment's ticket and author
+func (c *TicketComment) GetRelated(db *DB) []Data {
+	return db.Linked(c)
+}
 
-	return false, ErrFieldMissing
+func (c *TicketComment) Match(field, value string) (bool, error) {
+	return matchField(c, field, value)
 }
@@ -0,0 +1,286 @@
+package db
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// The links between organizations, users and tickets have their own back
+// references so they aren't registered Relations, but paths can still follow
+// them
+var builtinRelations = map[ResourceType][]Relation{
+	ResourceUser: {
+		{Name: "organization", Field: "organization_id", Target: ResourceOrganization},
+	},
+	ResourceTicket: {
+		{Name: "organization", Field: "organization_id", Target: ResourceOrganization},
+		{Name: "submitter", Field: "submitter_id", Target: ResourceUser},
+		{Name: "assignee", Field: "assignee_id", Target: ResourceUser},
+	},
+}
+
+// Relations lists the relations paths from the resource can follow, with
+// every Name filled in
+func Relations(resource ResourceType) ([]Relation, error) {
+	registered, err := LookupResource(resource)
+	if err != nil {
+		return nil, err
+	}
+
+	builtin := builtinRelations[resource]
+	var result []Relation
+	for _, relation := range append(builtin[:len(builtin):len(builtin)], registered.Relations...) {
+		relation.Name = relation.name()
+		result = append(result, relation)
+	}
+
+	return result, nil
+}
+
+// relationNamed finds the relation paths call name
+func relationNamed(resource ResourceType, name string) (Relation, bool) {
+	relations, _ := Relations(resource)
+	for _, relation := range relations {
+		if relation.Name == name {
+			return relation, true
+		}
+	}
+
+	return Relation{}, false
+}
+
+// RecordGetter is what paths look related records up in, a DB or the shards
+// of a ShardedDB
+type RecordGetter interface {
+	GetRecord(resource ResourceType, key string) (Data, error)
+}
+
+// Path is a field which can be on a related record like organization.name
+// on a ticket. A path without any relations is just the field
+type Path struct {
+	Name string
+	// Resource is the resource the path starts from
+	Resource ResourceType
+	// Field is the field at the end of the relations
+	Field     *Field
+	relations []Relation
+}
+
+// LookupPath resolves a dotted path. Each part which names a relation is
+// followed to the related records, then what's left is looked up with
+// LookupField
+func LookupPath(resource ResourceType, name string) (*Path, error) {
+	result := &Path{Name: name, Resource: resource}
+
+	current, rest := resource, name
+	for {
+		parts := strings.SplitN(rest, ".", 2)
+		relation, ok := relationNamed(current, parts[0])
+		if !ok || len(parts) == 1 {
+			break
+		}
+		result.relations = append(result.relations, relation)
+		current, rest = relation.Target, parts[1]
+	}
+
+	field, err := LookupField(current, rest)
+	if err != nil {
+		if len(result.relations) > 0 {
+			return nil, errors.Wrapf(err, "path %s", name)
+		}
+		return nil, err
+	}
+	result.Field = field
+
+	return result, nil
+}
+
+// Related is true if the path follows any relations
+func (p *Path) Related() bool {
+	return len(p.relations) > 0
+}
+
+// Target is the resource holding the field at the end of the path
+func (p *Path) Target() ResourceType {
+	if len(p.relations) == 0 {
+		return p.Resource
+	}
+	return p.relations[len(p.relations)-1].Target
+}
+
+// follow returns the records at the end of the relations. Keys which don't
+// resolve are skipped
+func (p *Path) follow(db RecordGetter, record Data) []Data {
+	records := []Data{record}
+	for _, relation := range p.relations {
+		var next []Data
+		for _, from := range records {
+			for _, key := range relationKeys(from, relation) {
+				if related, err := db.GetRecord(relation.Target, key); err == nil {
+					next = append(next, related)
+				}
+			}
+		}
+		records = next
+	}
+
+	return records
+}
+
+// Value returns the field of the record at the end of the path, nil if
+// there is none or a list of the values if a relation holds several keys
+func (p *Path) Value(db RecordGetter, record Data) interface{} {
+	if !p.Related() {
+		return p.Field.Value(record)
+	}
+
+	records := p.follow(db, record)
+	if len(records) == 0 {
+		return nil
+	}
+	if !p.many() {
+		return p.Field.Value(records[0])
+	}
+
+	result := make([]interface{}, len(records))
+	for i, related := range records {
+		result[i] = p.Field.Value(related)
+	}
+	return result
+}
+
+// many is true if any relation on the way can hold several keys
+func (p *Path) many() bool {
+	from := p.Resource
+	for _, relation := range p.relations {
+		field, err := LookupField(from, relation.Field)
+		if err == nil && (field.Kind == FieldList || field.Kind == FieldIntList) {
+			return true
+		}
+		from = relation.Target
+	}
+	return false
+}
+
+// matchFunc parses value once. A record matches if any record at the end of
+// the path does
+func (p *Path) matchFunc(db RecordGetter, value string) (func(record Data) bool, error) {
+	match, err := p.Field.matchFunc(value)
+	if err != nil || !p.Related() {
+		return match, err
+	}
+
+	return func(record Data) bool {
+		for _, related := range p.follow(db, record) {
+			if match(related) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// Compare compares the first record at the end of each path. Records with
+// nothing at the end come first
+func (p *Path) Compare(db RecordGetter, a, b Data) int {
+	if !p.Related() {
+		return p.Field.Compare(a, b)
+	}
+
+	aRecords, bRecords := p.follow(db, a), p.follow(db, b)
+	switch {
+	case len(aRecords) == 0 && len(bRecords) == 0:
+		return 0
+	case len(aRecords) == 0:
+		return -1
+	case len(bRecords) == 0:
+		return 1
+	}
+
+	return p.Field.Compare(aRecords[0], bRecords[0])
+}
+
+// pathsFor looks up each name from the resource. Descending paths are noted
+// in descending
+func pathsFor(resource ResourceType, names []string) ([]*Path, []bool, error) {
+	var paths []*Path
+	var descending []bool
+	for _, name := range names {
+		desc := strings.HasPrefix(name, "-")
+		path, err := LookupPath(resource, strings.TrimPrefix(name, "-"))
+		if err != nil {
+			return nil, nil, err
+		}
+		paths = append(paths, path)
+		descending = append(descending, desc)
+	}
+
+	return paths, descending, nil
+}
+
+// sortRecords sorts by each path in turn then by resource and key
+func sortRecords(db RecordGetter, records []Data, sortBy []string) error {
+	type sortPaths struct {
+		paths      []*Path
+		descending []bool
+	}
+	byResource := make(map[ResourceType]sortPaths)
+	for _, record := range records {
+		resource := record.GetResourceType()
+		if _, ok := byResource[resource]; ok {
+			continue
+		}
+		paths, descending, err := pathsFor(resource, sortBy)
+		if err != nil {
+			return err
+		}
+		byResource[resource] = sortPaths{paths, descending}
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if a.GetResourceType() != b.GetResourceType() {
+			return a.GetResourceType() < b.GetResourceType()
+		}
+		order := byResource[a.GetResourceType()]
+		for k, path := range order.paths {
+			result := path.Compare(db, a, b)
+			if order.descending[k] {
+				result = -result
+			}
+			if result != 0 {
+				return result < 0
+			}
+		}
+		return keyLess(a.GetKey(), b.GetKey())
+	})
+
+	return nil
+}
+
+// projectRecords returns the value of each path for every record
+func projectRecords(db RecordGetter, records []Data, fields []string) ([]map[string]interface{}, error) {
+	byResource := make(map[ResourceType][]*Path)
+	result := make([]map[string]interface{}, 0, len(records))
+	for _, record := range records {
+		resource := record.GetResourceType()
+		paths, ok := byResource[resource]
+		if !ok {
+			var err error
+			if paths, _, err = pathsFor(resource, fields); err != nil {
+				return nil, err
+			}
+			byResource[resource] = paths
+		}
+
+		row := make(map[string]interface{}, len(paths))
+		for _, path := range paths {
+			row[path.Name] = path.Value(db, record)
+		}
+		result = append(result, row)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,123 @@
+package db_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sardap/zendesk/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func resolveKeys(t *testing.T, database *db.DB, query db.Query) []string {
+	result, err := query.Resolve(database)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	var keys []string
+	for _, record := range result.Target {
+		keys = append(keys, record.GetKey())
+	}
+	return keys
+}
+
+func TestPathConditions(t *testing.T) {
+	database := createLoadedDB()
+
+	testCases := []struct {
+		resource db.ResourceType
+		field    string
+		value    string
+		expected []string
+	}{
+		{db.ResourceTicket, "organization.name", "Enthaze", []string{
+			"27c447d9-cfda-4415-9a72-d5aa12942cf1", "89255552-e9a2-433b-970a-af194b3a39dd",
+			"b07a8c20-2ee5-493b-9ebf-f6321b95966e", "c22aaced-7faa-4b5c-99e5-1a209500ff16",
+		}},
+		{db.ResourceTicket, "assignee.email", "coffeyrasmussen@flotonic.com", []string{
+			"13aafde0-81db-47fd-b1a2-94b0015803df", "1fafaa2a-a1e9-4158-aeb4-f17e64615300",
+		}},
+		{db.ResourceUser, "organization.name", "Enthaze", []string{"5", "23", "27", "29"}},
+		{db.ResourceUser, "organization.tags", "Fulton", []string{"5", "23", "27", "29"}},
+		// Two hops
+		{db.ResourceTicket, "assignee.organization.name", "Nutralab", nil},
+	}
+	for _, testCase := range testCases {
+		keys := resolveKeys(t, database, db.Query{
+			Conditions: []db.Condition{&db.FulLMatchCondition{
+				Resource: testCase.resource, Connector: db.ConnectorTypeUnion, Field: testCase.field, Match: testCase.value,
+			}},
+			SortBy: []string{"_id"},
+		})
+		if testCase.expected == nil {
+			assert.NotEmptyf(t, keys, "%s %s", testCase.resource, testCase.field)
+			continue
+		}
+		assert.Equalf(t, testCase.expected, keys, "%s %s", testCase.resource, testCase.field)
+	}
+
+	_, err := db.LookupPath(db.ResourceTicket, "organization.garbage")
+	assert.ErrorIs(t, err, db.ErrFieldMissing)
+	// Not a relation so it's taken to be an extra attribute which nothing has
+	garbage := db.FulLMatchCondition{Resource: db.ResourceTicket, Field: "garbage.name", Match: "x"}
+	_, err = garbage.Resolve(database)
+	assert.ErrorIs(t, err, db.ErrFieldMissing)
+
+	cond := db.FulLMatchCondition{Resource: db.ResourceUser, Field: "organization.name", Match: "Enthaze"}
+	_, err = cond.MatchRecord(&expectedUser)
+	assert.ErrorIs(t, err, db.ErrInvalidMatch, "related records need the DB")
+}
+
+func TestPathSortAndProject(t *testing.T) {
+	database := createBlankDb()
+	database.AddOrganization(db.Organization{ID: 1, Name: "b"})
+	database.AddOrganization(db.Organization{ID: 2, Name: "a"})
+	database.AddUser(db.User{ID: 1, Name: "x", OrganizationID: 1, Email: "x@example.com"})
+	database.AddUser(db.User{ID: 2, Name: "x", OrganizationID: 2, Email: "y@example.com"})
+	database.AddUser(db.User{ID: 3, Name: "x"})
+	database.AddTicket(db.Ticket{ID: "t", AssigneeID: 2})
+
+	query := db.Query{
+		Conditions: []db.Condition{&db.FulLMatchCondition{Resource: db.ResourceUser, Connector: db.ConnectorTypeUnion, Field: "name", Match: "x"}},
+		SortBy:     []string{"organization.name"},
+		Fields:     []string{"_id", "organization.name"},
+	}
+	assert.Equal(t, []string{"3", "2", "1"}, resolveKeys(t, database, query), "users without an organization first")
+
+	query.SortBy = []string{"-organization.name"}
+	result, err := query.Resolve(database)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []map[string]interface{}{
+			{"_id": int64(1), "organization.name": "b"},
+			{"_id": int64(2), "organization.name": "a"},
+			{"_id": int64(3), "organization.name": nil},
+		}, result.Rows)
+	}
+
+	query.SortBy = []string{"organization.garbage"}
+	_, err = query.Resolve(database)
+	assert.ErrorIs(t, err, db.ErrFieldMissing)
+
+	// Lists of keys give lists of values
+	database.Import(db.ResourceGroup, strings.NewReader(`[{"_id": 1, "name": "g1"}, {"_id": 2, "name": "g2"}]`), db.LoadOptions{})
+	database.UpdateUser(db.User{ID: 1, Name: "x", GroupMemberships: []int64{1, 2}})
+	query = db.Query{
+		Conditions: []db.Condition{&db.IDMatchCondition{Resource: db.ResourceUser, Target: "1"}},
+		Fields:     []string{"groups.name"},
+	}
+	result, err = query.Resolve(database)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []interface{}{"g1", "g2"}, result.Rows[0]["groups.name"])
+	}
+}
+
+func TestRelations(t *testing.T) {
+	relations, err := db.Relations(db.ResourceUser)
+	assert.NoError(t, err)
+	assert.Equal(t, []db.Relation{
+		{Name: "organization", Field: "organization_id", Target: db.ResourceOrganization},
+		{Name: "groups", Field: "group_memberships", Target: db.ResourceGroup},
+	}, relations)
+
+	_, err = db.Relations("garbage")
+	assert.ErrorIs(t, err, db.ErrInvalidResouce)
+}
@@ -2,21 +2,23 @@ package db
 
 import (
 	"fmt"
-	"strconv"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
 var (
-	ErrFieldMissing   error
-	ErrInvalidResouce error
-	ErrInvalidMatch   error
+	ErrFieldMissing     error
+	ErrInvalidResouce   error
+	ErrInvalidMatch     error
+	ErrInvalidConnector error
 )
 
 func init() {
 	ErrFieldMissing = fmt.Errorf("field doesn't exist in that type")
 	ErrInvalidResouce = fmt.Errorf("invalid resouce given")
 	ErrInvalidMatch = fmt.Errorf("invalid match given")
+	ErrInvalidConnector = fmt.Errorf("invalid connector given")
 }
 
 type ResourceType string
@@ -25,6 +27,10 @@ const (
 	ResourceOrganization ResourceType = "organization"
 	ResourceUser         ResourceType = "user"
 	ResourceTicket       ResourceType = "ticket"
+	// ResourceGroup and ResourceTicketComment are registered with
+	// RegisterResource like any other resource
+	ResourceGroup         ResourceType = "group"
+	ResourceTicketComment ResourceType = "ticket_comment"
 )
 
 type ConnectorType string
@@ -40,69 +46,238 @@ type Condition interface {
 	GetConnector() ConnectorType
 }
 
+// RecordCondition is a Condition which can check a single record without
+// resolving against the whole DB
+type RecordCondition interface {
+	Condition
+	MatchRecord(record Data) (bool, error)
+}
+
+// QueryResult holds the targets and their related records sorted by
+// resource then key, unless the query sorts the targets by something else
 type QueryResult struct {
-	Target  []Data `json:"target"`
+	// Tenant is set on results from Tenants.Resolve
+	Tenant string `json:"tenant,omitempty"`
+	// Meta is left out if nil
+	Meta    *ResultMeta `json:"meta,omitempty"`
+	Target  []Data      `json:"target"`
 	Related struct {
 		Orgs    []Data `json:"organizations"`
 		Users   []Data `json:"users"`
 		Tickets []Data `json:"tickets"`
+		// Others holds related records of every other registered resource
+		Others map[ResourceType][]Data `json:"others,omitempty"`
 	} `json:"related"`
+	// Fields are the Query.Fields and Rows holds them for each target in the
+	// same order
+	Fields []string                 `json:"fields,omitempty"`
+	Rows   []map[string]interface{} `json:"rows,omitempty"`
+}
+
+// ResultMeta describes the query which made a result and the data it ran
+// against
+type ResultMeta struct {
+	Query QueryEcho `json:"query"`
+	// Total is how many targets matched
+	Total int `json:"total"`
+	// Elapsed is how long resolving took, formatted like 1.5ms
+	Elapsed string `json:"elapsed"`
+	// Datasets are the inputs the DB was loaded from
+	Datasets []Source `json:"datasets"`
+}
+
+// QueryEcho is a Query as it was given
+type QueryEcho struct {
+	Conditions []ConditionEcho `json:"conditions"`
+	AsOf       *time.Time      `json:"as_of,omitempty"`
+	SortBy     []string        `json:"sort_by,omitempty"`
+	Fields     []string        `json:"fields,omitempty"`
+}
+
+type ConditionEcho struct {
+	Resource  ResourceType  `json:"resource"`
+	Connector ConnectorType `json:"connector"`
+	Field     string        `json:"field,omitempty"`
+	Match     string        `json:"match"`
+}
+
+// echo describes a condition. Conditions other than IDMatchCondition and
+// FulLMatchCondition only give their resource and connector
+func echo(con Condition) ConditionEcho {
+	switch val := con.(type) {
+	case *IDMatchCondition:
+		return ConditionEcho{val.Resource, val.GetConnector(), "_id", val.Target}
+	case *FulLMatchCondition:
+		return ConditionEcho{val.Resource, val.Connector, val.Field, val.Match}
+	}
+
+	return ConditionEcho{Resource: con.GetResource(), Connector: con.GetConnector()}
+}
+
+// Echo describes the query for ResultMeta
+func (q *Query) Echo() QueryEcho {
+	result := QueryEcho{
+		Conditions: make([]ConditionEcho, len(q.Conditions)),
+		SortBy:     q.SortBy,
+		Fields:     q.Fields,
+	}
+	for i, con := range q.Conditions {
+		result.Conditions[i] = echo(con)
+	}
+	if !q.AsOf.IsZero() {
+		asOf := q.AsOf
+		result.AsOf = &asOf
+	}
+
+	return result
 }
 
 type Query struct {
 	Conditions []Condition
+	// AsOf evaluates the conditions against the DB as it was at that time.
+	// Zero uses the current state
+	AsOf time.Time
+	// SortBy orders the targets by field paths like organization.name. A
+	// path starting with - sorts descending
+	SortBy []string
+	// Fields are the field paths to put in QueryResult.Rows
+	Fields []string
 }
 
+// Resolve runs against a view of the DB which doesn't change part way
+// through, so a commit made while resolving is either fully seen or not at
+// all. The conditions must not change the DB.
 func (q *Query) Resolve(db *DB) (*QueryResult, error) {
-	matches := make(map[string]Data)
+	start := time.Now()
+	if !q.AsOf.IsZero() {
+		db = db.AsOf(q.AsOf)
+	}
+
+	var result *QueryResult
+	err := db.read(func(view *DB) error {
+		var err error
+		result, err = q.resolve(view)
+		if err == nil {
+			result.Meta = &ResultMeta{
+				Query:    q.Echo(),
+				Total:    len(result.Target),
+				Datasets: append([]Source{}, view.sources...),
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.Meta.Elapsed = time.Since(start).String()
+
+	return result, nil
+}
+
+func (q *Query) resolve(db *DB) (*QueryResult, error) {
+	// keyed by resource as well since keys are only unique within one
+	matches := make(map[recordRef]Data)
 
 	for i, con := range q.Conditions {
 		condMatches, err := con.Resolve(db)
 		if err != nil {
 			return nil, err
 		}
-
-		switch con.GetConnector() {
-		case ConnectorTypeIntersection:
-			intersection := make(map[string]Data)
-			for _, val := range condMatches {
-				if i == 0 {
-					intersection[val.GetKey()] = val
-				} else {
-					if _, ok := matches[val.GetKey()]; ok {
-						intersection[val.GetKey()] = val
-					}
-				}
-			}
-
-			matches = intersection
-		case ConnectorTypeUnion:
-			for _, val := range condMatches {
-				matches[val.GetKey()] = val
-			}
-		default:
-			panic(fmt.Errorf("unimplemented connector type"))
+		if matches, err = connect(con, i == 0, matches, condMatches); err != nil {
+			return nil, err
 		}
 	}
 
 	var result QueryResult
+	// records related to more than one target are only listed once
+	seen := make(map[recordRef]bool)
 	for _, val := range matches {
 		result.Target = append(result.Target, val)
 		for _, related := range val.GetRelated(db) {
-			switch related.GetResourceType() {
-			case ResourceOrganization:
-				result.Related.Orgs = append(result.Related.Orgs, val)
-			case ResourceUser:
-				result.Related.Users = append(result.Related.Users, val)
-			case ResourceTicket:
-				result.Related.Tickets = append(result.Related.Tickets, val)
-			}
+			result.addRelated(related, seen)
 		}
 	}
 
+	if err := result.finish(db, q); err != nil {
+		return nil, err
+	}
+
 	return &result, nil
 }
 
+// connect combines the matches of a condition with the matches so far
+func connect(con Condition, first bool, matches map[recordRef]Data, condMatches []Data) (map[recordRef]Data, error) {
+	switch con.GetConnector() {
+	case ConnectorTypeIntersection:
+		intersection := make(map[recordRef]Data)
+		for _, val := range condMatches {
+			ref := refOf(val)
+			if first {
+				intersection[ref] = val
+			} else {
+				if _, ok := matches[ref]; ok {
+					intersection[ref] = val
+				}
+			}
+		}
+
+		return intersection, nil
+	case ConnectorTypeUnion:
+		for _, val := range condMatches {
+			matches[refOf(val)] = val
+		}
+		return matches, nil
+	}
+
+	return nil, errors.Wrapf(ErrInvalidConnector, "%s", con.GetConnector())
+}
+
+// addRelated lists a related record unless it's in seen
+func (r *QueryResult) addRelated(related Data, seen map[recordRef]bool) {
+	ref := refOf(related)
+	if seen[ref] {
+		return
+	}
+	seen[ref] = true
+
+	switch related.GetResourceType() {
+	case ResourceOrganization:
+		r.Related.Orgs = append(r.Related.Orgs, related)
+	case ResourceUser:
+		r.Related.Users = append(r.Related.Users, related)
+	case ResourceTicket:
+		r.Related.Tickets = append(r.Related.Tickets, related)
+	default:
+		if r.Related.Others == nil {
+			r.Related.Others = make(map[ResourceType][]Data)
+		}
+		resource := related.GetResourceType()
+		r.Related.Others[resource] = append(r.Related.Others[resource], related)
+	}
+}
+
+// finish sorts the targets and related records and picks the query's fields
+func (r *QueryResult) finish(db RecordGetter, q *Query) error {
+	sortData(r.Related.Orgs)
+	sortData(r.Related.Users)
+	sortData(r.Related.Tickets)
+	for _, related := range r.Related.Others {
+		sortData(related)
+	}
+	if err := sortRecords(db, r.Target, q.SortBy); err != nil {
+		return err
+	}
+	if len(q.Fields) > 0 {
+		rows, err := projectRecords(db, r.Target, q.Fields)
+		if err != nil {
+			return err
+		}
+		r.Fields, r.Rows = q.Fields, rows
+	}
+
+	return nil
+}
+
 type IDMatchCondition struct {
 	Resource ResourceType
 	Target   string
@@ -116,38 +291,17 @@ func (i *IDMatchCondition) GetResource() ResourceType {
 	return i.Resource
 }
 
+func (i *IDMatchCondition) MatchRecord(record Data) (bool, error) {
+	return record.GetResourceType() == i.Resource && record.GetKey() == i.Target, nil
+}
+
 func (i *IDMatchCondition) Resolve(db *DB) ([]Data, error) {
-	switch i.Resource {
-	case ResourceOrganization:
-		id, err := strconv.ParseInt(i.Target, 10, 64)
-		if err != nil {
-			return nil, errors.Wrap(err, "given target ID must be a number and base 10")
-		}
-		result, err := db.GetOrganization(id)
-		if err != nil {
-			return nil, err
-		}
-		return []Data{result}, nil
-	case ResourceUser:
-		id, err := strconv.ParseInt(i.Target, 10, 64)
-		if err != nil {
-			return nil, errors.Wrap(err, "given target ID must be a number and base 10")
-		}
-		result, err := db.GetUser(id)
-		if err != nil {
-			return nil, err
-		}
-		return []Data{result}, nil
-	case ResourceTicket:
-		result, err := db.GetTicket(i.Target)
-		if err != nil {
-			return nil, err
-		}
-		return []Data{result}, nil
-	default:
-		return nil, errors.Wrapf(ErrInvalidResouce, "%s", i.Resource)
+	result, err := db.GetRecord(i.Resource, i.Target)
+	if err != nil {
+		return nil, err
 	}
 
+	return []Data{result}, nil
 }
 
 type FulLMatchCondition struct {
@@ -155,6 +309,8 @@ type FulLMatchCondition struct {
 	Connector ConnectorType
 	Field     string
 	Match     string
+	// Workers is how many goroutines to scan with. Zero uses GOMAXPROCS
+	Workers int
 }
 
 func (f *FulLMatchCondition) GetConnector() ConnectorType {
@@ -165,43 +321,80 @@ func (f *FulLMatchCondition) GetResource() ResourceType {
 	return f.Resource
 }
 
+// MatchRecord fails with ErrInvalidMatch if the field is on a related record
+// since that needs the DB
+func (f *FulLMatchCondition) MatchRecord(record Data) (bool, error) {
+	if record.GetResourceType() != f.Resource {
+		return false, nil
+	}
+	path, err := LookupPath(f.Resource, f.Field)
+	if err != nil {
+		return false, err
+	}
+	if path.Related() {
+		return false, errors.Wrapf(ErrInvalidMatch, "%s is on a related record", f.Field)
+	}
+
+	val, ok := record.(matcher)
+	if !ok {
+		return false, errors.Wrapf(ErrInvalidResouce, "%s", f.Resource)
+	}
+	return val.Match(f.Field, f.Match)
+}
+
+// matchRecordIn is MatchRecord following relations like organization.name
+// to the related records in db
+func (f *FulLMatchCondition) matchRecordIn(db RecordGetter, record Data) (bool, error) {
+	if record.GetResourceType() != f.Resource {
+		return false, nil
+	}
+	path, err := LookupPath(f.Resource, f.Field)
+	if err != nil {
+		return false, err
+	}
+	if !path.Related() {
+		return f.MatchRecord(record)
+	}
+	match, err := path.matchFunc(db, f.Match)
+	if err != nil {
+		return false, err
+	}
+
+	return match(record), nil
+}
+
+// Resolve matches the field path against every record, following relations
+// like organization.name to the related records
 func (f *FulLMatchCondition) Resolve(db *DB) ([]Data, error) {
-	var result []Data
+	path, err := LookupPath(f.Resource, f.Field)
+	if err != nil {
+		return nil, err
+	}
+	match, err := path.matchFunc(db, f.Match)
+	if err != nil {
+		return nil, err
+	}
 
-	switch f.Resource {
-	case ResourceOrganization:
-		for _, val := range db.orgs {
-			match, err := val.Match(f.Field, f.Match)
-			if err != nil {
-				return nil, err
-			}
-			if match {
-				result = append(result, val)
-			}
-		}
-	case ResourceUser:
-		for _, val := range db.users {
-			match, err := val.Match(f.Field, f.Match)
-			if err != nil {
-				return nil, err
-			}
-			if match {
-				result = append(result, val)
-			}
-		}
-	case ResourceTicket:
-		for _, val := range db.tickets {
-			match, err := val.Match(f.Field, f.Match)
-			if err != nil {
-				return nil, err
-			}
-			if match {
-				result = append(result, val)
-			}
+	db.rlock()
+	records := db.records(f.Resource)
+	if field := path.Field; field.Kind == FieldExtra && !anyHasExtra(db.records(path.Target()), field) {
+		db.runlock()
+		return nil, errors.Wrapf(ErrFieldMissing, "no %s has an attribute %s", path.Target(), field.path[0])
+	}
+	// Records are never modified once added so they can be scanned unlocked
+	db.runlock()
+
+	return scan(records, match, f.Workers), nil
+}
+
+// anyHasExtra is true if any record has the extra attribute so a typo in a
+// path isn't taken to be an attribute nothing has
+func anyHasExtra(records []Data, field *Field) bool {
+	for _, record := range records {
+		if field.hasExtra(record) {
+			return true
 		}
-	default:
-		return nil, errors.Wrapf(ErrInvalidResouce, "%s", f.Resource)
 	}
 
-	return result, nil
+	return false
 }
@@ -1,6 +1,9 @@
 package db_test
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
 	"testing"
 
 	"github.com/sardap/zendesk/db"
@@ -160,6 +163,99 @@ func TestQueryRelated(t *testing.T) {
 	assert.Equal(t, 1, len(result.Related.Orgs))
 	assert.Equal(t, 4, len(result.Related.Tickets))
 	assert.Equal(t, 0, len(result.Related.Users))
+	for _, org := range result.Related.Orgs {
+		assert.Equal(t, db.ResourceOrganization, org.GetResourceType())
+	}
+}
+
+func keysOf(records []db.Data) []string {
+	var result []string
+	for _, record := range records {
+		result = append(result, record.GetKey())
+	}
+	return result
+}
+
+func TestQueryOrder(t *testing.T) {
+	database := createLoadedDB()
+
+	query := db.Query{
+		Conditions: []db.Condition{
+			&db.FulLMatchCondition{
+				Resource:  db.ResourceUser,
+				Connector: db.ConnectorTypeUnion,
+				Field:     "organization_id",
+				Match:     "119",
+			},
+			&db.IDMatchCondition{Resource: db.ResourceOrganization, Target: "101"},
+		},
+	}
+
+	first, err := query.Resolve(database)
+	assert.NoError(t, err)
+	if !assert.NotEmpty(t, first.Target) {
+		return
+	}
+	assert.Equal(t, db.ResourceOrganization, first.Target[0].GetResourceType(), "sorted by resource first")
+	for i := 0; i < 10; i++ {
+		result, err := query.Resolve(database)
+		assert.NoError(t, err)
+		assert.Equal(t, keysOf(first.Target), keysOf(result.Target))
+		assert.Equal(t, keysOf(first.Related.Orgs), keysOf(result.Related.Orgs))
+		assert.Equal(t, keysOf(first.Related.Users), keysOf(result.Related.Users))
+		assert.Equal(t, keysOf(first.Related.Tickets), keysOf(result.Related.Tickets))
+	}
+
+	seen := make(map[string]bool)
+	for i, ticket := range first.Related.Tickets {
+		assert.False(t, seen[ticket.GetKey()], "ticket %s listed twice", ticket.GetKey())
+		seen[ticket.GetKey()] = true
+		if i > 0 {
+			assert.Less(t, first.Related.Tickets[i-1].GetKey(), ticket.GetKey())
+		}
+	}
+}
+
+func TestQueryMeta(t *testing.T) {
+	database := createLoadedDB()
+
+	query := db.Query{
+		Conditions: []db.Condition{
+			&db.FulLMatchCondition{
+				Resource:  db.ResourceUser,
+				Connector: db.ConnectorTypeUnion,
+				Field:     "organization_id",
+				Match:     "119",
+			},
+		},
+		SortBy: []string{"name"},
+	}
+
+	result, err := query.Resolve(database)
+	assert.NoError(t, err)
+	meta := result.Meta
+	if !assert.NotNil(t, meta) {
+		return
+	}
+	assert.Equal(t, len(result.Target), meta.Total)
+	assert.NotEmpty(t, meta.Elapsed)
+	assert.Equal(t, []db.ConditionEcho{
+		{Resource: db.ResourceUser, Connector: db.ConnectorTypeUnion, Field: "organization_id", Match: "119"},
+	}, meta.Query.Conditions)
+	assert.Equal(t, []string{"name"}, meta.Query.SortBy)
+	assert.Nil(t, meta.Query.AsOf)
+
+	orgsJson, err := ioutil.ReadFile("db_testdata/organizations.json")
+	assert.NoError(t, err)
+	sum := sha256.Sum256(orgsJson)
+	if assert.Equal(t, 3, len(meta.Datasets)) {
+		orgs := meta.Datasets[0]
+		assert.Equal(t, db.ResourceOrganization, orgs.Resource)
+		assert.Equal(t, "db_testdata/organizations.json", orgs.File)
+		assert.Equal(t, hex.EncodeToString(sum[:]), orgs.SHA256)
+		assert.Equal(t, len(database.Sources()), len(meta.Datasets))
+		assert.NotZero(t, orgs.Records)
+	}
 }
 
 func TestQueryIntersection(t *testing.T) {
@@ -0,0 +1,152 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// LoadError says where in the input a record failed to load
+type LoadError struct {
+	// File is the name of the input if it was a file
+	File     string
+	Resource ResourceType
+	// Index of the record in the input starting from 0
+	Index int
+	// Offset is the byte offset of the start of the record. Zero for CSV rows
+	// which say their row in Err instead
+	Offset int64
+	// Line of the start of the record starting from 1. Zero if unknown
+	Line int
+	// Field that failed to parse. Empty if unknown
+	Field string
+	Err   error
+}
+
+func (l *LoadError) Error() string {
+	var sb strings.Builder
+
+	if l.File != "" {
+		fmt.Fprintf(&sb, "%s: ", l.File)
+	}
+	fmt.Fprintf(&sb, "%s record %d", l.Resource, l.Index)
+	if l.Line > 0 {
+		fmt.Fprintf(&sb, " (line %d, byte %d)", l.Line, l.Offset)
+	} else if l.Offset > 0 {
+		fmt.Fprintf(&sb, " (byte %d)", l.Offset)
+	}
+	if l.Field != "" {
+		fmt.Fprintf(&sb, " field %s", l.Field)
+	}
+	fmt.Fprintf(&sb, ": %v", l.Err)
+
+	return sb.String()
+}
+
+func (l *LoadError) Unwrap() error {
+	return l.Err
+}
+
+func (l *LoadError) Cause() error {
+	return l.Err
+}
+
+// LoadReport is filled in by a load
+type LoadReport struct {
+	Loaded  map[ResourceType]int
+	Skipped []*LoadError
+	// Duplicates are the keys which collided with an existing record
+	Duplicates []DuplicateKey
+	// index into Duplicates
+	duplicates map[ResourceType]map[string]int
+}
+
+func (l *LoadReport) duplicate(resource ResourceType, key string) {
+	if l.duplicates == nil {
+		l.duplicates = make(map[ResourceType]map[string]int)
+	}
+	if l.duplicates[resource] == nil {
+		l.duplicates[resource] = make(map[string]int)
+	}
+
+	if i, ok := l.duplicates[resource][key]; ok {
+		l.Duplicates[i].Count++
+		return
+	}
+	l.duplicates[resource][key] = len(l.Duplicates)
+	l.Duplicates = append(l.Duplicates, DuplicateKey{Resource: resource, Key: key, Count: 2})
+}
+
+func (l *LoadReport) loaded(resource ResourceType) {
+	if l.Loaded == nil {
+		l.Loaded = make(map[ResourceType]int)
+	}
+	l.Loaded[resource]++
+}
+
+func (l *LoadReport) Write(w io.Writer) error {
+	_, err := fmt.Fprintf(w,
+		"loaded %d organizations, %d users and %d tickets, skipped %d records, %d duplicate ids\n",
+		l.Loaded[ResourceOrganization], l.Loaded[ResourceUser], l.Loaded[ResourceTicket],
+		len(l.Skipped), len(l.Duplicates),
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, dup := range l.Duplicates {
+		if _, err := fmt.Fprintf(w, "\t%s %s seen %d times\n", dup.Resource, dup.Key, dup.Count); err != nil {
+			return err
+		}
+	}
+
+	for _, skipped := range l.Skipped {
+		if _, err := fmt.Fprintf(w, "\t%s\n", skipped); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// lineCounter tracks line numbers of a stream as it is read. Offsets must be
+// asked for in increasing order so only the tail which hasn't been counted
+// yet is kept.
+type lineCounter struct {
+	r    io.Reader
+	buf  []byte
+	base int64
+	line int
+}
+
+func newLineCounter(r io.Reader) *lineCounter {
+	return &lineCounter{r: r, line: 1}
+}
+
+func (l *lineCounter) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.buf = append(l.buf, p[:n]...)
+	return n, err
+}
+
+// advance counts the lines up to offset and drops the bytes before it
+func (l *lineCounter) advance(offset int64) {
+	n := offset - l.base
+	if n <= 0 {
+		return
+	}
+	if n > int64(len(l.buf)) {
+		n = int64(len(l.buf))
+	}
+
+	l.line += bytes.Count(l.buf[:n], []byte{'\n'})
+	l.buf = l.buf[n:]
+	l.base += n
+}
+
+// lineAt returns the line offset is on
+func (l *lineCounter) lineAt(offset int64) int {
+	l.advance(offset)
+	return l.line
+}
@@ -0,0 +1,243 @@
+package db
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrResourceExists error
+)
+
+func init() {
+	ErrResourceExists = fmt.Errorf("resource already registered")
+}
+
+type KeyType string
+
+const (
+	KeyInt    KeyType = "int"
+	KeyString KeyType = "string"
+)
+
+// Relation is a foreign key from one resource to another
+type Relation struct {
+	// Name is what field paths call the relation, like author in
+	// author.email. Defaults to Field without its _id suffix
+	Name string
+	// Field holds the key of the Target record or a list of keys
+	Field  string
+	Target ResourceType
+}
+
+func (r Relation) name() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return strings.TrimSuffix(r.Field, "_id")
+}
+
+// Resource describes a type of record the DB can hold
+type Resource struct {
+	Type ResourceType
+	Key  KeyType
+	// New returns an empty record for the loader to unmarshal into. It must
+	// be a pointer to a struct with json tags
+	New func() Data
+	// Relations are followed both ways, so a record's related records
+	// include the records it refers to and the records which refer to it.
+	// The links between organizations, users and tickets are built in.
+	Relations []Relation
+}
+
+var (
+	resourceRegistry = make(map[ResourceType]*Resource)
+	// registration order which is the order every resource is walked in
+	resourceOrder []ResourceType
+)
+
+// RegisterResource adds a type of record which can be loaded, queried and
+// related to the others. Resources must be registered before any DB is used,
+// usually from an init function.
+func RegisterResource(resource Resource) error {
+	if _, ok := resourceRegistry[resource.Type]; ok {
+		return errors.Wrapf(ErrResourceExists, "%s", resource.Type)
+	}
+
+	registerFields(resource.Type, reflect.ValueOf(resource.New()).Elem().Interface())
+	for _, relation := range resource.Relations {
+		if _, err := LookupField(resource.Type, relation.Field); err != nil {
+			delete(fieldRegistry, resource.Type)
+			return err
+		}
+	}
+
+	resourceRegistry[resource.Type] = &resource
+	resourceOrder = append(resourceOrder, resource.Type)
+
+	return nil
+}
+
+// LookupResource fails with ErrInvalidResouce if the resource isn't
+// registered
+func LookupResource(resource ResourceType) (*Resource, error) {
+	result, ok := resourceRegistry[resource]
+	if !ok {
+		return nil, errors.Wrapf(ErrInvalidResouce, "%s", resource)
+	}
+
+	return result, nil
+}
+
+// Resources lists every registered resource in the order they were
+// registered
+func Resources() []ResourceType {
+	return append([]ResourceType{}, resourceOrder...)
+}
+
+// newRecord returns an empty record of the resource
+func newRecord(resource ResourceType) (Data, error) {
+	found, err := LookupResource(resource)
+	if err != nil {
+		return nil, err
+	}
+
+	return found.New(), nil
+}
+
+// relationKeys lists the keys record refers to through relation. Zero ids
+// and empty strings are unset.
+func relationKeys(record Data, relation Relation) []string {
+	field, err := LookupField(record.GetResourceType(), relation.Field)
+	if err != nil {
+		return nil
+	}
+
+	var result []string
+	switch field.Kind {
+	case FieldInt:
+		if id := field.Int(record); id != 0 {
+			result = append(result, strconv.FormatInt(id, 10))
+		}
+	case FieldIntList:
+		for _, id := range field.IntList(record) {
+			if id != 0 {
+				result = append(result, strconv.FormatInt(id, 10))
+			}
+		}
+	case FieldString:
+		if key := field.String(record); key != "" {
+			result = append(result, key)
+		}
+	case FieldList:
+		for _, key := range field.List(record) {
+			if key != "" {
+				result = append(result, key)
+			}
+		}
+	}
+
+	return result
+}
+
+// recordRef is a record linking to another
+type recordRef struct {
+	Resource ResourceType
+	Key      string
+}
+
+func refOf(record Data) recordRef {
+	return recordRef{record.GetResourceType(), record.GetKey()}
+}
+
+// linkRelations adds the back references of the record's relations
+func (d *DB) linkRelations(record Data) {
+	resource, ok := resourceRegistry[record.GetResourceType()]
+	if !ok {
+		return
+	}
+
+	ref := refOf(record)
+	for _, relation := range resource.Relations {
+		if d.refs[relation.Target] == nil {
+			d.refs[relation.Target] = make(map[string][]recordRef)
+		}
+		for _, key := range relationKeys(record, relation) {
+			d.refs[relation.Target][key] = append(d.refs[relation.Target][key], ref)
+		}
+	}
+}
+
+func (d *DB) unlinkRelations(record Data) {
+	resource, ok := resourceRegistry[record.GetResourceType()]
+	if !ok {
+		return
+	}
+
+	ref := refOf(record)
+	for _, relation := range resource.Relations {
+		for _, key := range relationKeys(record, relation) {
+			refs := d.refs[relation.Target][key]
+			for i, val := range refs {
+				if val == ref {
+					d.refs[relation.Target][key] = append(refs[:i:i], refs[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+}
+
+// Linked returns the records the record refers to through its resource's
+// Relations followed by the records which refer to it
+func (d *DB) Linked(record Data) []Data {
+	d.rlock()
+	defer d.runlock()
+
+	var result []Data
+	if resource, ok := resourceRegistry[record.GetResourceType()]; ok {
+		for _, relation := range resource.Relations {
+			for _, key := range relationKeys(record, relation) {
+				if target := d.get(relation.Target, key); target != nil {
+					result = append(result, target)
+				}
+			}
+		}
+	}
+	for _, ref := range d.refs[record.GetResourceType()][record.GetKey()] {
+		if linked := d.get(ref.Resource, ref.Key); linked != nil {
+			result = append(result, linked)
+		}
+	}
+
+	return result
+}
+
+func init() {
+	builtin := []Resource{
+		{Type: ResourceOrganization, Key: KeyInt, New: func() Data { return &Organization{} }},
+		{
+			Type: ResourceUser, Key: KeyInt, New: func() Data { return &User{} },
+			Relations: []Relation{{Name: "groups", Field: "group_memberships", Target: ResourceGroup}},
+		},
+		{Type: ResourceTicket, Key: KeyString, New: func() Data { return &Ticket{} }},
+		{Type: ResourceGroup, Key: KeyInt, New: func() Data { return &Group{} }},
+		{
+			Type: ResourceTicketComment, Key: KeyInt, New: func() Data { return &TicketComment{} },
+			Relations: []Relation{
+				{Field: "ticket_id", Target: ResourceTicket},
+				{Field: "author_id", Target: ResourceUser},
+			},
+		},
+	}
+
+	for _, resource := range builtin {
+		if err := RegisterResource(resource); err != nil {
+			panic(err)
+		}
+	}
+}
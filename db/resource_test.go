@@ -0,0 +1,132 @@
+package db_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/sardap/zendesk/db"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	groupsJson = `[
+		{"_id": 1, "name": "Support", "default": true},
+		{"_id": 2, "name": "Billing"}
+	]`
+	ticketCommentsJson = `[
+		{"_id": 10, "ticket_id": "a", "author_id": 1, "body": "hello", "public": true},
+		{"_id": 11, "ticket_id": "a", "author_id": 2, "body": "internal"},
+		{"_id": 12, "ticket_id": "gone", "author_id": 1, "body": "orphan"}
+	]`
+)
+
+func createGroupsDB(t *testing.T) *db.DB {
+	result, err := db.CreateResources(map[db.ResourceType]io.Reader{
+		db.ResourceUser: strings.NewReader(`[
+			{"_id": 1, "name": "a", "group_memberships": [1, 2]},
+			{"_id": 2, "name": "b", "group_memberships": [2]}
+		]`),
+		db.ResourceTicket:        strings.NewReader(`[{"_id": "a", "assignee_id": 1}]`),
+		db.ResourceGroup:         strings.NewReader(groupsJson),
+		db.ResourceTicketComment: strings.NewReader(ticketCommentsJson),
+	}, db.LoadOptions{})
+	assert.NoError(t, err)
+
+	return result
+}
+
+func relatedKeys(related []db.Data) []string {
+	var result []string
+	for _, record := range related {
+		result = append(result, string(record.GetResourceType())+" "+record.GetKey())
+	}
+	return result
+}
+
+func TestRegisterResource(t *testing.T) {
+	assert.Equal(t, []db.ResourceType{
+		db.ResourceOrganization, db.ResourceUser, db.ResourceTicket, db.ResourceGroup, db.ResourceTicketComment,
+	}, db.Resources())
+
+	err := db.RegisterResource(db.Resource{Type: db.ResourceGroup, Key: db.KeyInt, New: func() db.Data { return &db.Group{} }})
+	assert.ErrorIs(t, err, db.ErrResourceExists)
+
+	err = db.RegisterResource(db.Resource{
+		Type: "macro", Key: db.KeyInt, New: func() db.Data { return &db.Group{} },
+		Relations: []db.Relation{{Field: "garbage", Target: db.ResourceUser}},
+	})
+	assert.ErrorIs(t, err, db.ErrFieldMissing, "relations must be on a field of the resource")
+	_, err = db.LookupResource("macro")
+	assert.ErrorIs(t, err, db.ErrInvalidResouce)
+
+	resource, err := db.LookupResource(db.ResourceTicketComment)
+	assert.NoError(t, err)
+	assert.Equal(t, db.KeyInt, resource.Key)
+	assert.Equal(t, 2, len(resource.Relations))
+}
+
+func TestGroupsAndComments(t *testing.T) {
+	database := createGroupsDB(t)
+
+	record, err := database.GetRecord(db.ResourceGroup, "1")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "Support", record.(*db.Group).Name)
+		assert.True(t, record.(*db.Group).Default)
+	}
+	_, err = database.GetRecord(db.ResourceGroup, "3")
+	assert.ErrorIs(t, err, db.ErrNotFound)
+	_, err = database.GetRecord(db.ResourceGroup, "garbage")
+	assert.Error(t, err)
+
+	// Relations resolve both ways
+	usr, _ := database.GetUser(1)
+	assert.Equal(t, []string{"group 1", "group 2", "ticket_comment 10", "ticket_comment 12"}, relatedKeys(database.Linked(usr)))
+	group, _ := database.GetRecord(db.ResourceGroup, "2")
+	assert.ElementsMatch(t, []string{"user 1", "user 2"}, relatedKeys(group.GetRelated(database)))
+	comment, _ := database.GetRecord(db.ResourceTicketComment, "10")
+	assert.Equal(t, []string{"ticket a", "user 1"}, relatedKeys(comment.GetRelated(database)))
+	ticket, _ := database.GetTicket("a")
+	assert.Contains(t, relatedKeys(ticket.GetRelated(database)), "ticket_comment 11")
+
+	// Links follow changes
+	assert.NoError(t, database.UpdateUser(db.User{ID: 2, GroupMemberships: []int64{1}}))
+	assert.Equal(t, []string{"user 1"}, relatedKeys(group.GetRelated(database)))
+	assert.NoError(t, database.DeleteRecord(db.ResourceTicketComment, "10"))
+	assert.Equal(t, []string{"group 1", "group 2", "ticket_comment 12"}, relatedKeys(database.Linked(usr)))
+
+	// Queries
+	query := db.Query{Conditions: []db.Condition{
+		&db.FulLMatchCondition{Resource: db.ResourceTicketComment, Connector: db.ConnectorTypeUnion, Field: "ticket_id", Match: "a"},
+	}}
+	result, err := query.Resolve(database)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"ticket_comment 11"}, relatedKeys(result.Target))
+	}
+	query = db.Query{Conditions: []db.Condition{&db.IDMatchCondition{Resource: db.ResourceUser, Target: "1"}}}
+	result, err = query.Resolve(database)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"group 1", "group 2"}, relatedKeys(result.Related.Others[db.ResourceGroup]))
+	}
+
+	// The comment on a missing ticket dangles
+	report := database.Validate()
+	assert.Equal(t, []db.DanglingReference{
+		{Resource: db.ResourceTicketComment, Key: "12", Field: "ticket_id", TargetKey: "gone"},
+	}, report.Dangling)
+
+	// Snapshots keep the records and links
+	var buf bytes.Buffer
+	assert.NoError(t, database.Save(&buf))
+	loaded, err := db.Load(&buf)
+	if assert.NoError(t, err) {
+		usr, _ := loaded.GetUser(1)
+		assert.Equal(t, []string{"group 1", "group 2", "ticket_comment 12"}, relatedKeys(loaded.Linked(usr)))
+		group, _ := loaded.GetRecord(db.ResourceGroup, "1")
+		assert.ElementsMatch(t, []string{"user 1", "user 2"}, relatedKeys(group.GetRelated(loaded)))
+		report, err := db.Diff(database, loaded)
+		assert.NoError(t, err)
+		assert.True(t, report.Empty())
+	}
+}
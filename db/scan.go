@@ -0,0 +1,113 @@
+package db
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// Below this many records per worker it's cheaper to scan on a single goroutine
+const minScanChunk = 1024
+
+type matcher interface {
+	Data
+	Match(field, value string) (bool, error)
+}
+
+// scanWorkers returns how many goroutines should be used to scan count records.
+// workers <= 0 means use GOMAXPROCS.
+func scanWorkers(workers, count int) int {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if maxWorkers := count / minScanChunk; workers > maxWorkers {
+		workers = maxWorkers
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	return workers
+}
+
+func scanChunk(records []Data, match func(record Data) bool) []Data {
+	var result []Data
+
+	for _, val := range records {
+		if match(val) {
+			result = append(result, val)
+		}
+	}
+
+	return result
+}
+
+// scan returns every record which matches. The records are split into
+// contiguous partitions which are scanned concurrently. The results are
+// sorted by key so the output doesn't depend on the partitioning or the map
+// iteration order the records came from.
+func scan(records []Data, match func(record Data) bool, workers int) []Data {
+	workers = scanWorkers(workers, len(records))
+
+	var result []Data
+	if workers == 1 {
+		result = scanChunk(records, match)
+	} else {
+		results := make([][]Data, workers)
+		chunkSize := (len(records) + workers - 1) / workers
+
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			start := i * chunkSize
+			end := start + chunkSize
+			if end > len(records) {
+				end = len(records)
+			}
+
+			wg.Add(1)
+			go func(i int, chunk []Data) {
+				defer wg.Done()
+				results[i] = scanChunk(chunk, match)
+			}(i, records[start:end])
+		}
+		wg.Wait()
+
+		for i := range results {
+			result = append(result, results[i]...)
+		}
+	}
+
+	sortData(result)
+	return result
+}
+
+func isDigits(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// keyLess orders keys so that numeric keys sort numerically and everything
+// else sorts lexically.
+func keyLess(a, b string) bool {
+	if len(a) != len(b) && isDigits(a) && isDigits(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// sortData sorts by resource type then key
+func sortData(ary []Data) {
+	sort.SliceStable(ary, func(i, j int) bool {
+		if ary[i].GetResourceType() != ary[j].GetResourceType() {
+			return ary[i].GetResourceType() < ary[j].GetResourceType()
+		}
+		return keyLess(ary[i].GetKey(), ary[j].GetKey())
+	})
+}
@@ -0,0 +1,139 @@
+package db_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/sardap/zendesk/db"
+	"github.com/stretchr/testify/assert"
+)
+
+const syntheticTicketCount = 300000
+
+var (
+	syntheticOnce sync.Once
+	syntheticDB   *db.DB
+)
+
+func createSyntheticDB() *db.DB {
+	syntheticOnce.Do(func() {
+		syntheticDB = createBlankDb()
+		statuses := []string{"open", "pending", "hold", "solved", "closed"}
+		for i := 0; i < syntheticTicketCount; i++ {
+			syntheticDB.AddTicket(db.Ticket{
+				ID:             fmt.Sprintf("ticket-%07d", i),
+				Subject:        fmt.Sprintf("subject %d", i%1000),
+				Status:         statuses[i%len(statuses)],
+				SubmitterID:    int64(i % 75),
+				AssigneeID:     int64(i % 75),
+				OrganizationID: int64(100 + i%25),
+				Tags:           []string{"Ohio", fmt.Sprintf("tag-%d", i%50)},
+			})
+		}
+	})
+
+	return syntheticDB
+}
+
+func TestParallelScan(t *testing.T) {
+	if testing.Short() {
+		t.Skip("synthetic dataset is slow to build")
+	}
+
+	database := createSyntheticDB()
+
+	testCases := []struct {
+		field string
+		match string
+		count int
+	}{
+		{field: "status", match: "pending", count: syntheticTicketCount / 5},
+		{field: "subject", match: "subject 7", count: syntheticTicketCount / 1000},
+		{field: "tags", match: "tag-49", count: syntheticTicketCount / 50},
+		{field: "via", match: "garbage", count: 0},
+	}
+
+	for _, testCase := range testCases {
+		serial := db.FulLMatchCondition{
+			Resource: db.ResourceTicket,
+			Field:    testCase.field,
+			Match:    testCase.match,
+			Workers:  1,
+		}
+		serialMatches, err := serial.Resolve(database)
+		assert.NoErrorf(t, err, "serial scan failed field %s", testCase.field)
+		assert.Equalf(t, testCase.count, len(serialMatches), "serial scan count field %s", testCase.field)
+
+		for _, workers := range []int{0, 2, 7} {
+			parallel := serial
+			parallel.Workers = workers
+			parallelMatches, err := parallel.Resolve(database)
+			assert.NoErrorf(t, err, "parallel scan failed field %s workers %d", testCase.field, workers)
+			assert.Equalf(t, serialMatches, parallelMatches,
+				"parallel scan should match serial scan field %s workers %d", testCase.field, workers,
+			)
+		}
+	}
+
+	// Unknown fields fail before any workers start
+	invalid := db.FulLMatchCondition{
+		Resource: db.ResourceTicket,
+		Field:    "garbage",
+		Match:    "garbage",
+		Workers:  4,
+	}
+	_, err := invalid.Resolve(database)
+	assert.ErrorIs(t, err, db.ErrFieldMissing)
+}
+
+func TestScanOrder(t *testing.T) {
+	database := createLoadedDB()
+
+	cond := db.FulLMatchCondition{
+		Resource: db.ResourceOrganization,
+		Field:    "details",
+		Match:    "MegaCorp",
+	}
+	matches, err := cond.Resolve(database)
+	assert.NoError(t, err)
+
+	var keys []string
+	for _, match := range matches {
+		keys = append(keys, match.GetKey())
+	}
+	assert.Equal(t, []string{"101", "105", "109", "112", "118", "120", "121", "123", "125"}, keys)
+}
+
+func benchmarkScan(b *testing.B, workers int) {
+	database := createSyntheticDB()
+	cond := db.FulLMatchCondition{
+		Resource: db.ResourceTicket,
+		Field:    "tags",
+		Match:    "tag-7",
+		Workers:  workers,
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := cond.Resolve(database); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkScanSerial(b *testing.B) {
+	benchmarkScan(b, 1)
+}
+
+func BenchmarkScanParallel(b *testing.B) {
+	benchmarkScan(b, 0)
+}
+
+func BenchmarkScanParallel2(b *testing.B) {
+	benchmarkScan(b, 2)
+}
+
+func BenchmarkScanParallel4(b *testing.B) {
+	benchmarkScan(b, 4)
+}
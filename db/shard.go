@@ -0,0 +1,768 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrNoShards error
+)
+
+func init() {
+	ErrNoShards = fmt.Errorf("a sharded DB needs at least one shard")
+}
+
+// Database is what a DB and a ShardedDB have in common so callers don't have
+// to care which they were given: queries, reading and writing records,
+// importing and reporting. Transactions (Begin), Subscribe, snapshots (Save),
+// History and AsOf, Diff and the WAL are only on a DB
+type Database interface {
+	Resolve(q *Query) (*QueryResult, error)
+	GetRecord(resource ResourceType, key string) (Data, error)
+	GetOrganization(id int64) (*Organization, error)
+	GetUser(id int64) (*User, error)
+	GetTicket(id string) (*Ticket, error)
+	AddRecord(toAdd Data) error
+	UpdateRecord(toUpdate Data) error
+	DeleteRecord(resource ResourceType, key string) error
+	AddOrganization(toAdd Organization) error
+	AddUser(toAdd User) error
+	AddTicket(toAdd Ticket) error
+	UpdateOrganization(toUpdate Organization) error
+	UpdateUser(toUpdate User) error
+	UpdateTicket(toUpdate Ticket) error
+	DeleteOrganization(id int64) error
+	DeleteUser(id int64) error
+	DeleteTicket(id string) error
+	Import(resource ResourceType, r io.Reader, opts LoadOptions) error
+	ImportCSV(resource ResourceType, r io.Reader, opts CSVOptions) error
+	Sources() []Source
+	Stats() *Stats
+	Validate() *ValidationReport
+}
+
+var (
+	_ Database = (*DB)(nil)
+	_ Database = (*ShardedDB)(nil)
+)
+
+// Resolve is Query.Resolve so a DB is a Database
+func (d *DB) Resolve(q *Query) (*QueryResult, error) {
+	return q.Resolve(d)
+}
+
+// Partitioner picks which of count shards a ticket goes in
+type Partitioner func(ticket *Ticket, count int) int
+
+// PartitionByOrganization keeps each organization's tickets in one shard
+func PartitionByOrganization(ticket *Ticket, count int) int {
+	return int(uint64(ticket.OrganizationID) % uint64(count))
+}
+
+// PartitionByTicketHash spreads tickets evenly by a hash of their ID
+func PartitionByTicketHash(ticket *Ticket, count int) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(ticket.ID))
+	return int(hash.Sum32() % uint32(count))
+}
+
+// ShardedDB splits the tickets of an account too big for one DB across
+// several. Records which belong to a ticket through a relation, like ticket
+// comments, go in their ticket's shard and every other record is copied to
+// each shard, so whatever a ticket refers to is always in its shard. Queries
+// are fanned out to every shard at once and give the same result a single DB
+// holding everything would.
+//
+// Tickets have to be added before the records which belong to them, which
+// loading does since resources are loaded in the order they were
+// registered. The shards must only be changed through the ShardedDB, and a
+// change which fails part way can be left on some shards.
+type ShardedDB struct {
+	// held for writing by changes and for reading by everything else so a
+	// query sees every shard at the same point
+	mu        sync.RWMutex
+	shards    []*DB
+	partition Partitioner
+	// homes is the shard each ticket is in
+	homes   map[string]int
+	sources []Source
+}
+
+// NewSharded creates count empty shards. partition defaults to
+// PartitionByTicketHash
+func NewSharded(count int, partition Partitioner) (*ShardedDB, error) {
+	if count < 1 {
+		return nil, errors.Wrapf(ErrNoShards, "%d given", count)
+	}
+	if partition == nil {
+		partition = PartitionByTicketHash
+	}
+
+	result := &ShardedDB{partition: partition, homes: make(map[string]int)}
+	for i := 0; i < count; i++ {
+		result.shards = append(result.shards, New())
+	}
+
+	return result, nil
+}
+
+// CreateSharded is CreateResources loading into count shards
+func CreateSharded(readers map[ResourceType]io.Reader, count int, partition Partitioner, opts LoadOptions) (*ShardedDB, error) {
+	result, err := NewSharded(count, partition)
+	if err != nil {
+		return nil, err
+	}
+	if err := importResources(result, readers, opts); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// Shards are the DBs the records are split across
+func (s *ShardedDB) Shards() []*DB {
+	return append([]*DB(nil), s.shards...)
+}
+
+// ticketRelation is the relation records of the resource follow to the
+// ticket they belong to
+func ticketRelation(resource ResourceType) (Relation, bool) {
+	registered, ok := resourceRegistry[resource]
+	if !ok {
+		return Relation{}, false
+	}
+	for _, relation := range registered.Relations {
+		if relation.Target == ResourceTicket {
+			return relation, true
+		}
+	}
+
+	return Relation{}, false
+}
+
+// sharded is true if the resource's records are split across the shards
+// rather than copied to each
+func sharded(resource ResourceType) bool {
+	_, ok := ticketRelation(resource)
+	return resource == ResourceTicket || ok
+}
+
+// home is the shard a sharded record belongs in. Records belonging to a
+// ticket which hasn't been added go where a ticket with its ID would. s.mu
+// must be held
+func (s *ShardedDB) home(record Data) int {
+	if ticket, ok := record.(*Ticket); ok {
+		return s.partition(ticket, len(s.shards))
+	}
+
+	relation, _ := ticketRelation(record.GetResourceType())
+	keys := relationKeys(record, relation)
+	if len(keys) == 0 {
+		return 0
+	}
+	if home, ok := s.homes[keys[0]]; ok {
+		return home
+	}
+	return s.partition(&Ticket{ID: keys[0]}, len(s.shards))
+}
+
+// getFrom is DB.get taking the read lock
+func getFrom(shard *DB, resource ResourceType, key string) Data {
+	shard.rlock()
+	defer shard.runlock()
+
+	return shard.get(resource, key)
+}
+
+// locate finds the shard holding the sharded record with the key. s.mu must
+// be held
+func (s *ShardedDB) locate(resource ResourceType, key string) (int, bool) {
+	if resource == ResourceTicket {
+		home, ok := s.homes[key]
+		return home, ok
+	}
+
+	for i, shard := range s.shards {
+		if getFrom(shard, resource, key) != nil {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// belonging lists the sharded records in the shard which belong to the
+// ticket
+func belonging(shard *DB, ticketKey string) []Data {
+	shard.rlock()
+	defer shard.runlock()
+
+	var result []Data
+	for _, ref := range shard.refs[ResourceTicket][ticketKey] {
+		if !sharded(ref.Resource) {
+			continue
+		}
+		if record := shard.get(ref.Resource, ref.Key); record != nil {
+			result = append(result, record)
+		}
+	}
+
+	return result
+}
+
+// evict deletes a sharded record from a shard before it's put in another.
+// Records belonging to a ticket are moved along with it. s.mu must be held
+func (s *ShardedDB) evict(resource ResourceType, key string, from, to int) error {
+	var moving []Data
+	if resource == ResourceTicket {
+		moving = belonging(s.shards[from], key)
+	}
+
+	if err := s.shards[from].delete(resource, key); err != nil {
+		return err
+	}
+	for _, record := range moving {
+		if err := s.shards[from].delete(record.GetResourceType(), record.GetKey()); err != nil {
+			return err
+		}
+		if _, err := s.shards[to].add(record, nil, DuplicateKeepLast, time.Now(), false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func noteMoved(shard *DB, resource ResourceType, key string) error {
+	return shard.write(func() ([]ChangeEvent, error) {
+		shard.noteDuplicate(resource, key)
+		return nil, nil
+	})
+}
+
+// add is DB.add on the record's shard, or on every shard if it isn't sharded
+func (s *ShardedDB) add(toAdd Data, raw json.RawMessage, policy DuplicatePolicy, at time.Time, dated bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resource, key := toAdd.GetResourceType(), toAdd.GetKey()
+	if !sharded(resource) {
+		exists := false
+		for i, shard := range s.shards {
+			shardExists, err := shard.add(toAdd, raw, policy, at, dated)
+			if err != nil {
+				return exists, err
+			}
+			if i == 0 {
+				exists = shardExists
+			}
+		}
+		return exists, nil
+	}
+
+	home := s.home(toAdd)
+	current, exists := s.locate(resource, key)
+	if exists && current != home {
+		// The record has moved shards, like a ticket which changed
+		// organization, so the shard can't settle the duplicate itself
+		existing := getFrom(s.shards[current], resource, key)
+		keep, err := resolveDuplicate(policy, existing, toAdd, raw)
+		if err != nil || !keep {
+			if err == nil {
+				err = noteMoved(s.shards[current], resource, key)
+			}
+			return true, err
+		}
+		if err := s.evict(resource, key, current, home); err != nil {
+			return true, err
+		}
+		policy = DuplicateKeepLast
+	}
+
+	if _, err := s.shards[home].add(toAdd, raw, policy, at, dated); err != nil {
+		return exists, err
+	}
+	if resource == ResourceTicket {
+		s.homes[key] = home
+	}
+	if exists && current != home {
+		return true, noteMoved(s.shards[home], resource, key)
+	}
+
+	return exists, nil
+}
+
+func (s *ShardedDB) update(toUpdate Data) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resource, key := toUpdate.GetResourceType(), toUpdate.GetKey()
+	if !sharded(resource) {
+		for _, shard := range s.shards {
+			if err := shard.update(toUpdate); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	current, ok := s.locate(resource, key)
+	if !ok {
+		return errors.Wrapf(ErrNotFound, "%s", key)
+	}
+	home := s.home(toUpdate)
+	if home == current {
+		return s.shards[home].update(toUpdate)
+	}
+
+	if err := s.evict(resource, key, current, home); err != nil {
+		return err
+	}
+	if _, err := s.shards[home].add(toUpdate, nil, DuplicateKeepLast, time.Now(), false); err != nil {
+		return err
+	}
+	if resource == ResourceTicket {
+		s.homes[key] = home
+	}
+
+	return nil
+}
+
+func (s *ShardedDB) delete(resource ResourceType, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !sharded(resource) {
+		for _, shard := range s.shards {
+			if err := shard.delete(resource, key); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	current, ok := s.locate(resource, key)
+	if !ok {
+		return errors.Wrapf(ErrNotFound, "%s", key)
+	}
+	if err := s.shards[current].delete(resource, key); err != nil {
+		return err
+	}
+	if resource == ResourceTicket {
+		delete(s.homes, key)
+	}
+
+	return nil
+}
+
+// AddOrganization replaces any organization with the same ID
+func (s *ShardedDB) AddOrganization(toAdd Organization) error {
+	_, err := s.add(&toAdd, nil, DuplicateKeepLast, time.Now(), false)
+	return err
+}
+
+// AddUser replaces any user with the same ID
+func (s *ShardedDB) AddUser(toAdd User) error {
+	_, err := s.add(&toAdd, nil, DuplicateKeepLast, time.Now(), false)
+	return err
+}
+
+// AddTicket replaces any ticket with the same ID. The ticket moves shards if
+// its partition has changed
+func (s *ShardedDB) AddTicket(toAdd Ticket) error {
+	_, err := s.add(&toAdd, nil, DuplicateKeepLast, time.Now(), false)
+	return err
+}
+
+// UpdateOrganization replaces an existing organization
+func (s *ShardedDB) UpdateOrganization(toUpdate Organization) error {
+	return s.update(&toUpdate)
+}
+
+// UpdateUser replaces an existing user
+func (s *ShardedDB) UpdateUser(toUpdate User) error {
+	return s.update(&toUpdate)
+}
+
+// UpdateTicket replaces an existing ticket. The ticket and the records
+// belonging to it move shards if its partition has changed
+func (s *ShardedDB) UpdateTicket(toUpdate Ticket) error {
+	return s.update(&toUpdate)
+}
+
+func (s *ShardedDB) DeleteOrganization(id int64) error {
+	return s.delete(ResourceOrganization, strconv.FormatInt(id, 10))
+}
+
+func (s *ShardedDB) DeleteUser(id int64) error {
+	return s.delete(ResourceUser, strconv.FormatInt(id, 10))
+}
+
+func (s *ShardedDB) DeleteTicket(id string) error {
+	return s.delete(ResourceTicket, id)
+}
+
+// AddRecord replaces any record of a registered resource with the same key
+func (s *ShardedDB) AddRecord(toAdd Data) error {
+	if _, err := LookupResource(toAdd.GetResourceType()); err != nil {
+		return err
+	}
+
+	_, err := s.add(toAdd, nil, DuplicateKeepLast, time.Now(), false)
+	return err
+}
+
+// UpdateRecord replaces an existing record of a registered resource
+func (s *ShardedDB) UpdateRecord(toUpdate Data) error {
+	if _, err := LookupResource(toUpdate.GetResourceType()); err != nil {
+		return err
+	}
+
+	return s.update(toUpdate)
+}
+
+// DeleteRecord removes a record of a registered resource
+func (s *ShardedDB) DeleteRecord(resource ResourceType, key string) error {
+	key, err := recordKey(resource, key)
+	if err != nil {
+		return err
+	}
+
+	return s.delete(resource, key)
+}
+
+// Import streams records into their shards like DB.Import
+func (s *ShardedDB) Import(resource ResourceType, r io.Reader, opts LoadOptions) error {
+	source, err := importRecords(resource, r, opts, s.add)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sources = append(s.sources, source)
+
+	return nil
+}
+
+// ImportCSV is DB.ImportCSV into the shards
+func (s *ShardedDB) ImportCSV(resource ResourceType, r io.Reader, opts CSVOptions) error {
+	return s.Import(resource, r, LoadOptions{Format: FormatCSV, CSV: opts})
+}
+
+// Sources lists every input imported in the order they were imported
+func (s *ShardedDB) Sources() []Source {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]Source(nil), s.sources...)
+}
+
+// shardedView looks records up across shards. The shards are usually read
+// views taken for a query
+type shardedView struct {
+	shards []*DB
+	homes  map[string]int
+}
+
+func (v shardedView) get(resource ResourceType, key string) Data {
+	if !sharded(resource) {
+		return getFrom(v.shards[0], resource, key)
+	}
+
+	if home, ok := v.homes[key]; ok && resource == ResourceTicket {
+		if record := getFrom(v.shards[home], resource, key); record != nil {
+			return record
+		}
+	}
+	// A past state from AsOf can have the ticket in the shard it was in
+	for _, shard := range v.shards {
+		if record := getFrom(shard, resource, key); record != nil {
+			return record
+		}
+	}
+
+	return nil
+}
+
+// GetRecord lets paths follow relations to records in other shards
+func (v shardedView) GetRecord(resource ResourceType, key string) (Data, error) {
+	key, err := recordKey(resource, key)
+	if err != nil {
+		return nil, err
+	}
+
+	result := v.get(resource, key)
+	if result == nil {
+		return nil, errors.Wrapf(ErrNotFound, "%s", key)
+	}
+
+	return result, nil
+}
+
+// GetRecord gets a record of any registered resource from whichever shard
+// has it
+func (s *ShardedDB) GetRecord(resource ResourceType, key string) (Data, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return shardedView{s.shards, s.homes}.GetRecord(resource, key)
+}
+
+func (s *ShardedDB) GetOrganization(id int64) (*Organization, error) {
+	result, err := s.GetRecord(ResourceOrganization, strconv.FormatInt(id, 10))
+	if err != nil {
+		return nil, err
+	}
+	return result.(*Organization), nil
+}
+
+func (s *ShardedDB) GetUser(id int64) (*User, error) {
+	result, err := s.GetRecord(ResourceUser, strconv.FormatInt(id, 10))
+	if err != nil {
+		return nil, err
+	}
+	return result.(*User), nil
+}
+
+func (s *ShardedDB) GetTicket(id string) (*Ticket, error) {
+	result, err := s.GetRecord(ResourceTicket, id)
+	if err != nil {
+		return nil, err
+	}
+	return result.(*Ticket), nil
+}
+
+// fanOut calls fn for every shard at once and waits for them all
+func fanOut(shards []*DB, fn func(i int, shard *DB) error) []error {
+	errs := make([]error, len(shards))
+	var wg sync.WaitGroup
+	for i, shard := range shards {
+		wg.Add(1)
+		go func(i int, shard *DB) {
+			defer wg.Done()
+			errs[i] = fn(i, shard)
+		}(i, shard)
+	}
+	wg.Wait()
+
+	return errs
+}
+
+// readAll calls fn with a read view of every shard, none of which change
+// until fn returns
+func readAll(shards []*DB, views []*DB, fn func(views []*DB) error) error {
+	if len(views) == len(shards) {
+		return fn(views)
+	}
+
+	return shards[len(views)].read(func(view *DB) error {
+		return readAll(shards, append(views, view), fn)
+	})
+}
+
+// everyShard is true if the condition has to run on every shard. Conditions
+// on records copied to every shard only need one, unless they follow a path
+// to sharded records. Conditions it doesn't know run everywhere
+func everyShard(con Condition) bool {
+	if sharded(con.GetResource()) {
+		return true
+	}
+
+	switch val := con.(type) {
+	case *IDMatchCondition:
+		return false
+	case *FulLMatchCondition:
+		path, err := LookupPath(val.Resource, val.Field)
+		if err != nil {
+			// the shard reports it
+			return false
+		}
+		for _, relation := range path.relations {
+			if sharded(relation.Target) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+// resolve runs the condition on the shards it needs at once and merges the
+// matches. A record missing from some shards is only ErrNotFound if it's in
+// none of them
+func (v shardedView) resolve(con Condition) ([]Data, error) {
+	shards := v.shards
+	if !everyShard(con) {
+		shards = shards[:1]
+	}
+
+	matches := make([][]Data, len(shards))
+	errs := fanOut(shards, func(i int, shard *DB) error {
+		var err error
+		matches[i], err = con.Resolve(shard)
+		return err
+	})
+
+	var result []Data
+	var notFound error
+	seen := make(map[recordRef]bool)
+	for i, err := range errs {
+		if errors.Is(err, ErrNotFound) {
+			notFound = err
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, match := range matches[i] {
+			if ref := refOf(match); !seen[ref] {
+				seen[ref] = true
+				result = append(result, match)
+			}
+		}
+	}
+	if len(result) == 0 && notFound != nil {
+		return nil, notFound
+	}
+
+	return result, nil
+}
+
+// related gets the related records of the targets from every shard at once
+// since a user's tickets, for one, can be in any of them
+func (v shardedView) related(targets []Data) [][]Data {
+	related := make([][]Data, len(v.shards))
+	fanOut(v.shards, func(i int, shard *DB) error {
+		for _, target := range targets {
+			related[i] = append(related[i], target.GetRelated(shard)...)
+		}
+		return nil
+	})
+
+	return related
+}
+
+func (q *Query) resolveShards(view shardedView) (*QueryResult, error) {
+	matches := make(map[recordRef]Data)
+	for i, con := range q.Conditions {
+		condMatches, err := view.resolve(con)
+		if err != nil {
+			return nil, err
+		}
+		if matches, err = connect(con, i == 0, matches, condMatches); err != nil {
+			return nil, err
+		}
+	}
+
+	var result QueryResult
+	for _, val := range matches {
+		result.Target = append(result.Target, val)
+	}
+	seen := make(map[recordRef]bool)
+	for _, shardRelated := range view.related(result.Target) {
+		for _, related := range shardRelated {
+			result.addRelated(related, seen)
+		}
+	}
+
+	if err := result.finish(view, q); err != nil {
+		return nil, err
+	}
+
+	return &result, nil
+}
+
+// Resolve fans the query out to every shard and merges the matches, related
+// records and sort order as if the shards were one DB. Paths like
+// ticket.subject on a comment are followed into whichever shard holds the
+// record
+func (s *ShardedDB) Resolve(q *Query) (*QueryResult, error) {
+	start := time.Now()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	shards := s.shards
+	if !q.AsOf.IsZero() {
+		shards = make([]*DB, len(s.shards))
+		for i, shard := range s.shards {
+			shards[i] = shard.AsOf(q.AsOf)
+		}
+	}
+
+	var result *QueryResult
+	err := readAll(shards, nil, func(views []*DB) error {
+		var err error
+		result, err = q.resolveShards(shardedView{views, s.homes})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.Meta = &ResultMeta{
+		Query:    q.Echo(),
+		Total:    len(result.Target),
+		Elapsed:  time.Since(start).String(),
+		Datasets: append([]Source{}, s.sources...),
+	}
+
+	return result, nil
+}
+
+// validate merges the reports of every shard. Problems with records copied
+// to every shard are only reported once. s.mu must be held
+func (s *ShardedDB) validate() *ValidationReport {
+	result := &ValidationReport{}
+	for i, shard := range s.shards {
+		report := shard.Validate()
+		for _, dangling := range report.Dangling {
+			if i == 0 || sharded(dangling.Resource) {
+				result.Dangling = append(result.Dangling, dangling)
+			}
+		}
+		for _, dup := range report.Duplicates {
+			if i == 0 || sharded(dup.Resource) {
+				result.Duplicates = append(result.Duplicates, dup)
+			}
+		}
+	}
+	result.sort()
+
+	return result
+}
+
+// Validate is DB.Validate across every shard
+func (s *ShardedDB) Validate() *ValidationReport {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.validate()
+}
+
+// Stats is DB.Stats across every shard, counting records copied to every
+// shard once
+func (s *ShardedDB) Stats() *Stats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	counts := make(map[ResourceType]int)
+	for i, shard := range s.shards {
+		shard.rlock()
+		for _, resource := range resourceOrder {
+			if i == 0 || sharded(resource) {
+				counts[resource] += len(shard.records(resource))
+			}
+		}
+		shard.runlock()
+	}
+
+	return newStats(counts, s.validate(), s.sources)
+}
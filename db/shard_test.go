@@ -0,0 +1,189 @@
+package db_test
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/sardap/zendesk/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func createSharded(t *testing.T, partition db.Partitioner) *db.ShardedDB {
+	orgs, users, tickets := getFiles()
+	defer orgs.Close()
+	defer users.Close()
+	defer tickets.Close()
+
+	result, err := db.CreateSharded(map[db.ResourceType]io.Reader{
+		db.ResourceOrganization: orgs,
+		db.ResourceUser:         users,
+		db.ResourceTicket:       tickets,
+	}, 3, partition, db.LoadOptions{})
+	assert.NoError(t, err)
+
+	return result
+}
+
+func addComments(t *testing.T, database db.Database) {
+	comments := []db.TicketComment{
+		{ID: 1, TicketID: "436bf9b0-1147-4c0a-8439-6f79833bff5b", AuthorID: 38, Body: "On it"},
+		{ID: 2, TicketID: "1a227508-9f39-427c-8f57-1b72f3fab87c", AuthorID: 38, Body: "Done"},
+		{ID: 3, TicketID: "2217c7dc-7371-4401-8738-0a8a8aedc08d", AuthorID: 71, Body: "Waiting"},
+	}
+	for i := range comments {
+		assert.NoError(t, database.AddRecord(&comments[i]))
+	}
+}
+
+// resultJson is the result without the meta, which has the time taken
+func resultJson(t *testing.T, result *db.QueryResult) string {
+	result.Meta = nil
+	resultBytes, err := json.Marshal(result)
+	assert.NoError(t, err)
+	return string(resultBytes)
+}
+
+func TestShardedQuery(t *testing.T) {
+	single := createLoadedDB()
+	addComments(t, single)
+
+	queries := []db.Query{
+		{Conditions: []db.Condition{&db.FulLMatchCondition{
+			Resource: db.ResourceUser, Connector: db.ConnectorTypeUnion, Field: "name", Match: "Francisca Rasmussen",
+		}}},
+		{Conditions: []db.Condition{&db.IDMatchCondition{Resource: db.ResourceOrganization, Target: "101"}}},
+		{
+			Conditions: []db.Condition{&db.FulLMatchCondition{
+				Resource: db.ResourceTicket, Connector: db.ConnectorTypeUnion, Field: "status", Match: "pending",
+			}},
+			SortBy: []string{"assignee.name", "-created_at"},
+			Fields: []string{"_id", "assignee.name", "organization.name"},
+		},
+		{Conditions: []db.Condition{
+			&db.FulLMatchCondition{Resource: db.ResourceTicket, Connector: db.ConnectorTypeIntersection, Field: "organization.name", Match: "Enthaze"},
+			&db.FulLMatchCondition{Resource: db.ResourceTicket, Connector: db.ConnectorTypeIntersection, Field: "type", Match: "incident"},
+		}},
+		{
+			Conditions: []db.Condition{&db.FulLMatchCondition{
+				Resource: db.ResourceTicketComment, Connector: db.ConnectorTypeUnion, Field: "author.name", Match: "Elma Castro",
+			}},
+			Fields: []string{"_id", "ticket.subject"},
+		},
+	}
+
+	for _, partition := range []db.Partitioner{db.PartitionByOrganization, db.PartitionByTicketHash} {
+		sharded := createSharded(t, partition)
+		addComments(t, sharded)
+
+		for _, shard := range sharded.Shards() {
+			stats := shard.Stats()
+			assert.Equal(t, 75, stats.Resources[1].Records, "users are in every shard")
+			assert.NotZero(t, stats.Resources[2].Records, "tickets are spread across the shards")
+			assert.Less(t, stats.Resources[2].Records, 200)
+		}
+		assert.Equal(t, single.Stats(), sharded.Stats())
+		assert.Equal(t, single.Validate(), sharded.Validate())
+
+		for _, query := range queries {
+			expected, err := query.Resolve(single)
+			if !assert.NoError(t, err) {
+				continue
+			}
+			result, err := sharded.Resolve(&query)
+			if !assert.NoError(t, err) {
+				continue
+			}
+			assert.NotEmpty(t, result.Target)
+			assert.Equal(t, len(result.Target), result.Meta.Total)
+			assert.Equal(t, resultJson(t, expected), resultJson(t, result), query.Echo())
+		}
+
+		_, err := sharded.Resolve(&db.Query{Conditions: []db.Condition{&db.IDMatchCondition{Resource: db.ResourceUser, Target: "9999"}}})
+		assert.ErrorIs(t, err, db.ErrNotFound)
+		ticket, err := sharded.GetTicket("436bf9b0-1147-4c0a-8439-6f79833bff5b")
+		if assert.NoError(t, err) {
+			assert.Equal(t, int64(116), ticket.OrganizationID)
+		}
+	}
+
+	_, err := db.NewSharded(0, nil)
+	assert.ErrorIs(t, err, db.ErrNoShards)
+}
+
+func TestShardedMove(t *testing.T) {
+	sharded, err := db.NewSharded(2, db.PartitionByOrganization)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, sharded.AddOrganization(db.Organization{ID: 1, Name: "Initech"}))
+	assert.NoError(t, sharded.AddOrganization(db.Organization{ID: 2, Name: "Hooli"}))
+	assert.NoError(t, sharded.AddUser(db.User{ID: 10, Name: "Peter Gibbons", OrganizationID: 1}))
+	assert.NoError(t, sharded.AddTicket(db.Ticket{ID: "a", Subject: "TPS reports", OrganizationID: 1, SubmitterID: 10}))
+	assert.NoError(t, sharded.AddRecord(&db.TicketComment{ID: 100, TicketID: "a", AuthorID: 10, Body: "Yeah"}))
+
+	shards := sharded.Shards()
+	_, err = shards[1].GetRecord(db.ResourceTicketComment, "100")
+	assert.NoError(t, err, "comments go in their ticket's shard")
+
+	assert.NoError(t, sharded.UpdateTicket(db.Ticket{ID: "a", Subject: "TPS reports", OrganizationID: 2, SubmitterID: 10}))
+	_, err = shards[1].GetTicket("a")
+	assert.ErrorIs(t, err, db.ErrNotFound, "the ticket moves when its organization changes")
+	_, err = shards[0].GetRecord(db.ResourceTicketComment, "100")
+	assert.NoError(t, err, "its comments move with it")
+
+	query := db.Query{Conditions: []db.Condition{&db.FulLMatchCondition{
+		Resource: db.ResourceTicketComment, Connector: db.ConnectorTypeUnion, Field: "ticket.organization.name", Match: "Hooli",
+	}}}
+	result, err := sharded.Resolve(&query)
+	if assert.NoError(t, err) && assert.Equal(t, 1, len(result.Target)) {
+		assert.Equal(t, "100", result.Target[0].GetKey())
+		assert.Equal(t, 1, len(result.Related.Tickets))
+		assert.Equal(t, 1, len(result.Related.Users))
+	}
+
+	assert.NoError(t, sharded.AddTicket(db.Ticket{ID: "a", Subject: "TPS reports", OrganizationID: 1, SubmitterID: 10}))
+	ticket, err := shards[1].GetTicket("a")
+	if assert.NoError(t, err, "adding over a ticket moves it too") {
+		assert.Equal(t, int64(1), ticket.OrganizationID)
+	}
+	assert.Equal(t, 1, len(sharded.Validate().Duplicates))
+
+	assert.NoError(t, sharded.DeleteTicket("a"))
+	_, err = sharded.GetTicket("a")
+	assert.ErrorIs(t, err, db.ErrNotFound)
+	assert.ErrorIs(t, sharded.DeleteTicket("a"), db.ErrNotFound)
+	assert.ErrorIs(t, sharded.UpdateTicket(db.Ticket{ID: "a"}), db.ErrNotFound)
+
+	assert.NoError(t, sharded.DeleteUser(10))
+	for _, shard := range shards {
+		_, err := shard.GetUser(10)
+		assert.ErrorIs(t, err, db.ErrNotFound, "users are deleted from every shard")
+	}
+}
+
+func TestCreateShardedStrict(t *testing.T) {
+	readers := func() map[db.ResourceType]io.Reader {
+		return map[db.ResourceType]io.Reader{
+			db.ResourceOrganization: strings.NewReader(`[{"_id": 1, "name": "Initech"}]`),
+			db.ResourceTicket:       strings.NewReader(`[{"_id": "a", "organization_id": 1, "submitter_id": 10}]`),
+		}
+	}
+
+	_, err := db.CreateSharded(readers(), 2, nil, db.LoadOptions{Strict: true})
+	assert.ErrorIs(t, err, db.ErrInvalidForeignKey, "submitter 10 isn't loaded")
+
+	sharded, err := db.CreateSharded(readers(), 2, nil, db.LoadOptions{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, sharded.ImportCSV(db.ResourceUser, strings.NewReader("_id,name\n10,Peter Gibbons\n"), db.CSVOptions{}))
+	assert.True(t, sharded.Validate().OK())
+	for _, shard := range sharded.Shards() {
+		user, err := shard.GetUser(10)
+		if assert.NoError(t, err, "users from a csv are copied to every shard") {
+			assert.Equal(t, "Peter Gibbons", user.Name)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrInvalidSnapshot error
+)
+
+func init() {
+	ErrInvalidSnapshot = fmt.Errorf("invalid snapshot")
+}
+
+// A snapshot starts with the magic "ZDSNAP", then the uint16 version and the
+// uint64 length of the payload. The payload is the gob encoded snapshot struct
+// followed by the uint32 CRC-32C of the payload. Integers are big endian.
+const SnapshotVersion uint16 = 1
+
+var (
+	snapshotMagic = []byte("ZDSNAP")
+	crcTable      = crc32.MakeTable(crc32.Castagnoli)
+)
+
+type snapshotHeader struct {
+	Version uint16
+	Length  uint64
+}
+
+// gob writes maps in iteration order so the back references are stored as
+// sorted slices to keep snapshots deterministic
+type userRefs struct {
+	Key  int64
+	Refs []int64
+}
+
+type ticketRefs struct {
+	Key  int64
+	Refs []string
+}
+
+type snapshot struct {
+	Orgs    []*Organization
+	Users   []*User
+	Tickets []*Ticket
+	// back references
+	OrgUsers   []userRefs
+	OrgTickets []ticketRefs
+	Assigned   []ticketRefs
+	Submitted  []ticketRefs
+	Duplicates []DuplicateKey
+	History    []recordHistory
+	// records of the other registered resources. Their back references are
+	// rebuilt on load
+	Others []snapshotRecord
+	// inputs the records were imported from
+	Sources []Source
+	// Seq of the last write ahead log entry applied
+	WALSeq uint64
+}
+
+type snapshotRecord struct {
+	Resource ResourceType
+	Record   []byte
+}
+
+// Versions hold any resource so the records are stored as json
+type snapshotVersion struct {
+	From   time.Time
+	Record []byte
+}
+
+type recordHistory struct {
+	Resource ResourceType
+	Key      string
+	Versions []snapshotVersion
+}
+
+func toHistory(history map[ResourceType]map[string][]Version) ([]recordHistory, error) {
+	var result []recordHistory
+	for resource, keys := range history {
+		for key, versions := range keys {
+			entry := recordHistory{Resource: resource, Key: key}
+			for _, version := range versions {
+				var record []byte
+				if version.Record != nil {
+					var err error
+					if record, err = json.Marshal(version.Record); err != nil {
+						return nil, err
+					}
+				}
+				entry.Versions = append(entry.Versions, snapshotVersion{version.From, record})
+			}
+			result = append(result, entry)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Resource != result[j].Resource {
+			return result[i].Resource < result[j].Resource
+		}
+		return result[i].Key < result[j].Key
+	})
+
+	return result, nil
+}
+
+func fromHistory(history []recordHistory) (map[ResourceType]map[string][]Version, error) {
+	result := make(map[ResourceType]map[string][]Version)
+	for _, entry := range history {
+		if result[entry.Resource] == nil {
+			result[entry.Resource] = make(map[string][]Version)
+		}
+		versions := make([]Version, len(entry.Versions))
+		for i, version := range entry.Versions {
+			versions[i].From = version.From
+			if version.Record == nil {
+				continue
+			}
+			record, err := decodeRecord(entry.Resource, version.Record)
+			if err != nil {
+				return nil, err
+			}
+			versions[i].Record = record
+		}
+		result[entry.Resource][entry.Key] = versions
+	}
+
+	return result, nil
+}
+
+func toUserRefs(refs map[int64][]int64) []userRefs {
+	result := make([]userRefs, 0, len(refs))
+	for key, ids := range refs {
+		if len(ids) > 0 {
+			result = append(result, userRefs{key, ids})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result
+}
+
+func fromUserRefs(refs []userRefs) map[int64][]int64 {
+	result := make(map[int64][]int64)
+	for _, ref := range refs {
+		result[ref.Key] = ref.Refs
+	}
+	return result
+}
+
+func toTicketRefs(refs map[int64][]string) []ticketRefs {
+	result := make([]ticketRefs, 0, len(refs))
+	for key, ids := range refs {
+		if len(ids) > 0 {
+			result = append(result, ticketRefs{key, ids})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result
+}
+
+func fromTicketRefs(refs []ticketRefs) map[int64][]string {
+	result := make(map[int64][]string)
+	for _, ref := range refs {
+		result[ref.Key] = ref.Refs
+	}
+	return result
+}
+
+// Save writes every record along with the foreign key back references so
+// Load doesn't have to resolve them again. Records are written in key order
+// so saving the same DB twice gives the same bytes.
+func (d *DB) Save(w io.Writer) error {
+	d.rlock()
+	defer d.runlock()
+
+	return d.save(w)
+}
+
+func (d *DB) save(w io.Writer) error {
+	snap := snapshot{
+		Orgs:       make([]*Organization, 0, len(d.orgs)),
+		Users:      make([]*User, 0, len(d.users)),
+		Tickets:    make([]*Ticket, 0, len(d.tickets)),
+		OrgUsers:   toUserRefs(d.orgUsers),
+		OrgTickets: toTicketRefs(d.orgTickets),
+		Assigned:   toTicketRefs(d.assigned),
+		Submitted:  toTicketRefs(d.submitted),
+		Duplicates: d.validate().Duplicates,
+		Sources:    d.sources,
+		WALSeq:     d.walSeq,
+	}
+	history, err := toHistory(d.history)
+	if err != nil {
+		return err
+	}
+	snap.History = history
+	for _, org := range d.orgs {
+		snap.Orgs = append(snap.Orgs, org)
+	}
+	for _, usr := range d.users {
+		snap.Users = append(snap.Users, usr)
+	}
+	for _, ticket := range d.tickets {
+		snap.Tickets = append(snap.Tickets, ticket)
+	}
+	sort.Slice(snap.Orgs, func(i, j int) bool { return snap.Orgs[i].ID < snap.Orgs[j].ID })
+	sort.Slice(snap.Users, func(i, j int) bool { return snap.Users[i].ID < snap.Users[j].ID })
+	sort.Slice(snap.Tickets, func(i, j int) bool { return snap.Tickets[i].ID < snap.Tickets[j].ID })
+	for _, resource := range resourceOrder {
+		switch resource {
+		case ResourceOrganization, ResourceUser, ResourceTicket:
+			continue
+		}
+		for _, record := range d.sortedRecords(resource) {
+			recordJson, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			snap.Others = append(snap.Others, snapshotRecord{resource, recordJson})
+		}
+	}
+
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(&snap); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(snapshotMagic); err != nil {
+		return err
+	}
+	header := snapshotHeader{Version: SnapshotVersion, Length: uint64(payload.Len())}
+	if err := binary.Write(w, binary.BigEndian, &header); err != nil {
+		return err
+	}
+	checksum := crc32.Checksum(payload.Bytes(), crcTable)
+	if _, err := payload.WriteTo(w); err != nil {
+		return err
+	}
+
+	return binary.Write(w, binary.BigEndian, checksum)
+}
+
+// LoadWithOptions is Load failing with ErrInvalidForeignKey if opts.Strict
+// is set and any foreign keys don't resolve. The other options don't apply
+// as a snapshot is already deduplicated and holds no skipped records
+func LoadWithOptions(r io.Reader, opts LoadOptions) (*DB, error) {
+	result, err := Load(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkStrict(result, opts); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// Load reads a DB written by Save
+func Load(r io.Reader) (*DB, error) {
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, errors.Wrap(ErrInvalidSnapshot, err.Error())
+	}
+	if !bytes.Equal(magic, snapshotMagic) {
+		return nil, errors.Wrap(ErrInvalidSnapshot, "not a snapshot")
+	}
+
+	var header snapshotHeader
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, errors.Wrap(ErrInvalidSnapshot, err.Error())
+	}
+	if header.Version != SnapshotVersion {
+		return nil, errors.Wrapf(ErrInvalidSnapshot,
+			"version %d can't be read, expected %d", header.Version, SnapshotVersion,
+		)
+	}
+
+	// The limit stops the gob decoder reading past the payload
+	crc := crc32.New(crcTable)
+	payload := io.TeeReader(io.LimitReader(r, int64(header.Length)), crc)
+
+	var snap snapshot
+	if err := gob.NewDecoder(payload).Decode(&snap); err != nil {
+		return nil, errors.Wrap(ErrInvalidSnapshot, err.Error())
+	}
+	if _, err := io.Copy(io.Discard, payload); err != nil {
+		return nil, errors.Wrap(ErrInvalidSnapshot, err.Error())
+	}
+
+	var checksum uint32
+	if err := binary.Read(r, binary.BigEndian, &checksum); err != nil {
+		return nil, errors.Wrap(ErrInvalidSnapshot, err.Error())
+	}
+	if checksum != crc.Sum32() {
+		return nil, errors.Wrap(ErrInvalidSnapshot, "checksum missmatch")
+	}
+
+	result := New()
+	for _, org := range snap.Orgs {
+		result.orgs[org.ID] = org
+	}
+	for _, usr := range snap.Users {
+		result.users[usr.ID] = usr
+	}
+	for _, ticket := range snap.Tickets {
+		result.tickets[ticket.ID] = ticket
+	}
+	result.orgUsers = fromUserRefs(snap.OrgUsers)
+	result.orgTickets = fromTicketRefs(snap.OrgTickets)
+	result.assigned = fromTicketRefs(snap.Assigned)
+	result.submitted = fromTicketRefs(snap.Submitted)
+	for _, dup := range snap.Duplicates {
+		result.noteDuplicates(dup.Resource, dup.Key, dup.Count-1)
+	}
+	history, err := fromHistory(snap.History)
+	if err != nil {
+		return nil, errors.Wrap(ErrInvalidSnapshot, err.Error())
+	}
+	result.history = history
+	result.sources = snap.Sources
+	result.walSeq = snap.WALSeq
+	for _, other := range snap.Others {
+		record, err := decodeRecord(other.Resource, other.Record)
+		if err != nil {
+			return nil, errors.Wrap(ErrInvalidSnapshot, err.Error())
+		}
+		result.put(record)
+	}
+	// put links the other resources but the built in ones were added straight
+	// to their maps
+	for _, resource := range []ResourceType{ResourceOrganization, ResourceUser, ResourceTicket} {
+		for _, record := range result.records(resource) {
+			result.linkRelations(record)
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,93 @@
+package db_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sardap/zendesk/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSaveLoad(t *testing.T) {
+	database := createLoadedDB()
+
+	var buf bytes.Buffer
+	err := database.Save(&buf)
+	assert.NoError(t, err, "error saving snapshot")
+	saved := buf.Bytes()
+
+	loaded, err := db.Load(bytes.NewReader(saved))
+	assert.NoError(t, err, "error loading snapshot")
+
+	org, err := loaded.GetOrganization(101)
+	assert.NoError(t, err)
+	assert.Equal(t, expectedOrg, *org)
+	assert.Equal(t, 8, len(org.GetRelated(loaded)), "back references not loaded")
+
+	usr, err := loaded.GetUser(1)
+	assert.NoError(t, err)
+	assert.Equal(t, expectedUser, *usr)
+	original, _ := database.GetUser(1)
+	assert.Equal(t, original.GetRelated(database), usr.GetRelated(loaded))
+
+	ticket, err := loaded.GetTicket(expectedTicket.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, expectedTicket, *ticket)
+
+	assert.Equal(t, database.Validate(), loaded.Validate())
+	assert.Equal(t, database.Sources(), loaded.Sources())
+
+	// Saving is deterministic
+	var again bytes.Buffer
+	loaded.Save(&again)
+	assert.Equal(t, saved, again.Bytes(), "snapshot should be the same when saved again")
+
+	// Empty DB
+	buf.Reset()
+	assert.NoError(t, db.New().Save(&buf))
+	empty, err := db.Load(&buf)
+	assert.NoError(t, err)
+	assert.NoError(t, empty.AddUser(db.User{ID: 1}), "loaded empty DB should be usable")
+}
+
+func TestLoadStrict(t *testing.T) {
+	database := db.New()
+	assert.NoError(t, database.AddTicket(db.Ticket{ID: "a", SubmitterID: 10}))
+	var buf bytes.Buffer
+	assert.NoError(t, database.Save(&buf))
+
+	_, err := db.LoadWithOptions(bytes.NewReader(buf.Bytes()), db.LoadOptions{Strict: true})
+	assert.ErrorIs(t, err, db.ErrInvalidForeignKey, "submitter 10 isn't in the snapshot")
+
+	_, err = db.LoadWithOptions(bytes.NewReader(buf.Bytes()), db.LoadOptions{})
+	assert.NoError(t, err)
+}
+
+func TestLoadInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	createLoadedDB().Save(&buf)
+	saved := buf.Bytes()
+
+	corrupt := func(i int) []byte {
+		result := append([]byte{}, saved...)
+		result[i] ^= 0xff
+		return result
+	}
+
+	testCases := []struct {
+		name  string
+		input []byte
+	}{
+		{name: "empty", input: []byte{}},
+		{name: "json", input: []byte(`[{"_id": 1}]`)},
+		{name: "version", input: corrupt(7)},
+		{name: "payload", input: corrupt(len(saved) / 2)},
+		{name: "checksum", input: corrupt(len(saved) - 1)},
+		{name: "truncated", input: saved[:len(saved)-10]},
+	}
+
+	for _, testCase := range testCases {
+		_, err := db.Load(bytes.NewReader(testCase.input))
+		assert.ErrorIsf(t, err, db.ErrInvalidSnapshot, "%s should fail to load", testCase.name)
+	}
+}
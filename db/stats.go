@@ -0,0 +1,95 @@
+package db
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// ResourceStats counts the records of one resource
+type ResourceStats struct {
+	Resource ResourceType `json:"resource"`
+	Records  int          `json:"records"`
+	// Dangling is how many of its foreign keys don't resolve
+	Dangling int `json:"dangling"`
+	// Duplicates is how many of its keys were added more than once
+	Duplicates int `json:"duplicates"`
+}
+
+// Stats summarises what's in the DB and how much of it fails Validate
+type Stats struct {
+	Resources  []ResourceStats `json:"resources"`
+	Records    int             `json:"records"`
+	Dangling   int             `json:"dangling"`
+	Duplicates int             `json:"duplicates"`
+	Sources    []Source        `json:"sources"`
+}
+
+// Stats counts the records of every registered resource in the order they
+// were registered
+func (d *DB) Stats() *Stats {
+	d.rlock()
+	defer d.runlock()
+
+	counts := make(map[ResourceType]int)
+	for _, resource := range resourceOrder {
+		counts[resource] = len(d.records(resource))
+	}
+
+	return newStats(counts, d.validate(), d.sources)
+}
+
+// newStats adds up the record counts and problems of each resource
+func newStats(counts map[ResourceType]int, report *ValidationReport, sources []Source) *Stats {
+	result := &Stats{
+		Dangling:   len(report.Dangling),
+		Duplicates: len(report.Duplicates),
+		Sources:    append([]Source{}, sources...),
+	}
+	for _, resource := range resourceOrder {
+		stats := ResourceStats{Resource: resource, Records: counts[resource]}
+		for _, dangling := range report.Dangling {
+			if dangling.Resource == resource {
+				stats.Dangling++
+			}
+		}
+		for _, dup := range report.Duplicates {
+			if dup.Resource == resource {
+				stats.Duplicates++
+			}
+		}
+		result.Records += stats.Records
+		result.Resources = append(result.Resources, stats)
+	}
+
+	return result
+}
+
+func (s *Stats) Write(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "resource\trecords\tdangling\tduplicates\n")
+	for _, stats := range s.Resources {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\n", stats.Resource, stats.Records, stats.Dangling, stats.Duplicates)
+	}
+	fmt.Fprintf(tw, "total\t%d\t%d\t%d\n", s.Records, s.Dangling, s.Duplicates)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	for _, source := range s.Sources {
+		file := source.File
+		if file == "" {
+			file = "-"
+		}
+		_, err := fmt.Fprintf(w, "\n%s loaded from %s sha256 %s", source.Resource, file, source.SHA256)
+		if err != nil {
+			return err
+		}
+	}
+	if len(s.Sources) > 0 {
+		_, err := fmt.Fprintln(w)
+		return err
+	}
+
+	return nil
+}
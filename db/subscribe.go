@@ -0,0 +1,310 @@
+package db
+
+import (
+	"sync"
+)
+
+type ChangeType string
+
+const (
+	ChangeInsert ChangeType = "insert"
+	ChangeUpdate ChangeType = "update"
+	ChangeDelete ChangeType = "delete"
+)
+
+// ChangeEvent is sent to subscribers after a change is applied. Before is nil
+// for inserts and After is nil for deletes. The records are the ones held
+// by the DB so must not be modified.
+type ChangeEvent struct {
+	Type   ChangeType `json:"type"`
+	Before Data       `json:"before"`
+	After  Data       `json:"after"`
+}
+
+// Overflow decides what happens when a subscriber's buffer is full
+type Overflow string
+
+const (
+	// OverflowClose unsubscribes the subscriber closing its channel so it
+	// knows it missed events. This is the default
+	OverflowClose Overflow = "close"
+	// OverflowDrop drops the event and counts it in Dropped
+	OverflowDrop Overflow = "drop"
+	// OverflowQueue holds up to Queue more events once the buffer is full
+	// and sends them as the subscriber catches up. Changes never wait on the
+	// subscriber. If the queue fills too the subscription is closed like
+	// OverflowClose
+	OverflowQueue Overflow = "queue"
+)
+
+const (
+	DefaultSubscriptionBuffer = 256
+	DefaultSubscriptionQueue  = 4096
+)
+
+type SubscribeOptions struct {
+	// Buffer is how many events can be waiting. Defaults to
+	// DefaultSubscriptionBuffer
+	Buffer   int
+	Overflow Overflow
+	// Queue is how many events OverflowQueue holds beyond the buffer.
+	// Defaults to DefaultSubscriptionQueue
+	Queue int
+}
+
+type Subscription struct {
+	filter   Condition
+	overflow Overflow
+	events   chan ChangeEvent
+	// held while sending so the channel isn't closed under a send
+	mu      sync.Mutex
+	closed  bool
+	dropped uint64
+	// OverflowQueue only. Events waiting for room in the channel, at most
+	// queue of them, which deliver sends. wake tells deliver there are more
+	// and done that the subscription ended
+	pending []ChangeEvent
+	queue   int
+	wake    chan struct{}
+	done    chan struct{}
+}
+
+// Events is closed once the subscription ends
+func (s *Subscription) Events() <-chan ChangeEvent {
+	return s.events
+}
+
+// Dropped is how many events were dropped with OverflowDrop
+func (s *Subscription) Dropped() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// close must be called with mu held
+func (s *Subscription) close() {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	if s.overflow == OverflowQueue {
+		// deliver is the only sender so it closes the channel once it stops
+		close(s.done)
+		return
+	}
+	close(s.events)
+}
+
+// Close ends the subscription. Safe to call more than once. Events still
+// queued with OverflowQueue may not be sent
+func (s *Subscription) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.close()
+}
+
+// pathMatcher is a condition which can check a single record, following
+// its path to related records in db
+type pathMatcher interface {
+	matchRecordIn(db RecordGetter, record Data) (bool, error)
+}
+
+// matches checks the record itself where the filter can, so a filter on a
+// related path like organization.name still sees the before image of a
+// delete, which isn't in db. Other filters are resolved against db
+func (s *Subscription) matches(event ChangeEvent, db *DB) bool {
+	if s.filter == nil {
+		return true
+	}
+
+	for _, record := range []Data{event.Before, event.After} {
+		if record == nil || record.GetResourceType() != s.filter.GetResource() {
+			continue
+		}
+
+		if cond, ok := s.filter.(pathMatcher); ok {
+			if match, err := cond.matchRecordIn(db, record); err == nil {
+				if match {
+					return true
+				}
+				continue
+			}
+		}
+		if cond, ok := s.filter.(RecordCondition); ok {
+			if match, err := cond.MatchRecord(record); err == nil {
+				if match {
+					return true
+				}
+				continue
+			}
+		}
+
+		// Fall back to resolving the whole condition
+		matches, err := s.filter.Resolve(db)
+		if err != nil {
+			continue
+		}
+		for _, match := range matches {
+			if match.GetKey() == record.GetKey() {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// send is called while a change holds the write lock so must never block
+func (s *Subscription) send(event ChangeEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+
+	switch s.overflow {
+	case OverflowQueue:
+		if len(s.pending) >= s.queue {
+			s.close()
+			return
+		}
+		s.pending = append(s.pending, event)
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	case OverflowDrop:
+		select {
+		case s.events <- event:
+		default:
+			s.dropped++
+		}
+	default:
+		select {
+		case s.events <- event:
+		default:
+			s.close()
+		}
+	}
+}
+
+// deliver sends the queued events of an OverflowQueue subscription as the
+// subscriber makes room for them. The subscriber can run queries and make
+// changes while it reads since nothing waits on it. An event stays queued
+// until it's sent so it counts towards the queue's limit
+func (s *Subscription) deliver() {
+	defer close(s.events)
+
+	for {
+		s.mu.Lock()
+		queued := len(s.pending) > 0
+		var event ChangeEvent
+		if queued {
+			event = s.pending[0]
+		}
+		s.mu.Unlock()
+
+		if !queued {
+			select {
+			case <-s.wake:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		select {
+		case s.events <- event:
+		case <-s.done:
+			return
+		}
+
+		s.mu.Lock()
+		s.pending[0] = ChangeEvent{}
+		s.pending = s.pending[1:]
+		s.mu.Unlock()
+	}
+}
+
+// Subscribe sends every insert, update and delete of records matching filter
+// to the returned channel. A nil filter matches everything. If the
+// subscriber falls more than DefaultSubscriptionBuffer events behind the
+// channel is closed.
+func (d *DB) Subscribe(filter Condition) <-chan ChangeEvent {
+	return d.SubscribeWithOptions(filter, SubscribeOptions{}).Events()
+}
+
+func (d *DB) SubscribeWithOptions(filter Condition, opts SubscribeOptions) *Subscription {
+	if opts.Buffer <= 0 {
+		opts.Buffer = DefaultSubscriptionBuffer
+	}
+	if opts.Overflow == "" {
+		opts.Overflow = OverflowClose
+	}
+	if opts.Queue <= 0 {
+		opts.Queue = DefaultSubscriptionQueue
+	}
+
+	result := &Subscription{
+		filter:   filter,
+		overflow: opts.Overflow,
+		events:   make(chan ChangeEvent, opts.Buffer),
+	}
+	if opts.Overflow == OverflowQueue {
+		result.queue = opts.Queue
+		result.wake = make(chan struct{}, 1)
+		result.done = make(chan struct{})
+		go result.deliver()
+	}
+
+	d.subsMu.Lock()
+	defer d.subsMu.Unlock()
+	d.subs = append(d.subs, result)
+
+	return result
+}
+
+// Unsubscribe ends the subscription which returned events
+func (d *DB) Unsubscribe(events <-chan ChangeEvent) {
+	d.subsMu.Lock()
+	var found *Subscription
+	for _, sub := range d.subs {
+		if sub.Events() == events {
+			found = sub
+			break
+		}
+	}
+	d.subsMu.Unlock()
+
+	if found != nil {
+		found.Close()
+	}
+}
+
+// publish sends the event to the subscriptions it matches. view is used to
+// resolve filters so the write lock the change holds isn't taken again
+func (d *DB) publish(event ChangeEvent, view *DB) {
+	d.subsMu.Lock()
+	if len(d.subs) == 0 {
+		d.subsMu.Unlock()
+		return
+	}
+	// Drop subscriptions which have ended
+	subs := d.subs[:0]
+	for _, sub := range d.subs {
+		sub.mu.Lock()
+		closed := sub.closed
+		sub.mu.Unlock()
+		if !closed {
+			subs = append(subs, sub)
+		}
+	}
+	d.subs = subs
+	subs = append([]*Subscription{}, subs...)
+	d.subsMu.Unlock()
+
+	for _, sub := range subs {
+		if sub.matches(event, view) {
+			sub.send(event)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package db_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sardap/zendesk/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscribe(t *testing.T) {
+	database := createBlankDb()
+
+	all := database.Subscribe(nil)
+	pending := database.Subscribe(&db.FulLMatchCondition{
+		Resource: db.ResourceTicket,
+		Field:    "status",
+		Match:    "pending",
+	})
+	single := database.Subscribe(&db.IDMatchCondition{
+		Resource: db.ResourceTicket,
+		Target:   "b",
+	})
+
+	database.AddUser(db.User{ID: 1})
+	database.AddTicket(db.Ticket{ID: "a", Status: "open"})
+	database.AddTicket(db.Ticket{ID: "b", Status: "pending"})
+	database.UpdateTicket(db.Ticket{ID: "a", Status: "pending"})
+	database.UpdateTicket(db.Ticket{ID: "b", Status: "solved"})
+	database.DeleteTicket("b")
+
+	expectEvents := func(events <-chan db.ChangeEvent, expected []db.ChangeType, keys []string) {
+		for i := range expected {
+			select {
+			case event := <-events:
+				assert.Equal(t, expected[i], event.Type, "event %d", i)
+				switch event.Type {
+				case db.ChangeInsert:
+					assert.Nil(t, event.Before)
+					assert.Equal(t, keys[i], event.After.GetKey())
+				case db.ChangeUpdate:
+					assert.Equal(t, keys[i], event.Before.GetKey())
+					assert.Equal(t, keys[i], event.After.GetKey())
+				case db.ChangeDelete:
+					assert.Equal(t, keys[i], event.Before.GetKey())
+					assert.Nil(t, event.After)
+				}
+			default:
+				assert.Failf(t, "missing event", "event %d %s %s", i, expected[i], keys[i])
+			}
+		}
+		select {
+		case event := <-events:
+			assert.Failf(t, "unexpected event", "%v", event)
+		default:
+		}
+	}
+
+	expectEvents(all,
+		[]db.ChangeType{db.ChangeInsert, db.ChangeInsert, db.ChangeInsert, db.ChangeUpdate, db.ChangeUpdate, db.ChangeDelete},
+		[]string{"1", "a", "b", "a", "b", "b"},
+	)
+	// Updates which move a record in or out of the filter are sent
+	expectEvents(pending,
+		[]db.ChangeType{db.ChangeInsert, db.ChangeUpdate, db.ChangeUpdate},
+		[]string{"b", "a", "b"},
+	)
+	expectEvents(single,
+		[]db.ChangeType{db.ChangeInsert, db.ChangeUpdate, db.ChangeDelete},
+		[]string{"b", "b", "b"},
+	)
+
+	// Before and after images
+	database.UpdateTicket(db.Ticket{ID: "a", Status: "closed"})
+	event := <-all
+	assert.Equal(t, "pending", event.Before.(*db.Ticket).Status)
+	assert.Equal(t, "closed", event.After.(*db.Ticket).Status)
+
+	// Unsubscribe
+	database.Unsubscribe(all)
+	_, ok := <-all
+	assert.False(t, ok, "channel should be closed after unsubscribe")
+	database.AddUser(db.User{ID: 2})
+}
+
+func TestSubscribeRelatedPath(t *testing.T) {
+	database := createBlankDb()
+	database.AddOrganization(db.Organization{ID: 101, Name: "Enthaze"})
+	database.AddOrganization(db.Organization{ID: 102, Name: "Nutralab"})
+
+	events := database.Subscribe(&db.FulLMatchCondition{
+		Resource: db.ResourceTicket,
+		Field:    "organization.name",
+		Match:    "Enthaze",
+	})
+
+	database.AddTicket(db.Ticket{ID: "a", OrganizationID: 101})
+	database.AddTicket(db.Ticket{ID: "b", OrganizationID: 102})
+	// Moving out of the filter is sent for the before image
+	database.UpdateTicket(db.Ticket{ID: "a", OrganizationID: 102})
+	database.UpdateTicket(db.Ticket{ID: "b", OrganizationID: 101})
+	// The deleted ticket isn't in the DB any more but its organization is
+	database.DeleteTicket("b")
+
+	expected := []struct {
+		change db.ChangeType
+		key    string
+	}{
+		{db.ChangeInsert, "a"},
+		{db.ChangeUpdate, "a"},
+		{db.ChangeUpdate, "b"},
+		{db.ChangeDelete, "b"},
+	}
+	for i, want := range expected {
+		select {
+		case event := <-events:
+			assert.Equal(t, want.change, event.Type, "event %d", i)
+			if event.Before != nil {
+				assert.Equal(t, want.key, event.Before.GetKey(), "event %d", i)
+			} else {
+				assert.Equal(t, want.key, event.After.GetKey(), "event %d", i)
+			}
+		default:
+			assert.Failf(t, "missing event", "event %d %s %s", i, want.change, want.key)
+		}
+	}
+	select {
+	case event := <-events:
+		assert.Failf(t, "unexpected event", "%v", event)
+	default:
+	}
+}
+
+func TestSubscribeOverflow(t *testing.T) {
+	database := createBlankDb()
+
+	closing := database.SubscribeWithOptions(nil, db.SubscribeOptions{Buffer: 2})
+	dropping := database.SubscribeWithOptions(nil, db.SubscribeOptions{Buffer: 2, Overflow: db.OverflowDrop})
+	queueing := database.SubscribeWithOptions(nil, db.SubscribeOptions{Buffer: 2, Overflow: db.OverflowQueue})
+
+	received := make(chan int)
+	go func() {
+		count := 0
+		for range queueing.Events() {
+			count++
+			time.Sleep(time.Millisecond)
+			if count == 5 {
+				break
+			}
+		}
+		received <- count
+	}()
+
+	for i := int64(0); i < 5; i++ {
+		database.AddUser(db.User{ID: i})
+	}
+
+	count := 0
+	for range closing.Events() {
+		count++
+	}
+	assert.Equal(t, 2, count, "closing subscriber should get the buffered events then be closed")
+
+	assert.Equal(t, 2, len(dropping.Events()))
+	assert.Equal(t, uint64(3), dropping.Dropped())
+	dropping.Close()
+	dropping.Close()
+
+	assert.Equal(t, 5, <-received, "queueing subscriber should get every event")
+	queueing.Close()
+	_, ok := <-queueing.Events()
+	assert.False(t, ok, "channel should be closed after close")
+
+	// A subscriber which stops reading is closed once the queue is full too
+	limited := database.SubscribeWithOptions(nil, db.SubscribeOptions{Buffer: 1, Overflow: db.OverflowQueue, Queue: 2})
+	for i := int64(10); i < 20; i++ {
+		database.AddUser(db.User{ID: i})
+	}
+	count = 0
+	timeout := time.After(10 * time.Second)
+	for closed := false; !closed; {
+		select {
+		case _, ok := <-limited.Events():
+			if ok {
+				count++
+			}
+			closed = !ok
+		case <-timeout:
+			assert.Fail(t, "full queue should close the subscription")
+			return
+		}
+	}
+	assert.LessOrEqual(t, count, 3, "no more than the buffer and queue should be held")
+}
+
+func TestSubscribeQueueQueries(t *testing.T) {
+	database := createBlankDb()
+	queueing := database.SubscribeWithOptions(nil, db.SubscribeOptions{Buffer: 1, Overflow: db.OverflowQueue})
+	defer queueing.Close()
+
+	const writers, changes = 4, 25
+	received := make(chan int)
+	go func() {
+		count := 0
+		for event := range queueing.Events() {
+			// Writers pile up behind the full buffer while the subscriber is
+			// slow. Its queries mustn't wait on them
+			time.Sleep(time.Millisecond)
+			q := db.Query{Conditions: []db.Condition{
+				&db.IDMatchCondition{Resource: db.ResourceUser, Target: event.After.GetKey()},
+			}}
+			_, err := q.Resolve(database)
+			assert.NoError(t, err)
+			count++
+			if count == writers*changes {
+				break
+			}
+		}
+		received <- count
+	}()
+
+	for i := 0; i < writers; i++ {
+		go func(writer int) {
+			for j := 0; j < changes; j++ {
+				database.AddUser(db.User{ID: int64(writer*changes + j)})
+			}
+		}(i)
+	}
+
+	select {
+	case count := <-received:
+		assert.Equal(t, writers*changes, count)
+	case <-time.After(10 * time.Second):
+		assert.Fail(t, "queueing subscriber deadlocked with the writers")
+	}
+}
@@ -0,0 +1,154 @@
+package db
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrTenantExists  error
+	ErrUnknownTenant error
+	ErrNoTenantName  error
+)
+
+func init() {
+	ErrTenantExists = fmt.Errorf("tenant already added")
+	ErrUnknownTenant = fmt.Errorf("unknown tenant")
+	ErrNoTenantName = fmt.Errorf("tenants must have a name")
+}
+
+// Tenants holds a DB for each Zendesk instance by name. Keys are only unique
+// within an instance so every tenant keeps its own DB and their records are
+// never mixed
+type Tenants struct {
+	mu  sync.RWMutex
+	dbs map[string]*DB
+}
+
+func NewTenants() *Tenants {
+	return &Tenants{dbs: make(map[string]*DB)}
+}
+
+func (t *Tenants) Add(name string, database *DB) error {
+	if name == "" {
+		return ErrNoTenantName
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.dbs[name]; ok {
+		return errors.Wrapf(ErrTenantExists, "%s", name)
+	}
+	t.dbs[name] = database
+
+	return nil
+}
+
+func (t *Tenants) Get(name string) (*DB, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	result, ok := t.dbs[name]
+	if !ok {
+		return nil, errors.Wrapf(ErrUnknownTenant, "%s", name)
+	}
+
+	return result, nil
+}
+
+// Names lists the tenants in order
+func (t *Tenants) Names() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	result := make([]string, 0, len(t.dbs))
+	for name := range t.dbs {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+
+	return result
+}
+
+// SelectTenants picks the names matching any of the patterns, which are
+// globs like init* (see path.Match). No patterns picks every name. Fails
+// with ErrUnknownTenant if a pattern matches nothing so a typo isn't taken
+// to mean no results
+func SelectTenants(names []string, patterns []string) ([]string, error) {
+	if len(patterns) == 0 {
+		return names, nil
+	}
+
+	var result []string
+	picked := make(map[string]bool)
+	for _, pattern := range patterns {
+		matched := false
+		for _, name := range names {
+			ok, err := path.Match(pattern, name)
+			if err != nil {
+				return nil, errors.Wrapf(ErrUnknownTenant, "%s: %s", pattern, err)
+			}
+			if !ok {
+				continue
+			}
+			matched = true
+			if !picked[name] {
+				picked[name] = true
+				result = append(result, name)
+			}
+		}
+		if !matched {
+			return nil, errors.Wrapf(ErrUnknownTenant, "nothing matches %s", pattern)
+		}
+	}
+	sort.Strings(result)
+
+	return result, nil
+}
+
+// Select is SelectTenants on the tenants' names
+func (t *Tenants) Select(patterns ...string) ([]string, error) {
+	return SelectTenants(t.Names(), patterns)
+}
+
+// Resolve runs the query against each named tenant, or every tenant if no
+// names are given. Each result is tagged with its tenant and they're in
+// tenant order. Tenants without any matches are left out, including those
+// without a record an IDMatchCondition asks for
+func (t *Tenants) Resolve(q *Query, names ...string) ([]*QueryResult, error) {
+	if len(names) == 0 {
+		names = t.Names()
+	} else {
+		// Sorted without reordering the caller's slice
+		names = append([]string(nil), names...)
+		sort.Strings(names)
+	}
+
+	var result []*QueryResult
+	for _, name := range names {
+		database, err := t.Get(name)
+		if err != nil {
+			return nil, err
+		}
+
+		tenantResult, err := q.Resolve(database)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "tenant %s", name)
+		}
+		if len(tenantResult.Target) == 0 {
+			continue
+		}
+		tenantResult.Tenant = name
+		result = append(result, tenantResult)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,53 @@
+package db_test
+
+import (
+	"testing"
+
+	"github.com/sardap/zendesk/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTenants(t *testing.T) {
+	initech := db.New()
+	initech.AddOrganization(db.Organization{ID: 101, Name: "Initech"})
+	initech.AddUser(db.User{ID: 1, Name: "Peter Gibbons", OrganizationID: 101})
+	acme := db.New()
+	acme.AddOrganization(db.Organization{ID: 101, Name: "Acme"})
+	acme.AddUser(db.User{ID: 1, Name: "Wile Coyote", OrganizationID: 101})
+	acme.AddUser(db.User{ID: 2, Name: "Road Runner", OrganizationID: 101})
+
+	tenants := db.NewTenants()
+	assert.NoError(t, tenants.Add("initech", initech))
+	assert.NoError(t, tenants.Add("acme", acme))
+	assert.ErrorIs(t, tenants.Add("acme", db.New()), db.ErrTenantExists)
+	assert.ErrorIs(t, tenants.Add("", db.New()), db.ErrNoTenantName)
+	assert.Equal(t, []string{"acme", "initech"}, tenants.Names())
+	_, err := tenants.Get("hooli")
+	assert.ErrorIs(t, err, db.ErrUnknownTenant)
+
+	selected, err := tenants.Select("init*", "initech")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"initech"}, selected)
+	_, err = tenants.Select("acme", "hooli")
+	assert.ErrorIs(t, err, db.ErrUnknownTenant, "a pattern matching nothing fails")
+
+	query := db.Query{Conditions: []db.Condition{&db.IDMatchCondition{Resource: db.ResourceUser, Target: "1"}}}
+	results, err := tenants.Resolve(&query)
+	if !assert.NoError(t, err) || !assert.Equal(t, 2, len(results)) {
+		return
+	}
+	assert.Equal(t, "acme", results[0].Tenant)
+	assert.Equal(t, "Wile Coyote", results[0].Target[0].(*db.User).Name, "keys are only looked up in their own tenant")
+	assert.Equal(t, "Acme", results[0].Related.Orgs[0].(*db.Organization).Name)
+	assert.Equal(t, "initech", results[1].Tenant)
+	assert.Equal(t, "Peter Gibbons", results[1].Target[0].(*db.User).Name)
+
+	query = db.Query{Conditions: []db.Condition{&db.IDMatchCondition{Resource: db.ResourceUser, Target: "2"}}}
+	names := []string{"initech", "acme"}
+	results, err = tenants.Resolve(&query, names...)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"initech", "acme"}, names, "the names given aren't reordered")
+	if assert.Equal(t, 1, len(results), "tenants without the record are left out") {
+		assert.Equal(t, "acme", results[0].Tenant)
+	}
+}
@@ -0,0 +1,163 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrTxDone error
+)
+
+func init() {
+	ErrTxDone = fmt.Errorf("transaction has already been committed or rolled back")
+}
+
+type txChange struct {
+	op     Op
+	record Data
+}
+
+// Tx collects changes which are applied together on Commit. Nothing is
+// visible to readers of the DB, including the foreign key back references,
+// until then. A Tx isn't safe to use from more than one goroutine.
+type Tx struct {
+	db      *DB
+	changes []txChange
+	done    bool
+}
+
+// Begin starts a transaction
+func (d *DB) Begin() *Tx {
+	return &Tx{db: d}
+}
+
+func (t *Tx) stage(op Op, record Data) error {
+	if t.done {
+		return ErrTxDone
+	}
+
+	t.changes = append(t.changes, txChange{op, record})
+	return nil
+}
+
+// AddOrganization replaces any organization with the same ID
+func (t *Tx) AddOrganization(toAdd Organization) error {
+	return t.stage(OpAdd, &toAdd)
+}
+
+// AddUser replaces any user with the same ID
+func (t *Tx) AddUser(toAdd User) error {
+	return t.stage(OpAdd, &toAdd)
+}
+
+// AddTicket replaces any ticket with the same ID
+func (t *Tx) AddTicket(toAdd Ticket) error {
+	return t.stage(OpAdd, &toAdd)
+}
+
+// UpdateOrganization replaces an organization which exists when the
+// transaction is committed
+func (t *Tx) UpdateOrganization(toUpdate Organization) error {
+	return t.stage(OpUpdate, &toUpdate)
+}
+
+// UpdateUser replaces a user which exists when the transaction is committed
+func (t *Tx) UpdateUser(toUpdate User) error {
+	return t.stage(OpUpdate, &toUpdate)
+}
+
+// UpdateTicket replaces a ticket which exists when the transaction is
+// committed
+func (t *Tx) UpdateTicket(toUpdate Ticket) error {
+	return t.stage(OpUpdate, &toUpdate)
+}
+
+func (t *Tx) DeleteOrganization(id int64) error {
+	return t.stage(OpDelete, &Organization{ID: id})
+}
+
+func (t *Tx) DeleteUser(id int64) error {
+	return t.stage(OpDelete, &User{ID: id})
+}
+
+func (t *Tx) DeleteTicket(id string) error {
+	return t.stage(OpDelete, &Ticket{ID: id})
+}
+
+// check makes sure every update and delete has a record to change, taking
+// the earlier changes in the transaction into account
+func (t *Tx) check() error {
+	staged := make(map[ResourceType]map[string]bool)
+
+	for _, change := range t.changes {
+		resource := change.record.GetResourceType()
+		key := change.record.GetKey()
+		if staged[resource] == nil {
+			staged[resource] = make(map[string]bool)
+		}
+
+		exists, ok := staged[resource][key]
+		if !ok {
+			exists = t.db.get(resource, key) != nil
+		}
+		if change.op != OpAdd && !exists {
+			return errors.Wrapf(ErrNotFound, "%s %s %s", change.op, resource, key)
+		}
+
+		staged[resource][key] = change.op != OpDelete
+	}
+
+	return nil
+}
+
+// Commit applies every change at once. If any change can't be made none of
+// them are and the DB is left as it was.
+func (t *Tx) Commit() error {
+	if t.done {
+		return ErrTxDone
+	}
+	t.done = true
+
+	d := t.db
+	return d.write(func() ([]ChangeEvent, error) {
+		if err := t.check(); err != nil {
+			return nil, err
+		}
+
+		// Every change takes effect at the same moment
+		at := time.Now()
+		if d.wal != nil && len(t.changes) > 0 {
+			if err := d.wal.appendBatch(t.changes, at); err != nil {
+				return nil, err
+			}
+			d.walSeq = d.wal.seq
+		}
+
+		events := make([]ChangeEvent, 0, len(t.changes))
+		for _, change := range t.changes {
+			event, ok := d.apply(change.op, change.record, at, false)
+			if change.op == OpAdd && event.Before != nil {
+				d.noteDuplicate(change.record.GetResourceType(), change.record.GetKey())
+			}
+			if ok {
+				events = append(events, event)
+			}
+		}
+
+		return events, nil
+	})
+}
+
+// Rollback throws away every change
+func (t *Tx) Rollback() error {
+	if t.done {
+		return ErrTxDone
+	}
+
+	t.done = true
+	t.changes = nil
+	return nil
+}
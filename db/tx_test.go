@@ -0,0 +1,168 @@
+package db_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/sardap/zendesk/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func stageBatch(t *testing.T, tx *db.Tx, users int) {
+	assert.NoError(t, tx.AddOrganization(db.Organization{ID: 900, Name: "Batch"}))
+	for i := 0; i < users; i++ {
+		assert.NoError(t, tx.AddUser(db.User{ID: int64(9000 + i), OrganizationID: 900}))
+	}
+	assert.NoError(t, tx.AddTicket(db.Ticket{ID: "batch", SubmitterID: 9000, OrganizationID: 900}))
+}
+
+func TestTxCommit(t *testing.T) {
+	database := createBlankDb()
+
+	tx := database.Begin()
+	stageBatch(t, tx, 2)
+
+	_, err := database.GetOrganization(900)
+	assert.ErrorIs(t, err, db.ErrNotFound, "changes shouldn't be visible before commit")
+	_, err = database.GetUser(9000)
+	assert.ErrorIs(t, err, db.ErrNotFound, "changes shouldn't be visible before commit")
+
+	assert.NoError(t, tx.Commit())
+
+	org, err := database.GetOrganization(900)
+	if assert.NoError(t, err, "org missing after commit") {
+		assert.Equal(t, 3, len(org.GetRelated(database)), "org should have both users and the ticket")
+	}
+	usr, err := database.GetUser(9000)
+	if assert.NoError(t, err, "user missing after commit") {
+		assert.Equal(t, 2, len(usr.GetRelated(database)), "user should have org and submitted ticket")
+	}
+
+	// Changes can build on earlier ones in the same transaction
+	tx = database.Begin()
+	assert.NoError(t, tx.AddUser(db.User{ID: 9100, Name: "a"}))
+	assert.NoError(t, tx.UpdateUser(db.User{ID: 9100, Name: "b"}))
+	assert.NoError(t, tx.DeleteTicket("batch"))
+	assert.NoError(t, tx.Commit())
+	usr, err = database.GetUser(9100)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "b", usr.Name)
+	}
+	_, err = database.GetTicket("batch")
+	assert.ErrorIs(t, err, db.ErrNotFound)
+
+	assert.ErrorIs(t, tx.Commit(), db.ErrTxDone)
+	assert.ErrorIs(t, tx.AddUser(db.User{ID: 1}), db.ErrTxDone)
+}
+
+func TestTxRollback(t *testing.T) {
+	database := createBlankDb()
+
+	tx := database.Begin()
+	stageBatch(t, tx, 2)
+	assert.NoError(t, tx.Rollback())
+	assert.ErrorIs(t, tx.Commit(), db.ErrTxDone)
+	assert.ErrorIs(t, tx.Rollback(), db.ErrTxDone)
+
+	_, err := database.GetOrganization(900)
+	assert.ErrorIs(t, err, db.ErrNotFound, "rolled back changes shouldn't be applied")
+
+	// A failing change stops the whole transaction
+	tx = database.Begin()
+	stageBatch(t, tx, 2)
+	assert.NoError(t, tx.DeleteUser(9000))
+	assert.NoError(t, tx.UpdateUser(db.User{ID: 9000}))
+	assert.ErrorIs(t, tx.Commit(), db.ErrNotFound)
+
+	_, err = database.GetOrganization(900)
+	assert.ErrorIs(t, err, db.ErrNotFound, "failed transaction shouldn't be applied")
+	_, err = database.GetUser(9001)
+	assert.ErrorIs(t, err, db.ErrNotFound, "failed transaction shouldn't be applied")
+}
+
+func TestTxConcurrentReaders(t *testing.T) {
+	const users = 50
+	database := createBlankDb()
+
+	query := db.Query{
+		Conditions: []db.Condition{
+			&db.FulLMatchCondition{
+				Resource:  db.ResourceUser,
+				Connector: db.ConnectorTypeUnion,
+				Field:     "organization_id",
+				Match:     "900",
+			},
+		},
+	}
+
+	var wg sync.WaitGroup
+	for reader := 0; reader < 4; reader++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				result, err := query.Resolve(database)
+				if !assert.NoError(t, err) {
+					return
+				}
+				count := len(result.Target)
+				if count != 0 && count != users {
+					assert.Fail(t, fmt.Sprintf("saw %d of %d users from a commit", count, users))
+					return
+				}
+				if count == users {
+					return
+				}
+			}
+		}()
+	}
+
+	tx := database.Begin()
+	stageBatch(t, tx, users)
+	assert.NoError(t, tx.Commit())
+	wg.Wait()
+}
+
+func TestTxWAL(t *testing.T) {
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "zendesk.wal")
+	snapPath := filepath.Join(dir, "zendesk.snap")
+
+	database, err := db.Open(snapPath, walPath, db.WALOptions{})
+	assert.NoError(t, err, "error opening db")
+	tx := database.Begin()
+	stageBatch(t, tx, 2)
+	assert.NoError(t, tx.Commit())
+	database.Close()
+	info, _ := os.Stat(walPath)
+	goodSize := info.Size()
+
+	recovered, err := db.Open(snapPath, walPath, db.WALOptions{})
+	assert.NoError(t, err, "error recovering db")
+	org, err := recovered.GetOrganization(900)
+	if assert.NoError(t, err, "transaction not replayed") {
+		assert.Equal(t, 3, len(org.GetRelated(recovered)))
+	}
+
+	// A torn transaction loses every change in it
+	tx = recovered.Begin()
+	assert.NoError(t, tx.AddUser(db.User{ID: 9100}))
+	assert.NoError(t, tx.AddUser(db.User{ID: 9101}))
+	assert.NoError(t, tx.Commit())
+	recovered.Close()
+	info, _ = os.Stat(walPath)
+	os.Truncate(walPath, info.Size()-4)
+
+	recovered, err = db.Open(snapPath, walPath, db.WALOptions{})
+	assert.NoError(t, err, "torn transaction should be recovered from")
+	for _, id := range []int64{9100, 9101} {
+		_, err = recovered.GetUser(id)
+		assert.ErrorIs(t, err, db.ErrNotFound, "torn transaction should be dropped")
+	}
+	info, _ = os.Stat(walPath)
+	assert.Equal(t, goodSize, info.Size(), "torn transaction should be truncated")
+	recovered.Close()
+}
@@ -0,0 +1,170 @@
+package db
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// DanglingReference is a foreign key which doesn't resolve
+type DanglingReference struct {
+	Resource ResourceType `json:"resource"`
+	Key      string       `json:"key"`
+	Field    string       `json:"field"`
+	Target   int64        `json:"target"`
+	// TargetKey is set instead of Target when the key isn't an int
+	TargetKey string `json:"target_key,omitempty"`
+}
+
+func (d DanglingReference) target() string {
+	if d.TargetKey != "" {
+		return d.TargetKey
+	}
+	return strconv.FormatInt(d.Target, 10)
+}
+
+func (d DanglingReference) String() string {
+	return fmt.Sprintf("%s %s %s %s", d.Resource, d.Key, d.Field, d.target())
+}
+
+// DuplicateKey is a key which was added more than once
+type DuplicateKey struct {
+	Resource ResourceType `json:"resource"`
+	Key      string       `json:"key"`
+	// Count is how many times the key was added
+	Count int `json:"count"`
+}
+
+type ValidationReport struct {
+	Dangling   []DanglingReference `json:"dangling"`
+	Duplicates []DuplicateKey      `json:"duplicates"`
+}
+
+func (v *ValidationReport) OK() bool {
+	return len(v.Dangling) == 0 && len(v.Duplicates) == 0
+}
+
+func (v *ValidationReport) Write(w io.Writer) error {
+	if v.OK() {
+		_, err := fmt.Fprintf(w, "no problems found\n")
+		return err
+	}
+
+	if len(v.Dangling) > 0 {
+		if _, err := fmt.Fprintf(w, "%d dangling references\n", len(v.Dangling)); err != nil {
+			return err
+		}
+		for _, dangling := range v.Dangling {
+			_, err := fmt.Fprintf(w, "\t%s %s %s %s not found\n",
+				dangling.Resource, dangling.Key, dangling.Field, dangling.target(),
+			)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(v.Duplicates) > 0 {
+		if _, err := fmt.Fprintf(w, "%d duplicate ids\n", len(v.Duplicates)); err != nil {
+			return err
+		}
+		for _, dup := range v.Duplicates {
+			_, err := fmt.Fprintf(w, "\t%s %s added %d times\n", dup.Resource, dup.Key, dup.Count)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Validate finds foreign keys which don't resolve and keys which were added
+// more than once. A foreign key of 0 is taken to be unset.
+func (d *DB) Validate() *ValidationReport {
+	d.rlock()
+	defer d.runlock()
+
+	return d.validate()
+}
+
+func (d *DB) validate() *ValidationReport {
+	result := &ValidationReport{}
+
+	checkOrg := func(resource ResourceType, key, field string, id int64) {
+		if _, ok := d.orgs[id]; id != 0 && !ok {
+			result.Dangling = append(result.Dangling, DanglingReference{Resource: resource, Key: key, Field: field, Target: id})
+		}
+	}
+	checkUser := func(resource ResourceType, key, field string, id int64) {
+		if _, ok := d.users[id]; id != 0 && !ok {
+			result.Dangling = append(result.Dangling, DanglingReference{Resource: resource, Key: key, Field: field, Target: id})
+		}
+	}
+
+	for _, usr := range d.users {
+		checkOrg(ResourceUser, usr.GetKey(), "organization_id", usr.OrganizationID)
+	}
+	for _, ticket := range d.tickets {
+		checkOrg(ResourceTicket, ticket.GetKey(), "organization_id", ticket.OrganizationID)
+		checkUser(ResourceTicket, ticket.GetKey(), "submitter_id", ticket.SubmitterID)
+		checkUser(ResourceTicket, ticket.GetKey(), "assignee_id", ticket.AssigneeID)
+	}
+	for _, resource := range resourceOrder {
+		relations := resourceRegistry[resource].Relations
+		if len(relations) == 0 {
+			continue
+		}
+		for _, record := range d.records(resource) {
+			for _, relation := range relations {
+				for _, key := range relationKeys(record, relation) {
+					if d.get(relation.Target, key) != nil {
+						continue
+					}
+					dangling := DanglingReference{Resource: resource, Key: record.GetKey(), Field: relation.Field}
+					if id, err := strconv.ParseInt(key, 10, 64); err == nil && resourceRegistry[relation.Target].Key == KeyInt {
+						dangling.Target = id
+					} else {
+						dangling.TargetKey = key
+					}
+					result.Dangling = append(result.Dangling, dangling)
+				}
+			}
+		}
+	}
+
+	for resource, keys := range d.duplicates {
+		for key, count := range keys {
+			result.Duplicates = append(result.Duplicates, DuplicateKey{resource, key, count + 1})
+		}
+	}
+
+	result.sort()
+
+	return result
+}
+
+// sort orders the problems by resource then key
+func (v *ValidationReport) sort() {
+	sort.Slice(v.Dangling, func(i, j int) bool {
+		a, b := v.Dangling[i], v.Dangling[j]
+		if a.Resource != b.Resource {
+			return a.Resource < b.Resource
+		}
+		if a.Key != b.Key {
+			return keyLess(a.Key, b.Key)
+		}
+		if a.Field != b.Field {
+			return a.Field < b.Field
+		}
+		return keyLess(a.target(), b.target())
+	})
+	sort.Slice(v.Duplicates, func(i, j int) bool {
+		a, b := v.Duplicates[i], v.Duplicates[j]
+		if a.Resource != b.Resource {
+			return a.Resource < b.Resource
+		}
+		return keyLess(a.Key, b.Key)
+	})
+}
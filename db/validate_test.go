@@ -0,0 +1,84 @@
+package db_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/sardap/zendesk/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	database := createLoadedDB()
+
+	report := database.Validate()
+	assert.False(t, report.OK())
+	assert.Equal(t, []db.DanglingReference{
+		{Resource: db.ResourceTicket, Key: "4d0ab657-4c59-43e4-aab3-162753043a59", Field: "assignee_id", Target: 555},
+		{Resource: db.ResourceTicket, Key: "7523607d-d45c-4e3a-93aa-419402e64d73", Field: "organization_id", Target: 555},
+		{Resource: db.ResourceTicket, Key: "bc736a06-eeb0-4271-b4a8-c66f61b5df1f", Field: "submitter_id", Target: 555},
+	}, report.Dangling)
+	assert.Empty(t, report.Duplicates)
+
+	// Duplicates
+	database = createBlankDb()
+	database.AddOrganization(db.Organization{ID: 101})
+	database.AddOrganization(db.Organization{ID: 101})
+	database.AddOrganization(db.Organization{ID: 101})
+	database.AddUser(db.User{ID: 1, OrganizationID: 101})
+	database.AddTicket(db.Ticket{ID: "a", SubmitterID: 1})
+	database.AddTicket(db.Ticket{ID: "a", SubmitterID: 1})
+
+	report = database.Validate()
+	assert.Empty(t, report.Dangling, "unset foreign keys shouldn't dangle")
+	assert.Equal(t, []db.DuplicateKey{
+		{Resource: db.ResourceOrganization, Key: "101", Count: 3},
+		{Resource: db.ResourceTicket, Key: "a", Count: 2},
+	}, report.Duplicates)
+
+	var buf bytes.Buffer
+	report.Write(&buf)
+	assert.Contains(t, buf.String(), "organization 101 added 3 times")
+
+	buf.Reset()
+	createBlankDb().Validate().Write(&buf)
+	assert.Equal(t, "no problems found\n", buf.String())
+}
+
+func TestCreateStrict(t *testing.T) {
+	orgsFile, usersFile, ticketsFile := getFiles()
+	defer orgsFile.Close()
+	defer usersFile.Close()
+	defer ticketsFile.Close()
+
+	_, err := db.CreateWithOptions(orgsFile, usersFile, ticketsFile, db.LoadOptions{Strict: true})
+	assert.ErrorIs(t, err, db.ErrInvalidForeignKey)
+
+	_, err = db.CreateWithOptions(
+		strings.NewReader(`[{"_id": 101}]`),
+		strings.NewReader(`[{"_id": 1, "organization_id": 101}]`),
+		strings.NewReader(`[{"_id": "a", "organization_id": 101, "submitter_id": 1, "assignee_id": 1}]`),
+		db.LoadOptions{Strict: true},
+	)
+	assert.NoError(t, err)
+}
+
+func TestStats(t *testing.T) {
+	database := createLoadedDB()
+	report := database.Validate()
+
+	stats := database.Stats()
+	assert.Equal(t, 300, stats.Records)
+	assert.Equal(t, len(report.Dangling), stats.Dangling)
+	assert.Equal(t, len(report.Duplicates), stats.Duplicates)
+	assert.Equal(t, database.Sources(), stats.Sources)
+	if assert.Equal(t, len(db.Resources()), len(stats.Resources)) {
+		assert.Equal(t, db.ResourceStats{Resource: db.ResourceTicket, Records: 200, Dangling: len(report.Dangling)}, stats.Resources[2])
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, stats.Write(&buf))
+	assert.Contains(t, buf.String(), "organization    25       0         0\n")
+	assert.Contains(t, buf.String(), "total           300")
+}
@@ -0,0 +1,477 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrInvalidWAL error
+	ErrNoWAL      error
+)
+
+func init() {
+	ErrInvalidWAL = fmt.Errorf("invalid write ahead log")
+	ErrNoWAL = fmt.Errorf("no write ahead log attached")
+}
+
+// A write ahead log starts with the magic "ZDWAL" and a uint16 version. Each
+// entry after that is the uint32 length of the payload, the uint32 CRC-32C of
+// the payload and then the json encoded walEntry. Integers are big endian.
+const WALVersion uint16 = 1
+
+var walMagic = []byte("ZDWAL")
+
+type SyncMode string
+
+const (
+	// SyncAlways fsyncs after every entry so nothing is lost on a crash
+	SyncAlways SyncMode = "always"
+	// SyncNever leaves flushing to the OS which is much faster but the last
+	// few entries can be lost on a crash
+	SyncNever SyncMode = "never"
+)
+
+type WALOptions struct {
+	// Sync defaults to SyncAlways
+	Sync SyncMode
+}
+
+// opBatch entries hold the changes of a transaction in Batch so a torn write
+// loses all of them rather than some
+const opBatch Op = "batch"
+
+type walEntry struct {
+	Op       Op              `json:"op"`
+	Resource ResourceType    `json:"resource,omitempty"`
+	Record   json.RawMessage `json:"record,omitempty"`
+	Batch    []walEntry      `json:"batch,omitempty"`
+	// At is when the change took effect
+	At time.Time `json:"at"`
+	// Dated is set for versions from a dated export
+	Dated bool `json:"dated,omitempty"`
+	// Seq numbers the entries of a DB's log in the order they were written.
+	// Batched changes share their batch's
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+// WAL is an append only log of every change made to a DB
+type WAL struct {
+	f    *os.File
+	opts WALOptions
+	// offset of the end of the last good entry
+	end int64
+	// Seq of the last entry written or replayed
+	seq uint64
+}
+
+// OpenWAL opens or creates the log at path. Call Replay before attaching it
+// to a DB so the existing entries aren't lost.
+func OpenWAL(path string, opts WALOptions) (*WAL, error) {
+	if opts.Sync == "" {
+		opts.Sync = SyncAlways
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	result := &WAL{f: f, opts: opts}
+	if info.Size() == 0 {
+		if err := result.writeHeader(); err != nil {
+			f.Close()
+			return nil, err
+		}
+		return result, nil
+	}
+
+	header := make([]byte, len(walMagic)+2)
+	if _, err := io.ReadFull(f, header); err != nil {
+		f.Close()
+		return nil, errors.Wrap(ErrInvalidWAL, err.Error())
+	}
+	if !bytes.Equal(header[:len(walMagic)], walMagic) {
+		f.Close()
+		return nil, errors.Wrap(ErrInvalidWAL, "not a write ahead log")
+	}
+	if version := binary.BigEndian.Uint16(header[len(walMagic):]); version != WALVersion {
+		f.Close()
+		return nil, errors.Wrapf(ErrInvalidWAL, "version %d can't be read, expected %d", version, WALVersion)
+	}
+	result.end = int64(len(header))
+
+	return result, nil
+}
+
+func (w *WAL) writeHeader() error {
+	header := make([]byte, len(walMagic)+2)
+	copy(header, walMagic)
+	binary.BigEndian.PutUint16(header[len(walMagic):], WALVersion)
+
+	if _, err := w.f.WriteAt(header, 0); err != nil {
+		return err
+	}
+	w.end = int64(len(header))
+
+	return w.sync()
+}
+
+func (w *WAL) sync() error {
+	if w.opts.Sync == SyncAlways {
+		return w.f.Sync()
+	}
+	return nil
+}
+
+func newWALEntry(op Op, record Data, at time.Time) (walEntry, error) {
+	recordJson, err := json.Marshal(record)
+	if err != nil {
+		return walEntry{}, err
+	}
+
+	return walEntry{
+		Op:       op,
+		Resource: record.GetResourceType(),
+		Record:   recordJson,
+		At:       at,
+	}, nil
+}
+
+func (w *WAL) append(op Op, record Data, at time.Time, dated bool) error {
+	entry, err := newWALEntry(op, record, at)
+	if err != nil {
+		return err
+	}
+	entry.Dated = dated
+
+	return w.write(entry)
+}
+
+// appendBatch logs the changes as a single entry
+func (w *WAL) appendBatch(changes []txChange, at time.Time) error {
+	entry := walEntry{Op: opBatch, At: at}
+	for _, change := range changes {
+		sub, err := newWALEntry(change.op, change.record, at)
+		if err != nil {
+			return err
+		}
+		entry.Batch = append(entry.Batch, sub)
+	}
+
+	return w.write(entry)
+}
+
+func (w *WAL) write(entry walEntry) error {
+	entry.Seq = w.seq + 1
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	frame := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint32(frame[0:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:], crc32.Checksum(payload, crcTable))
+	copy(frame[8:], payload)
+
+	if _, err := w.f.WriteAt(frame, w.end); err != nil {
+		return err
+	}
+	w.end += int64(len(frame))
+	w.seq = entry.Seq
+
+	return w.sync()
+}
+
+// decodeRecord unmarshals a json record of the resource
+func decodeRecord(resource ResourceType, raw json.RawMessage) (Data, error) {
+	record, err := newRecord(resource)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(raw, record); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// decodeWALEntry returns the changes held by an entry
+func decodeWALEntry(entry walEntry) ([]txChange, error) {
+	if entry.Op != opBatch {
+		record, err := decodeRecord(entry.Resource, entry.Record)
+		if err != nil {
+			return nil, err
+		}
+		return []txChange{{entry.Op, record}}, nil
+	}
+
+	result := make([]txChange, 0, len(entry.Batch))
+	for _, sub := range entry.Batch {
+		record, err := decodeRecord(sub.Resource, sub.Record)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, txChange{sub.Op, record})
+	}
+
+	return result, nil
+}
+
+// Replay applies every entry in the log to d and returns how many it
+// applied. Entries d's snapshot already holds, left by a Compact which didn't
+// finish, are skipped. A last entry which is cut short or fails its checksum
+// is taken to be a write torn by a crash and truncated away. An entry which
+// is followed by a whole entry can't have been torn, so if it fails its
+// checksum or says it runs past the end of the log Replay fails with
+// ErrInvalidWAL and leaves the log as it is.
+func (w *WAL) Replay(d *DB) (int, error) {
+	count := 0
+	err := d.write(func() ([]ChangeEvent, error) {
+		var events []ChangeEvent
+		var err error
+		count, err = w.replay(d, &events)
+		return events, err
+	})
+
+	return count, err
+}
+
+// replay must be called with the write lock held
+func (w *WAL) replay(d *DB, events *[]ChangeEvent) (int, error) {
+	info, err := w.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	start := int64(len(walMagic) + 2)
+	r := bufio.NewReader(io.NewSectionReader(w.f, start, 1<<62))
+
+	offset := start
+	count := 0
+	// index of the entry in the log, counting those skipped
+	index := -1
+	frameHeader := make([]byte, 8)
+	for {
+		_, err := io.ReadFull(r, frameHeader)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+		index++
+		length := binary.BigEndian.Uint32(frameHeader[0:])
+		checksum := binary.BigEndian.Uint32(frameHeader[4:])
+		end := offset + int64(len(frameHeader)) + int64(length)
+		if end > info.Size() {
+			torn, err := w.tornAt(offset, info.Size())
+			if err != nil {
+				return count, err
+			}
+			if !torn {
+				return count, errors.Wrapf(ErrInvalidWAL, "entry %d: length %d runs past the end", index, length)
+			}
+			break
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return count, err
+		}
+		if crc32.Checksum(payload, crcTable) != checksum {
+			if end < info.Size() {
+				return count, errors.Wrapf(ErrInvalidWAL, "entry %d: checksum missmatch", index)
+			}
+			break
+		}
+
+		var entry walEntry
+		if err := json.Unmarshal(payload, &entry); err != nil {
+			return count, errors.Wrapf(ErrInvalidWAL, "entry %d: %s", index, err)
+		}
+		offset = end
+		if entry.Seq > w.seq {
+			w.seq = entry.Seq
+		}
+		if entry.Seq != 0 && entry.Seq <= d.walSeq {
+			continue
+		}
+
+		changes, err := decodeWALEntry(entry)
+		if err != nil {
+			return count, errors.Wrapf(ErrInvalidWAL, "entry %d: %s", index, err)
+		}
+		// Replayed changes are already in the log so aren't logged again
+		for _, change := range changes {
+			if event, ok := d.apply(change.op, change.record, entry.At, entry.Dated); ok {
+				*events = append(*events, event)
+			}
+		}
+		if entry.Seq > d.walSeq {
+			d.walSeq = entry.Seq
+		}
+		count++
+	}
+
+	// Drop the torn entry so new entries follow the last good one
+	if err := w.f.Truncate(offset); err != nil {
+		return count, err
+	}
+	w.end = offset
+	if w.seq < d.walSeq {
+		w.seq = d.walSeq
+	}
+
+	return count, w.sync()
+}
+
+// tornAt is true if the entry at offset could be the last write cut short
+// by a crash, which it can't be if there's a whole entry with a good
+// checksum anywhere after it
+func (w *WAL) tornAt(offset, size int64) (bool, error) {
+	rest := make([]byte, size-offset)
+	if _, err := w.f.ReadAt(rest, offset); err != nil {
+		return false, err
+	}
+
+	for i := 1; i+8 <= len(rest); i++ {
+		length := int(binary.BigEndian.Uint32(rest[i:]))
+		// No entry is empty, and empty ones would match zeroed space
+		if length == 0 || length > len(rest)-i-8 {
+			continue
+		}
+		payload := rest[i+8 : i+8+length]
+		if crc32.Checksum(payload, crcTable) == binary.BigEndian.Uint32(rest[i+4:]) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// Truncate removes every entry
+func (w *WAL) Truncate() error {
+	if err := w.f.Truncate(0); err != nil {
+		return err
+	}
+	return w.writeHeader()
+}
+
+func (w *WAL) Close() error {
+	return w.f.Close()
+}
+
+// AttachWAL logs every following change to the DB to w
+func (d *DB) AttachWAL(w *WAL) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.wal = w
+	// Carry on numbering from the snapshot if the log is newer than it
+	if w.seq < d.walSeq {
+		w.seq = d.walSeq
+	}
+}
+
+// Compact writes a snapshot of the DB to snapshotPath then empties the
+// attached log since the snapshot now holds all of its changes. The
+// snapshot is written to a temporary file first so a crash part way through
+// leaves the old snapshot and log in place. The snapshot records the Seq of
+// the last entry it holds, so if a crash comes between writing it and
+// emptying the log the entries aren't applied again when replayed.
+func (d *DB) Compact(snapshotPath string) error {
+	// Changes made between saving and truncating would be lost
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.wal == nil {
+		return ErrNoWAL
+	}
+
+	tmpPath := snapshotPath + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	if err := d.save(w); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, snapshotPath); err != nil {
+		return err
+	}
+
+	return d.wal.Truncate()
+}
+
+// Open loads the snapshot at snapshotPath if there is one, replays the log at
+// walPath on top of it and attaches the log so further changes are durable.
+func Open(snapshotPath, walPath string, opts WALOptions) (*DB, error) {
+	result := New()
+
+	if f, err := os.Open(snapshotPath); err == nil {
+		result, err = Load(bufio.NewReader(f))
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	wal, err := OpenWAL(walPath, opts)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := wal.Replay(result); err != nil {
+		wal.Close()
+		return nil, err
+	}
+	result.AttachWAL(wal)
+
+	return result, nil
+}
+
+// Close closes the attached log if there is one
+func (d *DB) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.wal == nil {
+		return nil
+	}
+
+	err := d.wal.Close()
+	d.wal = nil
+	return err
+}
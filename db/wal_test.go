@@ -0,0 +1,211 @@
+package db_test
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sardap/zendesk/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeChanges(t *testing.T, database *db.DB) {
+	assert.NoError(t, database.AddOrganization(db.Organization{ID: 101, Name: "Enthaze"}))
+	assert.NoError(t, database.AddUser(db.User{ID: 1, Name: "a", OrganizationID: 101}))
+	assert.NoError(t, database.AddUser(db.User{ID: 2, Name: "b", OrganizationID: 101}))
+	assert.NoError(t, database.AddTicket(db.Ticket{ID: "x", AssigneeID: 1, OrganizationID: 101}))
+	assert.NoError(t, database.UpdateUser(db.User{ID: 1, Name: "c", OrganizationID: 101}))
+	assert.NoError(t, database.DeleteUser(2))
+}
+
+func checkChanges(t *testing.T, database *db.DB) {
+	usr, err := database.GetUser(1)
+	if assert.NoError(t, err, "user 1 missing") {
+		assert.Equal(t, "c", usr.Name, "update not replayed")
+		assert.Equal(t, 2, len(usr.GetRelated(database)), "user should have org and ticket")
+	}
+	_, err = database.GetUser(2)
+	assert.ErrorIs(t, err, db.ErrNotFound, "delete not replayed")
+	org, err := database.GetOrganization(101)
+	if assert.NoError(t, err, "org missing") {
+		assert.Equal(t, 2, len(org.GetRelated(database)), "org should have user 1 and ticket")
+	}
+}
+
+func TestWALReplay(t *testing.T) {
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "zendesk.wal")
+	snapPath := filepath.Join(dir, "zendesk.snap")
+
+	for _, mode := range []db.SyncMode{db.SyncAlways, db.SyncNever} {
+		os.Remove(walPath)
+
+		database, err := db.Open(snapPath, walPath, db.WALOptions{Sync: mode})
+		assert.NoError(t, err, "error opening db")
+		writeChanges(t, database)
+		assert.NoError(t, database.Close())
+
+		recovered, err := db.Open(snapPath, walPath, db.WALOptions{Sync: mode})
+		assert.NoErrorf(t, err, "error recovering db sync %s", mode)
+		checkChanges(t, recovered)
+		recovered.Close()
+	}
+}
+
+func TestWALTornEntry(t *testing.T) {
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "zendesk.wal")
+	snapPath := filepath.Join(dir, "zendesk.snap")
+
+	database, _ := db.Open(snapPath, walPath, db.WALOptions{})
+	writeChanges(t, database)
+	database.Close()
+	info, _ := os.Stat(walPath)
+	goodSize := info.Size()
+
+	// Simulate a crash part way through writing an entry
+	database, _ = db.Open(snapPath, walPath, db.WALOptions{})
+	database.AddUser(db.User{ID: 3, Name: "torn"})
+	database.Close()
+	info, _ = os.Stat(walPath)
+	os.Truncate(walPath, goodSize+(info.Size()-goodSize)/2)
+
+	recovered, err := db.Open(snapPath, walPath, db.WALOptions{})
+	assert.NoError(t, err, "torn entry should be recovered from")
+	checkChanges(t, recovered)
+	_, err = recovered.GetUser(3)
+	assert.ErrorIs(t, err, db.ErrNotFound, "torn entry should be dropped")
+	info, _ = os.Stat(walPath)
+	assert.Equal(t, goodSize, info.Size(), "torn entry should be truncated")
+
+	// New entries go after the last good one
+	assert.NoError(t, recovered.AddUser(db.User{ID: 4, Name: "after"}))
+	recovered.Close()
+
+	recovered, err = db.Open(snapPath, walPath, db.WALOptions{})
+	assert.NoError(t, err)
+	checkChanges(t, recovered)
+	_, err = recovered.GetUser(4)
+	assert.NoError(t, err, "entry after recovery lost")
+	recovered.Close()
+
+	// Corrupt checksum on the last entry
+	info, _ = os.Stat(walPath)
+	f, _ := os.OpenFile(walPath, os.O_RDWR, 0644)
+	f.WriteAt([]byte{'!'}, info.Size()-2)
+	f.Close()
+
+	recovered, err = db.Open(snapPath, walPath, db.WALOptions{})
+	assert.NoError(t, err)
+	checkChanges(t, recovered)
+	_, err = recovered.GetUser(4)
+	assert.ErrorIs(t, err, db.ErrNotFound, "corrupt entry should be dropped")
+	recovered.Close()
+
+	// Corrupt checksum on an entry with more after it isn't a torn write
+	recovered, _ = db.Open(snapPath, walPath, db.WALOptions{})
+	assert.NoError(t, recovered.AddUser(db.User{ID: 4, Name: "after"}))
+	assert.NoError(t, recovered.AddUser(db.User{ID: 5, Name: "last"}))
+	recovered.Close()
+	before, _ := os.ReadFile(walPath)
+	f, _ = os.OpenFile(walPath, os.O_RDWR, 0644)
+	f.WriteAt([]byte{'!'}, goodSize+12)
+	f.Close()
+	corrupted, _ := os.ReadFile(walPath)
+	assert.NotEqual(t, before, corrupted)
+
+	_, err = db.Open(snapPath, walPath, db.WALOptions{})
+	assert.ErrorIs(t, err, db.ErrInvalidWAL, "corrupt middle entry should fail")
+	after, _ := os.ReadFile(walPath)
+	assert.Equal(t, corrupted, after, "log with a corrupt middle entry shouldn't be truncated")
+
+	// A length running past the end with whole entries after it isn't a torn
+	// write either
+	os.Remove(walPath)
+	database, _ = db.Open(snapPath, walPath, db.WALOptions{})
+	for id := int64(1); id <= 3; id++ {
+		assert.NoError(t, database.AddUser(db.User{ID: id}))
+	}
+	database.Close()
+	logBytes, _ := os.ReadFile(walPath)
+	// Skip the header and entry 0 to get to entry 1's length
+	second := 7 + 8 + int(binary.BigEndian.Uint32(logBytes[7:]))
+	logBytes[second] = 0x7f
+	os.WriteFile(walPath, logBytes, 0644)
+
+	_, err = db.Open(snapPath, walPath, db.WALOptions{})
+	assert.ErrorIs(t, err, db.ErrInvalidWAL, "corrupt middle length should fail")
+	after, _ = os.ReadFile(walPath)
+	assert.Equal(t, logBytes, after, "log with a corrupt middle length shouldn't be truncated")
+
+	// Not a log
+	os.WriteFile(walPath, []byte("garbage garbagehead"), 0644)
+	_, err = db.Open(snapPath, walPath, db.WALOptions{})
+	assert.ErrorIs(t, err, db.ErrInvalidWAL)
+}
+
+func TestWALCompact(t *testing.T) {
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "zendesk.wal")
+	snapPath := filepath.Join(dir, "zendesk.snap")
+
+	database, _ := db.Open(snapPath, walPath, db.WALOptions{})
+	writeChanges(t, database)
+	assert.NoError(t, database.Compact(snapPath), "error compacting")
+	info, _ := os.Stat(walPath)
+	compactedSize := info.Size()
+
+	assert.NoError(t, database.AddUser(db.User{ID: 5, Name: "after compact"}))
+	database.Close()
+
+	recovered, err := db.Open(snapPath, walPath, db.WALOptions{})
+	assert.NoError(t, err)
+	checkChanges(t, recovered)
+	_, err = recovered.GetUser(5)
+	assert.NoError(t, err, "entry after compaction lost")
+	recovered.Close()
+
+	// The snapshot on its own only has the changes up to the compaction
+	snapshotOnly, _ := db.Open(snapPath, filepath.Join(dir, "other.wal"), db.WALOptions{})
+	_, err = snapshotOnly.GetUser(5)
+	assert.ErrorIs(t, err, db.ErrNotFound, "snapshot shouldn't have entries written after compaction")
+	snapshotOnly.Close()
+
+	assert.Less(t, compactedSize, int64(20), "compacted log should only have its header")
+	assert.ErrorIs(t, db.New().Compact(snapPath), db.ErrNoWAL)
+}
+
+func TestWALCompactInterrupted(t *testing.T) {
+	dir := t.TempDir()
+	walPath := filepath.Join(dir, "zendesk.wal")
+	snapPath := filepath.Join(dir, "zendesk.snap")
+
+	database, _ := db.Open(snapPath, walPath, db.WALOptions{})
+	writeChanges(t, database)
+	versions := len(database.History(db.ResourceUser, "1"))
+
+	// A crash after the snapshot is written but before the log is emptied
+	f, _ := os.Create(snapPath)
+	assert.NoError(t, database.Save(f))
+	f.Close()
+	database.Close()
+
+	recovered, err := db.Open(snapPath, walPath, db.WALOptions{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	checkChanges(t, recovered)
+	assert.Equal(t, versions, len(recovered.History(db.ResourceUser, "1")), "entries in the snapshot replayed again")
+
+	// Entries written after carry on from the snapshot's so aren't skipped
+	assert.NoError(t, recovered.AddUser(db.User{ID: 6, Name: "after"}))
+	recovered.Close()
+	recovered, err = db.Open(snapPath, walPath, db.WALOptions{})
+	if assert.NoError(t, err) {
+		_, err = recovered.GetUser(6)
+		assert.NoError(t, err, "entry after recovery lost")
+		assert.Equal(t, versions, len(recovered.History(db.ResourceUser, "1")))
+		recovered.Close()
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	"github.com/sardap/zendesk/db"
+	"github.com/sardap/zendesk/output"
+)
+
+// Exit codes. Usage errors exit with 2 like the flag package does for flags
+// it can't parse
+const (
+	ExitOK = 0
+	// ExitFailure is for validate finding problems and anything which isn't
+	// one of the others, like being unable to write the output
+	ExitFailure   = 1
+	ExitUsage     = 2
+	ExitLoad      = 3
+	ExitQuery     = 4
+	ExitNoResults = 5
+)
+
+var (
+	ErrUsage      error
+	ErrLoad       error
+	ErrQuery      error
+	ErrNoResults  error
+	ErrValidation error
+)
+
+func init() {
+	ErrUsage = fmt.Errorf("invalid arguments")
+	ErrLoad = fmt.Errorf("unable to load data")
+	ErrQuery = fmt.Errorf("query failed")
+	ErrNoResults = fmt.Errorf("no entries found")
+	ErrValidation = fmt.Errorf("validation found problems")
+
+	// Set here since the errors are only made above
+	exitCodes = []exitCode{
+		{ErrUsage, ExitUsage, "usage"},
+		{ErrLoad, ExitLoad, "load"},
+		{ErrQuery, ExitQuery, "query"},
+		{ErrNoResults, ExitNoResults, "no_results"},
+		{ErrValidation, ExitFailure, "validation"},
+	}
+}
+
+const (
+	ErrorFormatText = "text"
+	ErrorFormatJSON = "json"
+)
+
+// Error is a failure of one of the kinds above. errors.Is matches the kind
+// as well as anything the cause matches, so a failed query can be checked
+// for db.ErrFieldMissing
+type Error struct {
+	Kind  error
+	Cause error
+}
+
+func (e *Error) Error() string {
+	if e.Cause == nil {
+		return e.Kind.Error()
+	}
+	return fmt.Sprintf("%s: %s", e.Kind, e.Cause)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Cause
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+func usageErrorf(format string, args ...interface{}) error {
+	return &Error{Kind: ErrUsage, Cause: fmt.Errorf(format, args...)}
+}
+
+type exitCode struct {
+	kind error
+	code int
+	name string
+}
+
+var exitCodes []exitCode
+
+// ExitCode is what the program exits with after err
+func ExitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+	for _, exitCode := range exitCodes {
+		if errors.Is(err, exitCode.kind) {
+			return exitCode.code
+		}
+	}
+
+	return ExitFailure
+}
+
+func kindName(err error) string {
+	for _, exitCode := range exitCodes {
+		if errors.Is(err, exitCode.kind) {
+			return exitCode.name
+		}
+	}
+
+	return "failure"
+}
+
+// Reasons given in json errors so wrappers don't have to parse the message
+var reasons = []struct {
+	err    error
+	reason string
+}{
+	{db.ErrNotFound, "not_found"},
+	{db.ErrFieldMissing, "field_missing"},
+	{db.ErrInvalidResouce, "invalid_resource"},
+	{db.ErrInvalidMatch, "invalid_match"},
+	{db.ErrInvalidConnector, "invalid_connector"},
+	{db.ErrInvalidForeignKey, "invalid_foreign_key"},
+	{db.ErrDuplicateKey, "duplicate_key"},
+	{db.ErrInvalidPolicy, "invalid_policy"},
+	{db.ErrInvalidFormat, "invalid_format"},
+	{db.ErrNotArray, "not_array"},
+	{db.ErrInvalidSnapshot, "invalid_snapshot"},
+	{db.ErrUnknownTenant, "unknown_tenant"},
+	{db.ErrTenantExists, "tenant_exists"},
+	{output.ErrUnknownFormat, "unknown_format"},
+	{output.ErrNoTemplate, "no_template"},
+	{os.ErrNotExist, "file_not_found"},
+}
+
+type errorReport struct {
+	Error struct {
+		Kind    string `json:"kind"`
+		Code    int    `json:"code"`
+		Reason  string `json:"reason,omitempty"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// WriteError describes err for a person or, with ErrorFormatJSON, for a
+// program wrapping this one
+func WriteError(w io.Writer, format string, err error) error {
+	if format != ErrorFormatJSON {
+		_, writeErr := fmt.Fprintf(w, "%s\n", err)
+		return writeErr
+	}
+
+	var report errorReport
+	report.Error.Kind = kindName(err)
+	report.Error.Code = ExitCode(err)
+	report.Error.Message = err.Error()
+	for _, reason := range reasons {
+		if errors.Is(err, reason.err) {
+			report.Error.Reason = reason.reason
+			break
+		}
+	}
+
+	return json.NewEncoder(w).Encode(report)
+}
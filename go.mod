@@ -3,7 +3,7 @@ module github.com/sardap/zendesk
 go 1.16
 
 require (
-	github.com/namsral/flag v1.7.4-pre // indirect
+	github.com/namsral/flag v1.7.4-pre
 	github.com/pkg/errors v0.9.1
 	github.com/stretchr/testify v1.7.0
 )
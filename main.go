@@ -1,65 +1,326 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"strings"
+	"text/tabwriter"
 
 	"github.com/namsral/flag"
+	"github.com/pkg/errors"
 	"github.com/sardap/zendesk/db"
+	"github.com/sardap/zendesk/output"
+)
+
+type Command string
+
+const (
+	CommandQuery    Command = "query"
+	CommandGet      Command = "get"
+	CommandFields   Command = "fields"
+	CommandStats    Command = "stats"
+	CommandValidate Command = "validate"
+	CommandSnapshot Command = "snapshot"
+	CommandDiff     Command = "diff"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Files a dataset directory given to diff holds
+const (
+	organizationsFileName = "organizations.json"
+	usersFileName         = "users.json"
+	ticketsFileName       = "tickets.json"
+	// Optional
+	groupsFileName         = "groups.json"
+	ticketCommentsFileName = "ticket_comments.json"
 )
 
 type Args struct {
+	Command Command
 	// Files
 	OrganizationsFile string
 	UsersFile         string
 	TicketsFile       string
+	// Optional files
+	GroupsFile         string
+	TicketCommentsFile string
+	// Directory holding the files by their usual names or a manifest
+	DataDir string
+	// Manifest naming the files to load instead
+	Manifest string
+	// Snapshot to load instead of the json files
+	Snapshot string
+	// Directory holding a dataset for each tenant instead of a single one
+	TenantsDir string
+	// Names or globs of the tenants in TenantsDir to use. Empty uses them all
+	Tenants []string
+	// Where the snapshot command writes to
+	SnapshotOut string
+	// Datasets the diff command compares
+	DiffBefore string
+	DiffAfter  string
+	// Output format of query results or diff
+	Format string
+	// Template the template format runs
+	Template string
+	// Include the result meta in the output
+	Meta bool
+	// How errors are written, text or json
+	ErrorFormat string
+	// Skip records which fail to load
+	Lenient bool
+	// Fail to load if any foreign keys don't resolve
+	Strict bool
+	// What to do with records which have the same id
+	Duplicates db.DuplicatePolicy
 	// Query
 	Query db.Query
+	// Resource the fields command lists. Empty lists every resource
+	Resource db.ResourceType
 }
 
+// ParseFlags parses the command line. It's either a command followed by its
+// flags and arguments like get -format table user 74, or the flags followed
+// by an optional command which runs -query when there isn't one
 func ParseFlags() (Args, error) {
-	var result Args
+	if len(os.Args) > 1 {
+		if cmd, ok := lookupCommand(Command(os.Args[1])); ok {
+			return cmd.parse(os.Args[2:])
+		}
+	}
 
-	flag.StringVar(&result.OrganizationsFile, "orgs_file", "", "path to organizations json file")
-	flag.StringVar(&result.UsersFile, "users_file", "", "path to users json file")
-	flag.StringVar(&result.TicketsFile, "tickets_file", "", "path to users json file")
-	var queryStr string
+	var result Args
+	var raw rawFlags
+	sharedFlags(flag.CommandLine, &result, &raw)
+	outputFlags(
+		flag.CommandLine, &result,
+		fmt.Sprintf("output format. query results can be %s. diff can be %s (default) or %s", queryFormats, FormatText, FormatJSON),
+	)
+	flag.StringVar(&raw.sortBy, "sort", "", "comma separated field paths to sort the results by like organization.name. prefix with - to sort descending")
+	flag.StringVar(&raw.fields, "fields", "", "comma separated field paths to list for each result like _id,assignee.email")
 	flag.StringVar(
-		&queryStr, "query", "",
+		&raw.query, "query", "",
 		fmt.Sprintf(
 			"the query to be ran. should go \"RESOURCE FIELD TARGET VALUE\" "+
 				"Example \"user name Cross Barlow\" will return the user along with any "+
 				"tickets and organization associated with said user. "+
-				"valid resoruce are %s %s and %s. Check the given json files for the field names ",
-			db.ResourceOrganization, db.ResourceUser, db.ResourceTicket,
+				"FIELD can be on a related record like \"ticket assignee.email\". "+
+				"valid resoruce are %s. Check the given json files for the field names ",
+			resourceNames(),
 		),
 	)
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s COMMAND [flags] [arguments]\n\nCommands:\n", os.Args[0])
+		tw := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+		for _, cmd := range commands {
+			fmt.Fprintf(tw, "  %s %s\t%s\n", cmd.name, cmd.args, cmd.description)
+		}
+		tw.Flush()
+		fmt.Fprintf(os.Stderr,
+			"\nRun %s COMMAND -h for the flags of each command. "+
+				"The flags can also come first, followed by %s, %s, %s OUTPUT or %s BEFORE AFTER. "+
+				"%s is run with -query if there's no command\n\n",
+			os.Args[0], CommandQuery, CommandValidate, CommandSnapshot, CommandDiff, CommandQuery,
+		)
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	if _, err := os.Stat(result.OrganizationsFile); err != nil {
-		return result, fmt.Errorf("invalid or no organizations file given")
+	if err := result.check(&raw); err != nil {
+		return result, err
 	}
-	if _, err := os.Stat(result.UsersFile); err != nil {
-		return result, fmt.Errorf("invalid or no users file given")
+
+	result.Command = Command(flag.Arg(0))
+	switch result.Command {
+	case "":
+		result.Command = CommandQuery
+	case CommandQuery, CommandValidate:
+	case CommandSnapshot:
+		result.SnapshotOut = flag.Arg(1)
+		if result.SnapshotOut == "" {
+			return result, usageErrorf("no output file given for snapshot please check -h")
+		}
+	case CommandDiff:
+		if err := checkTextFormat(CommandDiff, result.Format); err != nil {
+			return result, err
+		}
+		// The datasets are loaded from the arguments instead
+		return result, setDiffArgs(&result, flag.Arg(1), flag.Arg(2))
+	default:
+		return result, usageErrorf("invalid command %s please check -h", result.Command)
 	}
-	if _, err := os.Stat(result.TicketsFile); err != nil {
-		return result, fmt.Errorf("invalid or no tickets file given")
+
+	if err := result.checkDataset(); err != nil {
+		return result, err
 	}
 
-	// Parse query
+	if result.Command != CommandQuery {
+		return result, nil
+	}
+
+	if err := checkFormatter(result); err != nil {
+		return result, err
+	}
+	query, err := parseQuery(raw.query, &raw)
+	result.Query = query
+
+	return result, err
+}
+
+// check validates the flags every command shares
+func (a *Args) check(raw *rawFlags) error {
+	switch a.ErrorFormat {
+	case ErrorFormatText, ErrorFormatJSON:
+	default:
+		invalid := a.ErrorFormat
+		a.ErrorFormat = ErrorFormatText
+		return usageErrorf("invalid error format %s please check -h", invalid)
+	}
+
+	a.Tenants = splitList(raw.tenant)
+
+	a.Duplicates = db.DuplicatePolicy(raw.duplicates)
+	switch a.Duplicates {
+	case db.DuplicateKeepLast, db.DuplicateKeepFirst, db.DuplicateKeepNewest, db.DuplicateMerge, db.DuplicateError:
+	default:
+		return usageErrorf("invalid duplicates policy %s please check -h", raw.duplicates)
+	}
+
+	return nil
+}
+
+// files are the json files given for each resource
+func (a *Args) files() map[db.ResourceType]*string {
+	return map[db.ResourceType]*string{
+		db.ResourceOrganization:  &a.OrganizationsFile,
+		db.ResourceUser:          &a.UsersFile,
+		db.ResourceTicket:        &a.TicketsFile,
+		db.ResourceGroup:         &a.GroupsFile,
+		db.ResourceTicketComment: &a.TicketCommentsFile,
+	}
+}
+
+// checkDataset makes sure the files to load exist. Files in DataDir are
+// filled in for any not given, or its manifest is used if it has one with
+// any files given used over the ones it names
+func (a *Args) checkDataset() error {
+	if a.TenantsDir != "" || len(a.Tenants) > 0 {
+		return a.checkTenants()
+	}
+
+	givenFiles := false
+	for _, file := range a.files() {
+		givenFiles = givenFiles || *file != ""
+	}
+
+	// Each of these picks the whole dataset so the others would be ignored
+	if a.Snapshot != "" && (a.DataDir != "" || a.Manifest != "" || givenFiles) {
+		return usageErrorf("-snapshot can't be given with -data_dir, -manifest or the json files please check -h")
+	}
+	if a.DataDir != "" && a.Manifest != "" {
+		return usageErrorf("give either -data_dir or -manifest please check -h")
+	}
+
+	if a.Snapshot != "" {
+		if _, err := os.Stat(a.Snapshot); err != nil {
+			return usageErrorf("invalid snapshot file given")
+		}
+		// A snapshot is already deduplicated and holds no skipped records
+		if a.Lenient || a.Duplicates != db.DuplicateKeepLast {
+			return usageErrorf("-lenient and -duplicates only apply to json files not -snapshot please check -h")
+		}
+		return nil
+	}
+
+	fromDataDir := false
+	if a.DataDir != "" {
+		if info, err := os.Stat(a.DataDir); err != nil || !info.IsDir() {
+			return usageErrorf("invalid data directory %s given", a.DataDir)
+		}
+		if manifest, ok := dataDirManifest(a.DataDir); ok {
+			a.Manifest = manifest
+			fromDataDir = true
+		} else {
+			files := a.files()
+			for resource, path := range dataDirFiles(a.DataDir) {
+				if *files[resource] == "" {
+					*files[resource] = path
+				}
+			}
+		}
+	}
+
+	if a.Manifest != "" {
+		if givenFiles && !fromDataDir {
+			return usageErrorf("give either a manifest or the json files please check -h")
+		}
+		if _, err := os.Stat(a.Manifest); err != nil {
+			return usageErrorf("invalid manifest file given")
+		}
+		for resource, file := range a.files() {
+			if _, err := os.Stat(*file); *file != "" && err != nil {
+				return usageErrorf("invalid %s file given", resource)
+			}
+		}
+		return nil
+	}
+
+	if _, err := os.Stat(a.OrganizationsFile); err != nil {
+		return usageErrorf("invalid or no organizations file given")
+	}
+	if _, err := os.Stat(a.UsersFile); err != nil {
+		return usageErrorf("invalid or no users file given")
+	}
+	if _, err := os.Stat(a.TicketsFile); err != nil {
+		return usageErrorf("invalid or no tickets file given")
+	}
+	if _, err := os.Stat(a.GroupsFile); a.GroupsFile != "" && err != nil {
+		return usageErrorf("invalid groups file given")
+	}
+	if _, err := os.Stat(a.TicketCommentsFile); a.TicketCommentsFile != "" && err != nil {
+		return usageErrorf("invalid ticket comments file given")
+	}
+
+	return nil
+}
+
+func setDiffArgs(result *Args, before, after string) error {
+	result.DiffBefore, result.DiffAfter = before, after
+	for _, path := range []string{before, after} {
+		if _, err := os.Stat(path); path == "" || err != nil {
+			return usageErrorf("invalid or no datasets given for diff please check -h")
+		}
+	}
+
+	return nil
+}
+
+func checkFormatter(args Args) error {
+	if _, err := newFormatter(args); err != nil {
+		return &Error{Kind: ErrUsage, Cause: errors.Wrap(err, "please check -h")}
+	}
+
+	return nil
+}
+
+// parseQuery parses a query like "user name Cross Barlow"
+func parseQuery(queryStr string, raw *rawFlags) (db.Query, error) {
 	splits := strings.SplitN(queryStr, " ", 3)
 	if len(splits) != 3 {
-		return result, fmt.Errorf("invalid query string please check -h")
+		return db.Query{}, usageErrorf("invalid query string please check -h")
 	}
 
-	var resource db.ResourceType
-	switch db.ResourceType(splits[0]) {
-	case db.ResourceOrganization, db.ResourceUser, db.ResourceTicket:
-		resource = db.ResourceType(splits[0])
-	default:
-		return result, fmt.Errorf("invalid resource given in query please check -h")
+	resource := db.ResourceType(splits[0])
+	if _, err := db.LookupResource(resource); err != nil {
+		return db.Query{}, &Error{Kind: ErrUsage, Cause: errors.Wrap(err, "invalid resource given in query please check -h")}
 	}
 
 	var cond db.Condition
@@ -79,61 +340,314 @@ func ParseFlags() (Args, error) {
 		}
 	}
 
-	result.Query = db.Query{
+	return db.Query{
 		Conditions: []db.Condition{cond},
+		SortBy:     splitList(raw.sortBy),
+		Fields:     splitList(raw.fields),
+	}, nil
+}
+
+// newFormatter creates the formatter for query results
+func newFormatter(args Args) (output.Formatter, error) {
+	format := args.Format
+	if format == "" {
+		format = output.FormatJSON
 	}
 
-	return result, nil
+	return output.New(format, output.Options{Template: args.Template})
+}
+
+// splitList splits a comma separated flag
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+
+	var result []string
+	for _, item := range strings.Split(value, ",") {
+		result = append(result, strings.TrimSpace(item))
+	}
+	return result
+}
+
+// resourceNames lists the registered resources for the help text
+func resourceNames() string {
+	var names []string
+	for _, resource := range db.Resources() {
+		names = append(names, string(resource))
+	}
+
+	return strings.Join(names, ", ")
 }
 
-func createDB(args Args) *db.DB {
-	orgsF, err := os.Open(args.OrganizationsFile)
+// loadSnapshot loads a snapshot, failing like the json files would if
+// -strict is set and any foreign keys don't resolve
+func loadSnapshot(path string, args Args) (*db.DB, error) {
+	snapF, err := os.Open(path)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer orgsF.Close()
+	defer snapF.Close()
 
-	usersF, err := os.Open(args.UsersFile)
+	return db.LoadWithOptions(bufio.NewReader(snapF), db.LoadOptions{Strict: args.Strict})
+}
+
+// loadFiles loads each resource from its file. Resources without a path are
+// left empty
+func loadFiles(paths map[db.ResourceType]string, args Args) (*db.DB, error) {
+	readers := make(map[db.ResourceType]io.Reader)
+	for resource, path := range paths {
+		if path == "" {
+			continue
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		readers[resource] = f
+	}
+
+	var report db.LoadReport
+	result, err := db.CreateResources(readers, loadOptions(args, &report))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	defer usersF.Close()
+	writeLoadReport(&report)
+
+	return result, nil
+}
 
-	ticketsF, err := os.Open(args.TicketsFile)
+// loadManifest loads every file the manifest names into one DB. A resource
+// in overrides is loaded from that file instead of its shards
+func loadManifest(path string, overrides map[db.ResourceType]string, args Args) (*db.DB, error) {
+	manifest, err := db.ReadManifest(path)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	for resource, file := range overrides {
+		// Shard paths are relative to the manifest but files given are
+		// relative to where we're run
+		absPath, err := filepath.Abs(file)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Resources[resource] = []db.Shard{{Path: absPath}}
 	}
-	defer ticketsF.Close()
 
-	result, err := db.Create(orgsF, usersF, ticketsF)
+	var report db.LoadReport
+	result, err := db.CreateFromManifest(manifest, loadOptions(args, &report))
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	writeLoadReport(&report)
+
+	return result, nil
+}
+
+func loadOptions(args Args, report *db.LoadReport) db.LoadOptions {
+	return db.LoadOptions{
+		Lenient:    args.Lenient,
+		Report:     report,
+		Strict:     args.Strict,
+		Duplicates: args.Duplicates,
+	}
+}
+
+func writeLoadReport(report *db.LoadReport) {
+	if len(report.Skipped) > 0 || len(report.Duplicates) > 0 {
+		report.Write(os.Stderr)
+	}
+}
+
+// dataDirFiles are the files in a dataset directory by their usual names.
+// The optional ones are left out if they don't exist
+func dataDirFiles(dir string) map[db.ResourceType]string {
+	result := map[db.ResourceType]string{
+		db.ResourceOrganization: filepath.Join(dir, organizationsFileName),
+		db.ResourceUser:         filepath.Join(dir, usersFileName),
+		db.ResourceTicket:       filepath.Join(dir, ticketsFileName),
+	}
+	optional := map[db.ResourceType]string{
+		db.ResourceGroup:         filepath.Join(dir, groupsFileName),
+		db.ResourceTicketComment: filepath.Join(dir, ticketCommentsFileName),
+	}
+	for resource, optionalPath := range optional {
+		if _, err := os.Stat(optionalPath); err == nil {
+			result[resource] = optionalPath
+		}
 	}
 
 	return result
 }
 
-func main() {
-	if len(os.Args) == 0 {
-		fmt.Printf("Missing arugments try -h\n")
-		os.Exit(0)
+// dataDirManifest is the manifest in a dataset directory if it has one
+func dataDirManifest(dir string) (string, bool) {
+	path := filepath.Join(dir, db.ManifestFileName)
+	_, err := os.Stat(path)
+
+	return path, err == nil
+}
+
+// loadDataset loads a snapshot or a directory of json files
+func loadDataset(path string, args Args) (*db.DB, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return loadSnapshot(path, args)
+	}
+	if manifest, ok := dataDirManifest(path); ok {
+		return loadManifest(manifest, nil, args)
 	}
 
-	args, err := ParseFlags()
+	return loadFiles(dataDirFiles(path), args)
+}
+
+// createDB loads the snapshot or files given in args
+func createDB(args Args) (*db.DB, error) {
+	var result *db.DB
+	var err error
+	switch {
+	case args.Snapshot != "":
+		result, err = loadSnapshot(args.Snapshot, args)
+	case args.Manifest != "":
+		overrides := make(map[db.ResourceType]string)
+		for resource, file := range args.files() {
+			if *file != "" {
+				overrides[resource] = *file
+			}
+		}
+		result, err = loadManifest(args.Manifest, overrides, args)
+	default:
+		result, err = loadFiles(map[db.ResourceType]string{
+			db.ResourceOrganization:  args.OrganizationsFile,
+			db.ResourceUser:          args.UsersFile,
+			db.ResourceTicket:        args.TicketsFile,
+			db.ResourceGroup:         args.GroupsFile,
+			db.ResourceTicketComment: args.TicketCommentsFile,
+		}, args)
+	}
 	if err != nil {
-		panic(err)
+		return nil, &Error{Kind: ErrLoad, Cause: err}
 	}
 
-	database := createDB(args)
+	return result, nil
+}
+
+func diff(args Args, stdout io.Writer) error {
+	before, err := loadDataset(args.DiffBefore, args)
+	if err != nil {
+		return &Error{Kind: ErrLoad, Cause: errors.Wrap(err, args.DiffBefore)}
+	}
+	after, err := loadDataset(args.DiffAfter, args)
+	if err != nil {
+		return &Error{Kind: ErrLoad, Cause: errors.Wrap(err, args.DiffAfter)}
+	}
+
+	report, err := db.Diff(before, after)
+	if err != nil {
+		return err
+	}
+
+	if args.Format == FormatJSON {
+		jsonBytes, _ := json.MarshalIndent(report, "", "\t")
+		_, err := fmt.Fprintf(stdout, "%s\n", jsonBytes)
+		return err
+	}
+	return report.Write(stdout)
+}
+
+func writeSnapshot(database *db.DB, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	if err := database.Save(w); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// Run carries out the command in args writing the results to stdout. The
+// error says which exit code to use, see ExitCode
+func Run(args Args, stdout io.Writer) error {
+	switch args.Command {
+	case CommandDiff:
+		return diff(args, stdout)
+	case CommandFields:
+		return listFields(args, stdout)
+	}
+
+	if args.TenantsDir != "" {
+		return runTenants(args, stdout)
+	}
+
+	database, err := createDB(args)
+	if err != nil {
+		return err
+	}
+
+	switch args.Command {
+	case CommandStats:
+		return printStats(database, args, stdout)
+	case CommandValidate:
+		report := database.Validate()
+		if args.Format == FormatJSON {
+			jsonBytes, _ := json.MarshalIndent(report, "", "\t")
+			if _, err := fmt.Fprintf(stdout, "%s\n", jsonBytes); err != nil {
+				return err
+			}
+		} else if err := report.Write(stdout); err != nil {
+			return err
+		}
+		if !report.OK() {
+			return ErrValidation
+		}
+		return nil
+	case CommandSnapshot:
+		return writeSnapshot(database, args.SnapshotOut)
+	}
 
 	result, err := args.Query.Resolve(database)
+	if errors.Is(err, db.ErrNotFound) {
+		return &Error{Kind: ErrNoResults, Cause: err}
+	}
 	if err != nil {
-		panic(err)
+		return &Error{Kind: ErrQuery, Cause: err}
 	}
 	if len(result.Target) <= 0 {
-		fmt.Printf("No entires found\n")
-		os.Exit(0)
+		return ErrNoResults
+	}
+	if !args.Meta {
+		result.Meta = nil
 	}
-	jsonBytes, _ := json.MarshalIndent(result, "", "\t")
-	fmt.Printf("%s\n", jsonBytes)
+	formatter, err := newFormatter(args)
+	if err != nil {
+		return &Error{Kind: ErrUsage, Cause: err}
+	}
+
+	return formatter.Format(stdout, result)
+}
+
+func main() {
+	args, err := ParseFlags()
+	if err == nil {
+		err = Run(args, os.Stdout)
+	}
+	// The usage has already been printed for -h
+	if err != nil && !errors.Is(err, flag.ErrHelp) {
+		WriteError(os.Stderr, args.ErrorFormat, err)
+	}
+
+	os.Exit(ExitCode(err))
 }
@@ -1,6 +1,9 @@
 package main_test
 
 import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
 	"os"
 	"testing"
 
@@ -14,6 +17,14 @@ func init() {
 	os.Mkdir("testdata", os.ModeDir)
 }
 
+// setArgs replaces the command line args so go test's args aren't taken as
+// the command. Call the returned function to put them back
+func setArgs(args ...string) func() {
+	oldArgs := os.Args
+	os.Args = append([]string{"zendesk"}, args...)
+	return func() { os.Args = oldArgs }
+}
+
 func TestParseArgsFullMatch(t *testing.T) {
 	// This is to prevent flag parsed twice error
 	flag.CommandLine = flag.NewFlagSet("", flag.ExitOnError)
@@ -35,13 +46,17 @@ func TestParseArgsFullMatch(t *testing.T) {
 	defer os.Unsetenv("TICKETS_FILE")
 	os.Setenv("QUERY", "user name test")
 	defer os.Unsetenv("QUERY")
+	defer setArgs()()
 
 	args, err := zendesk.ParseFlags()
 	assert.NoError(t, err)
 	expectedArgs := zendesk.Args{
+		Command:           zendesk.CommandQuery,
 		OrganizationsFile: "testdata/orgs.json",
 		UsersFile:         "testdata/users.json",
 		TicketsFile:       "testdata/tickets.json",
+		Duplicates:        db.DuplicateKeepLast,
+		ErrorFormat:       zendesk.ErrorFormatText,
 		Query: db.Query{
 			Conditions: []db.Condition{
 				&db.FulLMatchCondition{
@@ -77,13 +92,17 @@ func TestParseArgsIdMatch(t *testing.T) {
 	defer os.Unsetenv("TICKETS_FILE")
 	os.Setenv("QUERY", "user id 100")
 	defer os.Unsetenv("QUERY")
+	defer setArgs()()
 
 	args, err := zendesk.ParseFlags()
 	assert.NoError(t, err)
 	expectedArgs := zendesk.Args{
+		Command:           zendesk.CommandQuery,
 		OrganizationsFile: "testdata/orgs.json",
 		UsersFile:         "testdata/users.json",
 		TicketsFile:       "testdata/tickets.json",
+		Duplicates:        db.DuplicateKeepLast,
+		ErrorFormat:       zendesk.ErrorFormatText,
 		Query: db.Query{
 			Conditions: []db.Condition{
 				&db.IDMatchCondition{
@@ -95,3 +114,616 @@ func TestParseArgsIdMatch(t *testing.T) {
 	}
 	assert.Equal(t, expectedArgs, args)
 }
+
+func TestParseArgsRelatedPaths(t *testing.T) {
+	// This is to prevent flag parsed twice error
+	flag.CommandLine = flag.NewFlagSet("", flag.ExitOnError)
+
+	// Setup files
+	os.Create("testdata/orgs.json")
+	defer os.Remove("testdata/orgs.json")
+	os.Create("testdata/users.json")
+	defer os.Remove("testdata/users.json")
+	os.Create("testdata/tickets.json")
+	defer os.Remove("testdata/tickets.json")
+
+	defer setArgs(
+		"-orgs_file", "testdata/orgs.json",
+		"-users_file", "testdata/users.json",
+		"-tickets_file", "testdata/tickets.json",
+		"-query", "ticket organization.name Enthaze",
+		"-sort", "-assignee.name, created_at",
+		"-fields", "_id,assignee.email",
+	)()
+
+	args, err := zendesk.ParseFlags()
+	assert.NoError(t, err)
+	assert.Equal(t, db.Query{
+		Conditions: []db.Condition{
+			&db.FulLMatchCondition{
+				Resource:  db.ResourceTicket,
+				Connector: db.ConnectorTypeUnion,
+				Field:     "organization.name",
+				Match:     "Enthaze",
+			},
+		},
+		SortBy: []string{"-assignee.name", "created_at"},
+		Fields: []string{"_id", "assignee.email"},
+	}, args.Query)
+}
+
+func TestParseArgsFormat(t *testing.T) {
+	// Setup files
+	os.Create("testdata/orgs.json")
+	defer os.Remove("testdata/orgs.json")
+	os.Create("testdata/users.json")
+	defer os.Remove("testdata/users.json")
+	os.Create("testdata/tickets.json")
+	defer os.Remove("testdata/tickets.json")
+
+	testCases := []struct {
+		args  []string
+		valid bool
+	}{
+		{[]string{"-format", "table"}, true},
+		{[]string{"-format", "yaml"}, true},
+		{[]string{"-format", "template", "-template", "{{len .Target}}"}, true},
+		{[]string{"-format", "template"}, false},
+		{[]string{"-format", "xml"}, false},
+		// diff only
+		{[]string{"-format", "text"}, false},
+	}
+	for _, testCase := range testCases {
+		// This is to prevent flag parsed twice error
+		flag.CommandLine = flag.NewFlagSet("", flag.ExitOnError)
+		restore := setArgs(append([]string{
+			"-orgs_file", "testdata/orgs.json",
+			"-users_file", "testdata/users.json",
+			"-tickets_file", "testdata/tickets.json",
+			"-query", "user name test",
+		}, testCase.args...)...)
+
+		args, err := zendesk.ParseFlags()
+		restore()
+		if testCase.valid {
+			assert.NoErrorf(t, err, "%v", testCase.args)
+			assert.Equal(t, testCase.args[1], args.Format)
+		} else {
+			assert.Errorf(t, err, "%v", testCase.args)
+		}
+	}
+}
+
+func TestParseArgsValidate(t *testing.T) {
+	// This is to prevent flag parsed twice error
+	flag.CommandLine = flag.NewFlagSet("", flag.ExitOnError)
+
+	// Setup files
+	os.Create("testdata/orgs.json")
+	defer os.Remove("testdata/orgs.json")
+	os.Create("testdata/users.json")
+	defer os.Remove("testdata/users.json")
+	os.Create("testdata/tickets.json")
+	defer os.Remove("testdata/tickets.json")
+
+	os.Setenv("ORGS_FILE", "testdata/orgs.json")
+	defer os.Unsetenv("ORGS_FILE")
+	os.Setenv("USERS_FILE", "testdata/users.json")
+	defer os.Unsetenv("USERS_FILE")
+	os.Setenv("TICKETS_FILE", "testdata/tickets.json")
+	defer os.Unsetenv("TICKETS_FILE")
+
+	defer setArgs("-strict", "validate")()
+
+	args, err := zendesk.ParseFlags()
+	assert.NoError(t, err)
+	expectedArgs := zendesk.Args{
+		Command:           zendesk.CommandValidate,
+		OrganizationsFile: "testdata/orgs.json",
+		UsersFile:         "testdata/users.json",
+		TicketsFile:       "testdata/tickets.json",
+		Duplicates:        db.DuplicateKeepLast,
+		ErrorFormat:       zendesk.ErrorFormatText,
+		Strict:            true,
+	}
+	assert.Equal(t, expectedArgs, args)
+
+	// Unknown command
+	flag.CommandLine = flag.NewFlagSet("", flag.ExitOnError)
+	defer setArgs("garbage")()
+	_, err = zendesk.ParseFlags()
+	assert.Error(t, err)
+}
+
+func TestParseArgsSnapshot(t *testing.T) {
+	// This is to prevent flag parsed twice error
+	flag.CommandLine = flag.NewFlagSet("", flag.ExitOnError)
+
+	os.Create("testdata/data.snap")
+	defer os.Remove("testdata/data.snap")
+
+	os.Setenv("ZENDESK_SNAPSHOT", "testdata/data.snap")
+	defer os.Unsetenv("ZENDESK_SNAPSHOT")
+	defer setArgs("snapshot", "testdata/out.snap")()
+
+	args, err := zendesk.ParseFlags()
+	assert.NoError(t, err)
+	expectedArgs := zendesk.Args{
+		Command:     zendesk.CommandSnapshot,
+		Snapshot:    "testdata/data.snap",
+		SnapshotOut: "testdata/out.snap",
+		Duplicates:  db.DuplicateKeepLast,
+		ErrorFormat: zendesk.ErrorFormatText,
+	}
+	assert.Equal(t, expectedArgs, args)
+
+	// Missing output
+	flag.CommandLine = flag.NewFlagSet("", flag.ExitOnError)
+	defer setArgs("snapshot")()
+	_, err = zendesk.ParseFlags()
+	assert.Error(t, err)
+}
+
+func TestRunSnapshotStrict(t *testing.T) {
+	database := db.New()
+	database.AddUser(db.User{ID: 1, OrganizationID: 999})
+	f, err := os.Create("testdata/dangling.snap")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.Remove("testdata/dangling.snap")
+	assert.NoError(t, database.Save(f))
+	f.Close()
+
+	args := zendesk.Args{
+		Command:     zendesk.CommandStats,
+		Snapshot:    "testdata/dangling.snap",
+		Duplicates:  db.DuplicateKeepLast,
+		ErrorFormat: zendesk.ErrorFormatText,
+	}
+	assert.NoError(t, zendesk.Run(args, ioutil.Discard))
+	args.Strict = true
+	err = zendesk.Run(args, ioutil.Discard)
+	assert.ErrorIs(t, err, zendesk.ErrLoad)
+	assert.ErrorIs(t, err, db.ErrInvalidForeignKey)
+
+	for _, arguments := range [][]string{
+		{"-snapshot", "testdata/dangling.snap", "-lenient", "stats"},
+		{"-snapshot", "testdata/dangling.snap", "-duplicates", "merge", "stats"},
+	} {
+		flag.CommandLine = flag.NewFlagSet("", flag.ExitOnError)
+		restore := setArgs(arguments...)
+		_, err = zendesk.ParseFlags()
+		restore()
+		assert.ErrorIs(t, err, zendesk.ErrUsage, arguments)
+	}
+}
+
+func TestParseArgsDiff(t *testing.T) {
+	// This is to prevent flag parsed twice error
+	flag.CommandLine = flag.NewFlagSet("", flag.ExitOnError)
+
+	os.Create("testdata/before.snap")
+	defer os.Remove("testdata/before.snap")
+	os.Create("testdata/after.snap")
+	defer os.Remove("testdata/after.snap")
+
+	defer setArgs("-format", "json", "diff", "testdata/before.snap", "testdata/after.snap")()
+
+	args, err := zendesk.ParseFlags()
+	assert.NoError(t, err)
+	expectedArgs := zendesk.Args{
+		Command:     zendesk.CommandDiff,
+		DiffBefore:  "testdata/before.snap",
+		DiffAfter:   "testdata/after.snap",
+		Format:      zendesk.FormatJSON,
+		Duplicates:  db.DuplicateKeepLast,
+		ErrorFormat: zendesk.ErrorFormatText,
+	}
+	assert.Equal(t, expectedArgs, args)
+
+	// Missing after
+	flag.CommandLine = flag.NewFlagSet("", flag.ExitOnError)
+	defer setArgs("diff", "testdata/before.snap")()
+	_, err = zendesk.ParseFlags()
+	assert.Error(t, err)
+
+	// Bad format
+	flag.CommandLine = flag.NewFlagSet("", flag.ExitOnError)
+	defer setArgs("-format", "garbage", "diff", "testdata/before.snap", "testdata/after.snap")()
+	_, err = zendesk.ParseFlags()
+	assert.Error(t, err)
+}
+
+func TestRunErrors(t *testing.T) {
+	files := zendesk.Args{
+		Command:           zendesk.CommandQuery,
+		OrganizationsFile: "db/db_testdata/organizations.json",
+		UsersFile:         "db/db_testdata/users.json",
+		TicketsFile:       "db/db_testdata/tickets.json",
+		Duplicates:        db.DuplicateKeepLast,
+	}
+	userQuery := func(cond db.Condition) zendesk.Args {
+		args := files
+		args.Query = db.Query{Conditions: []db.Condition{cond}}
+		return args
+	}
+	nameMatch := func(field, match string) db.Condition {
+		return &db.FulLMatchCondition{Resource: db.ResourceUser, Connector: db.ConnectorTypeUnion, Field: field, Match: match}
+	}
+	missingFile := userQuery(nameMatch("name", "Francisca Rasmussen"))
+	missingFile.UsersFile = "testdata/missing.json"
+
+	testCases := []struct {
+		args  zendesk.Args
+		kind  error
+		cause error
+		code  int
+	}{
+		{userQuery(nameMatch("name", "Francisca Rasmussen")), nil, nil, zendesk.ExitOK},
+		{userQuery(nameMatch("name", "Nobody At All")), zendesk.ErrNoResults, nil, zendesk.ExitNoResults},
+		{userQuery(&db.IDMatchCondition{Resource: db.ResourceUser, Target: "9999"}), zendesk.ErrNoResults, db.ErrNotFound, zendesk.ExitNoResults},
+		{userQuery(&db.IDMatchCondition{Resource: db.ResourceUser, Target: "one"}), zendesk.ErrQuery, db.ErrInvalidMatch, zendesk.ExitQuery},
+		{userQuery(nameMatch("garbage", "test")), zendesk.ErrQuery, db.ErrFieldMissing, zendesk.ExitQuery},
+		{missingFile, zendesk.ErrLoad, os.ErrNotExist, zendesk.ExitLoad},
+	}
+	for i, testCase := range testCases {
+		var stdout bytes.Buffer
+		err := zendesk.Run(testCase.args, &stdout)
+		assert.Equalf(t, testCase.code, zendesk.ExitCode(err), "case %d: %v", i, err)
+		if testCase.kind == nil {
+			assert.NoErrorf(t, err, "case %d", i)
+			assert.NotEmptyf(t, stdout.String(), "case %d", i)
+			continue
+		}
+		assert.ErrorIsf(t, err, testCase.kind, "case %d", i)
+		if testCase.cause != nil {
+			assert.ErrorIsf(t, err, testCase.cause, "case %d", i)
+		}
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	err := zendesk.Run(zendesk.Args{
+		Command:           zendesk.CommandQuery,
+		OrganizationsFile: "db/db_testdata/organizations.json",
+		UsersFile:         "db/db_testdata/users.json",
+		TicketsFile:       "db/db_testdata/tickets.json",
+		Query: db.Query{Conditions: []db.Condition{&db.FulLMatchCondition{
+			Resource: db.ResourceUser, Connector: db.ConnectorTypeUnion, Field: "garbage", Match: "test",
+		}}},
+	}, ioutil.Discard)
+
+	var buf bytes.Buffer
+	assert.NoError(t, zendesk.WriteError(&buf, zendesk.ErrorFormatJSON, err))
+	var report struct {
+		Error struct {
+			Kind    string `json:"kind"`
+			Code    int    `json:"code"`
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &report))
+	assert.Equal(t, "query", report.Error.Kind)
+	assert.Equal(t, zendesk.ExitQuery, report.Error.Code)
+	assert.Equal(t, "field_missing", report.Error.Reason)
+	assert.Equal(t, err.Error(), report.Error.Message)
+
+	buf.Reset()
+	assert.NoError(t, zendesk.WriteError(&buf, zendesk.ErrorFormatText, err))
+	assert.Equal(t, err.Error()+"\n", buf.String())
+
+	// Bad arguments
+	flag.CommandLine = flag.NewFlagSet("", flag.ExitOnError)
+	restore := setArgs("-error_format", "xml")
+	_, err = zendesk.ParseFlags()
+	restore()
+	assert.ErrorIs(t, err, zendesk.ErrUsage)
+	assert.Equal(t, zendesk.ExitUsage, zendesk.ExitCode(err))
+
+	flag.CommandLine = flag.NewFlagSet("", flag.ExitOnError)
+	restore = setArgs(
+		"-orgs_file", "db/db_testdata/organizations.json",
+		"-users_file", "db/db_testdata/users.json",
+		"-tickets_file", "db/db_testdata/tickets.json",
+		"-query", "garbage name test",
+	)
+	_, err = zendesk.ParseFlags()
+	restore()
+	assert.ErrorIs(t, err, zendesk.ErrUsage)
+	assert.ErrorIs(t, err, db.ErrInvalidResouce)
+
+	// Unknown command flags are reported like any other error
+	restore = setArgs("get", "-error_format", "json", "-garbage", "organization", "101")
+	args, err := zendesk.ParseFlags()
+	restore()
+	assert.ErrorIs(t, err, zendesk.ErrUsage)
+	assert.Equal(t, zendesk.ExitUsage, zendesk.ExitCode(err))
+	buf.Reset()
+	assert.NoError(t, zendesk.WriteError(&buf, args.ErrorFormat, err))
+	if assert.NoError(t, json.Unmarshal(buf.Bytes(), &report)) {
+		assert.Equal(t, "usage", report.Error.Kind)
+		assert.Equal(t, zendesk.ExitUsage, report.Error.Code)
+		assert.Contains(t, report.Error.Message, "-garbage")
+	}
+}
+
+func TestParseCommands(t *testing.T) {
+	dataset := []string{
+		"-orgs_file", "db/db_testdata/organizations.json",
+		"-users_file", "db/db_testdata/users.json",
+		"-tickets_file", "db/db_testdata/tickets.json",
+	}
+	withDataset := func(command string, args ...string) []string {
+		return append(append([]string{command}, dataset...), args...)
+	}
+
+	testCases := []struct {
+		args     []string
+		valid    bool
+		expected func(t *testing.T, args zendesk.Args)
+	}{
+		{withDataset("get", "-format", "table", "user", "74"), true, func(t *testing.T, args zendesk.Args) {
+			assert.Equal(t, zendesk.CommandGet, args.Command)
+			assert.Equal(t, "table", args.Format)
+			assert.Equal(t, []db.Condition{&db.IDMatchCondition{Resource: db.ResourceUser, Target: "74"}}, args.Query.Conditions)
+		}},
+		{withDataset("query", "-sort", "-name", "user", "name", "Cross", "Barlow"), true, func(t *testing.T, args zendesk.Args) {
+			assert.Equal(t, zendesk.CommandQuery, args.Command)
+			assert.Equal(t, []string{"-name"}, args.Query.SortBy)
+			assert.Equal(t, []db.Condition{&db.FulLMatchCondition{
+				Resource: db.ResourceUser, Connector: db.ConnectorTypeUnion, Field: "name", Match: "Cross Barlow",
+			}}, args.Query.Conditions)
+		}},
+		{[]string{"fields", "ticket"}, true, func(t *testing.T, args zendesk.Args) {
+			assert.Equal(t, zendesk.CommandFields, args.Command)
+			assert.Equal(t, db.ResourceTicket, args.Resource)
+		}},
+		{[]string{"fields"}, true, nil},
+		{withDataset("stats", "-format", "json"), true, nil},
+		{withDataset("validate"), true, nil},
+		{withDataset("get", "user"), false, nil},
+		{withDataset("get", "garbage", "1"), false, nil},
+		{withDataset("query", "user", "name"), false, nil},
+		{withDataset("stats", "extra"), false, nil},
+		{withDataset("stats", "-format", "table"), false, nil},
+		{[]string{"fields", "garbage"}, false, nil},
+		{[]string{"stats"}, false, nil},
+	}
+	for _, testCase := range testCases {
+		restore := setArgs(testCase.args...)
+		args, err := zendesk.ParseFlags()
+		restore()
+		if !testCase.valid {
+			assert.ErrorIsf(t, err, zendesk.ErrUsage, "%v", testCase.args)
+			continue
+		}
+		if assert.NoErrorf(t, err, "%v", testCase.args) && testCase.expected != nil {
+			testCase.expected(t, args)
+		}
+	}
+
+	// Shared flags from a config file
+	config := "testdata/zendesk.conf"
+	assert.NoError(t, ioutil.WriteFile(config, []byte(""+
+		"# dataset\n"+
+		"orgs_file db/db_testdata/organizations.json\n"+
+		"users_file=db/db_testdata/users.json\n"+
+		"tickets_file db/db_testdata/tickets.json\n"+
+		"lenient\n",
+	), 0644))
+	defer os.Remove(config)
+	restore := setArgs("get", "-config", config, "-users_file", "testdata/missing.json", "user", "1")
+	_, err := zendesk.ParseFlags()
+	restore()
+	assert.ErrorIs(t, err, zendesk.ErrUsage, "flags take precedence over the config file")
+
+	restore = setArgs("get", "-config", config, "user", "1")
+	args, err := zendesk.ParseFlags()
+	restore()
+	assert.NoError(t, err)
+	assert.Equal(t, "db/db_testdata/users.json", args.UsersFile)
+	assert.True(t, args.Lenient)
+
+	// Only prefixed environment variables are read
+	os.Setenv("FORMAT", "garbage")
+	defer os.Unsetenv("FORMAT")
+	os.Setenv("ZENDESK_USERS_FILE", "testdata/missing.json")
+	defer os.Unsetenv("ZENDESK_USERS_FILE")
+	os.Setenv("ZENDESK_SORT", "-name")
+	defer os.Unsetenv("ZENDESK_SORT")
+	restore = setArgs("query", "-config", config, "user", "name", "Cross Barlow")
+	_, err = zendesk.ParseFlags()
+	restore()
+	assert.ErrorIs(t, err, zendesk.ErrUsage, "the environment takes precedence over the config file")
+	os.Unsetenv("ZENDESK_USERS_FILE")
+	restore = setArgs("query", "-config", config, "user", "name", "Cross Barlow")
+	args, err = zendesk.ParseFlags()
+	restore()
+	if assert.NoError(t, err, "FORMAT isn't read") {
+		assert.Equal(t, "", args.Format)
+		assert.Equal(t, []string{"-name"}, args.Query.SortBy)
+	}
+}
+
+func TestRunCommands(t *testing.T) {
+	var stdout bytes.Buffer
+	assert.NoError(t, zendesk.Run(zendesk.Args{Command: zendesk.CommandFields, Resource: db.ResourceUser}, &stdout))
+	assert.Contains(t, stdout.String(), "organization_id    int\n")
+	assert.Contains(t, stdout.String(), "organization.*     relation to organization\n")
+
+	stdout.Reset()
+	assert.NoError(t, zendesk.Run(zendesk.Args{Command: zendesk.CommandFields, Format: zendesk.FormatJSON}, &stdout))
+	var fields []struct {
+		Resource db.ResourceType `json:"resource"`
+	}
+	assert.NoError(t, json.Unmarshal(stdout.Bytes(), &fields))
+	assert.Equal(t, len(db.Resources()), len(fields))
+
+	stdout.Reset()
+	err := zendesk.Run(zendesk.Args{
+		Command:           zendesk.CommandStats,
+		OrganizationsFile: "db/db_testdata/organizations.json",
+		UsersFile:         "db/db_testdata/users.json",
+		TicketsFile:       "db/db_testdata/tickets.json",
+		Format:            zendesk.FormatJSON,
+	}, &stdout)
+	assert.NoError(t, err)
+	var stats db.Stats
+	assert.NoError(t, json.Unmarshal(stdout.Bytes(), &stats))
+	assert.Equal(t, 300, stats.Records)
+	if assert.NotEmpty(t, stats.Resources) {
+		assert.Equal(t, db.ResourceStats{Resource: db.ResourceOrganization, Records: 25}, stats.Resources[0])
+	}
+	assert.Equal(t, 3, len(stats.Sources))
+}
+
+func TestParseArgsDataDir(t *testing.T) {
+	restore := setArgs("stats", "-data_dir", "db/db_testdata", "-users_file", "db/db_testdata/user.json")
+	args, err := zendesk.ParseFlags()
+	restore()
+	assert.NoError(t, err)
+	assert.Equal(t, "db/db_testdata/organizations.json", args.OrganizationsFile)
+	assert.Equal(t, "db/db_testdata/user.json", args.UsersFile, "flags are used over the directory")
+	assert.Equal(t, "db/db_testdata/tickets.json", args.TicketsFile)
+	assert.Empty(t, args.GroupsFile, "optional files are only used if they exist")
+
+	restore = setArgs("stats", "-data_dir", "testdata/missing")
+	_, err = zendesk.ParseFlags()
+	restore()
+	assert.ErrorIs(t, err, zendesk.ErrUsage)
+
+	// A manifest in the directory is used instead
+	dir, err := ioutil.TempDir("", "data_dir")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	manifest := `{"resources": {"organization": [{"path": "` + wd + `/db/db_testdata/organizations.json"}]}}`
+	assert.NoError(t, ioutil.WriteFile(dir+"/"+db.ManifestFileName, []byte(manifest), 0644))
+
+	restore = setArgs("get", "-data_dir", dir, "-fields", "_id,name", "-format", "csv", "organization", "101")
+	args, err = zendesk.ParseFlags()
+	restore()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, dir+"/"+db.ManifestFileName, args.Manifest)
+	var stdout bytes.Buffer
+	assert.NoError(t, zendesk.Run(args, &stdout))
+	assert.Equal(t, "_id,name\n101,Enthaze\n", stdout.String())
+
+	// Files given are used over the ones the directory's manifest names
+	restore = setArgs("get", "-data_dir", dir, "-users_file", "db/db_testdata/users.json", "-fields", "_id,name", "-format", "csv", "user", "1")
+	args, err = zendesk.ParseFlags()
+	restore()
+	if assert.NoError(t, err) {
+		stdout.Reset()
+		assert.NoError(t, zendesk.Run(args, &stdout))
+		assert.Equal(t, "_id,name\n1,Francisca Rasmussen\n", stdout.String())
+	}
+
+	restore = setArgs("get", "-data_dir", dir, "-users_file", "testdata/missing.json", "user", "1")
+	_, err = zendesk.ParseFlags()
+	restore()
+	assert.ErrorIs(t, err, zendesk.ErrUsage)
+
+	restore = setArgs("get", "-manifest", args.Manifest, "-orgs_file", "db/db_testdata/organizations.json", "organization", "101")
+	_, err = zendesk.ParseFlags()
+	restore()
+	assert.ErrorIs(t, err, zendesk.ErrUsage, "a manifest and files can't both be given")
+
+	// Flags which pick the whole dataset can't be mixed
+	snapPath := dir + "/dataset.snap"
+	assert.NoError(t, ioutil.WriteFile(snapPath, []byte("ZDSNAP"), 0644))
+	mixed := [][]string{
+		{"-data_dir", dir, "-manifest", dir + "/" + db.ManifestFileName},
+		{"-data_dir", "db/db_testdata", "-manifest", dir + "/" + db.ManifestFileName},
+		{"-data_dir", dir, "-snapshot", snapPath},
+		{"-manifest", dir + "/" + db.ManifestFileName, "-snapshot", snapPath},
+		{"-orgs_file", "db/db_testdata/organizations.json", "-snapshot", snapPath},
+	}
+	for _, flags := range mixed {
+		restore = setArgs(append(append([]string{"get"}, flags...), "organization", "101")...)
+		_, err = zendesk.ParseFlags()
+		restore()
+		assert.ErrorIsf(t, err, zendesk.ErrUsage, "%v", flags)
+	}
+}
+
+func TestRunTenants(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tenants")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	wd, _ := os.Getwd()
+	assert.NoError(t, os.Mkdir(dir+"/initech", 0755))
+	manifest := `{"resources": {"organization": [{"path": "` + wd + `/db/db_testdata/organizations.json"}]}}`
+	assert.NoError(t, ioutil.WriteFile(dir+"/initech/"+db.ManifestFileName, []byte(manifest), 0644))
+	err = zendesk.Run(zendesk.Args{
+		Command:           zendesk.CommandSnapshot,
+		OrganizationsFile: "db/db_testdata/organizations.json",
+		UsersFile:         "db/db_testdata/users.json",
+		TicketsFile:       "db/db_testdata/tickets.json",
+		SnapshotOut:       dir + "/acme.snap",
+	}, ioutil.Discard)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(dir+"/notes.txt", nil, 0644), "other files are ignored")
+
+	restore := setArgs("get", "-tenants_dir", dir, "-fields", "_id,name", "-format", "csv", "organization", "101")
+	args, err := zendesk.ParseFlags()
+	restore()
+	if !assert.NoError(t, err) {
+		return
+	}
+	var stdout bytes.Buffer
+	assert.NoError(t, zendesk.Run(args, &stdout))
+	assert.Equal(t, "tenant,_id,name\nacme,101,Enthaze\ninitech,101,Enthaze\n", stdout.String())
+
+	stdout.Reset()
+	args.Tenants = []string{"ac*"}
+	args.Query = db.Query{Conditions: []db.Condition{&db.IDMatchCondition{Resource: db.ResourceUser, Target: "1"}}}
+	args.Format = zendesk.FormatJSON
+	assert.NoError(t, zendesk.Run(args, &stdout))
+	var results []struct {
+		Tenant string `json:"tenant"`
+	}
+	assert.NoError(t, json.Unmarshal(stdout.Bytes(), &results))
+	if assert.Equal(t, 1, len(results)) {
+		assert.Equal(t, "acme", results[0].Tenant)
+	}
+
+	args.Tenants = []string{"initech"}
+	assert.ErrorIs(t, zendesk.Run(args, ioutil.Discard), zendesk.ErrNoResults, "initech has no users")
+
+	stdout.Reset()
+	err = zendesk.Run(zendesk.Args{Command: zendesk.CommandStats, TenantsDir: dir, Format: zendesk.FormatJSON}, &stdout)
+	assert.NoError(t, err)
+	var stats []struct {
+		Tenant  string `json:"tenant"`
+		Records int    `json:"records"`
+	}
+	assert.NoError(t, json.Unmarshal(stdout.Bytes(), &stats))
+	assert.Equal(t, []struct {
+		Tenant  string `json:"tenant"`
+		Records int    `json:"records"`
+	}{{"acme", 300}, {"initech", 25}}, stats)
+
+	err = zendesk.Run(zendesk.Args{Command: zendesk.CommandSnapshot, TenantsDir: dir, SnapshotOut: dir + "/all.snap"}, ioutil.Discard)
+	assert.ErrorIs(t, err, zendesk.ErrUsage, "snapshot needs a single tenant")
+
+	for _, arguments := range [][]string{
+		{"get", "-tenants_dir", dir, "-tenant", "hooli", "user", "1"},
+		{"get", "-tenant", "acme", "-orgs_file", "db/db_testdata/organizations.json", "user", "1"},
+		{"get", "-tenants_dir", dir, "-snapshot", dir + "/acme.snap", "user", "1"},
+	} {
+		restore = setArgs(arguments...)
+		_, err = zendesk.ParseFlags()
+		restore()
+		assert.ErrorIs(t, err, zendesk.ErrUsage, arguments)
+	}
+}
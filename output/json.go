@@ -0,0 +1,72 @@
+package output
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/sardap/zendesk/db"
+)
+
+// newJSON writes a result as an object, or a list of results as an array
+func newJSON(opts Options) (Formatter, error) {
+	return valueFormatter(func(w io.Writer, value interface{}) error {
+		jsonBytes, err := json.MarshalIndent(value, "", "\t")
+		if err != nil {
+			return err
+		}
+		jsonBytes = append(jsonBytes, '\n')
+		_, err = w.Write(jsonBytes)
+		return err
+	}), nil
+}
+
+// ndjsonLine encodes value on one line. A tenant key is put first when the
+// result is from a tenant so lines from several can be told apart
+func ndjsonLine(tenant string, value interface{}) ([]byte, error) {
+	line, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	if tenant != "" && len(line) > 1 && line[0] == '{' {
+		tenantJson, err := json.Marshal(tenant)
+		if err != nil {
+			return nil, err
+		}
+		tagged := append([]byte(`{"tenant":`), tenantJson...)
+		if line[1] != '}' {
+			tagged = append(tagged, ',')
+		}
+		line = append(tagged, line[1:]...)
+	}
+
+	return append(line, '\n'), nil
+}
+
+// newNDJSON writes one target per line, or one row per line if the query
+// picked fields, so the output can be streamed into other tools
+func newNDJSON(opts Options) (Formatter, error) {
+	return FormatterFunc(func(w io.Writer, result *db.QueryResult) error {
+		values := make([]interface{}, 0, len(result.Target))
+		if len(result.Rows) > 0 {
+			for _, row := range result.Rows {
+				values = append(values, row)
+			}
+		} else {
+			for _, record := range result.Target {
+				values = append(values, record)
+			}
+		}
+
+		for _, value := range values {
+			line, err := ndjsonLine(result.Tenant, value)
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write(line); err != nil {
+				return err
+			}
+		}
+		return nil
+	}), nil
+}
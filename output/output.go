@@ -0,0 +1,196 @@
+// Package output writes query results in the formats the command line
+// supports. More formats can be added with Register.
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sardap/zendesk/db"
+	"github.com/sardap/zendesk/utility"
+)
+
+var (
+	ErrUnknownFormat error
+	ErrFormatExists  error
+	ErrNoTemplate    error
+)
+
+func init() {
+	ErrUnknownFormat = fmt.Errorf("unknown output format")
+	ErrFormatExists = fmt.Errorf("output format already registered")
+	ErrNoTemplate = fmt.Errorf("no template given")
+}
+
+const (
+	FormatJSON     = "json"
+	FormatNDJSON   = "ndjson"
+	FormatTable    = "table"
+	FormatCSV      = "csv"
+	FormatYAML     = "yaml"
+	FormatTemplate = "template"
+)
+
+// Formatter writes a query result
+type Formatter interface {
+	Format(w io.Writer, result *db.QueryResult) error
+}
+
+// FormatterFunc lets a plain function be used as a Formatter
+type FormatterFunc func(w io.Writer, result *db.QueryResult) error
+
+func (f FormatterFunc) Format(w io.Writer, result *db.QueryResult) error {
+	return f(w, result)
+}
+
+// ListFormatter is a Formatter which can write several results, such as one
+// per tenant, as one document
+type ListFormatter interface {
+	Formatter
+	FormatList(w io.Writer, results []*db.QueryResult) error
+}
+
+// FormatList writes every result. Formatters which aren't ListFormatters
+// write each result in turn
+func FormatList(formatter Formatter, w io.Writer, results []*db.QueryResult) error {
+	if list, ok := formatter.(ListFormatter); ok {
+		return list.FormatList(w, results)
+	}
+
+	for _, result := range results {
+		if err := formatter.Format(w, result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// valueFormatter writes a result or list of results the same way
+type valueFormatter func(w io.Writer, value interface{}) error
+
+func (f valueFormatter) Format(w io.Writer, result *db.QueryResult) error {
+	return f(w, result)
+}
+
+func (f valueFormatter) FormatList(w io.Writer, results []*db.QueryResult) error {
+	return f(w, results)
+}
+
+type Options struct {
+	// Template is the text/template run by the template format
+	Template string
+}
+
+// NewFunc creates a Formatter. It should fail if opts are missing anything
+// the format needs
+type NewFunc func(opts Options) (Formatter, error)
+
+var (
+	registry = make(map[string]NewFunc)
+	names    []string
+)
+
+// Register adds a format. Formats must be registered before they're used,
+// usually from an init function.
+func Register(name string, newFunc NewFunc) error {
+	if _, ok := registry[name]; ok {
+		return errors.Wrapf(ErrFormatExists, "%s", name)
+	}
+
+	registry[name] = newFunc
+	names = append(names, name)
+	return nil
+}
+
+// New creates the Formatter for a registered format
+func New(name string, opts Options) (Formatter, error) {
+	newFunc, ok := registry[name]
+	if !ok {
+		return nil, errors.Wrapf(ErrUnknownFormat, "%s, valid formats are %s", name, strings.Join(names, ", "))
+	}
+
+	return newFunc(opts)
+}
+
+// Names lists the registered formats in the order they were registered
+func Names() []string {
+	return append([]string{}, names...)
+}
+
+// cell turns a field value into text for the table format. Lists are joined
+// with db.DefaultListDelimiter
+func cell(value interface{}) string {
+	return formatCell(value, func(item string) string { return item })
+}
+
+// csvCell is cell with list items escaped like db.WriteCSV does so
+// db.ImportCSV splits them back into the same items
+func csvCell(value interface{}) string {
+	return formatCell(value, func(item string) string {
+		return db.EscapeListItem(item, db.DefaultListDelimiter)
+	})
+}
+
+// formatCell turns a field value into text, passing each item of a list
+// through listItem before they're joined
+func formatCell(value interface{}, listItem func(item string) string) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case time.Time:
+		if v.IsZero() {
+			return ""
+		}
+		return v.Format(utility.ZendeskTimeFormat)
+	case []string:
+		cells := make([]string, len(v))
+		for i, item := range v {
+			cells[i] = listItem(item)
+		}
+		return strings.Join(cells, db.DefaultListDelimiter)
+	case []int64:
+		cells := make([]string, len(v))
+		for i, item := range v {
+			cells[i] = strconv.FormatInt(item, 10)
+		}
+		return strings.Join(cells, db.DefaultListDelimiter)
+	case []interface{}:
+		cells := make([]string, len(v))
+		for i, item := range v {
+			cells[i] = listItem(formatCell(item, listItem))
+		}
+		return strings.Join(cells, db.DefaultListDelimiter)
+	case map[string]interface{}:
+		valueJson, _ := json.Marshal(v)
+		return string(valueJson)
+	}
+
+	return fmt.Sprintf("%v", value)
+}
+
+func init() {
+	builtin := []struct {
+		name    string
+		newFunc NewFunc
+	}{
+		{FormatJSON, newJSON},
+		{FormatNDJSON, newNDJSON},
+		{FormatTable, newTable},
+		{FormatCSV, newCSV},
+		{FormatYAML, newYAML},
+		{FormatTemplate, newTemplate},
+	}
+
+	for _, format := range builtin {
+		if err := Register(format.name, format.newFunc); err != nil {
+			panic(err)
+		}
+	}
+}
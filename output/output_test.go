@@ -0,0 +1,181 @@
+package output_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/sardap/zendesk/db"
+	"github.com/sardap/zendesk/output"
+	"github.com/stretchr/testify/assert"
+)
+
+func createResult(t *testing.T, fields ...string) *db.QueryResult {
+	database := db.New()
+	database.AddOrganization(db.Organization{ID: 101, Name: "Enthaze", Tags: []string{"Fulton", "West"}})
+	database.AddUser(db.User{ID: 1, Name: "Francisca Rasmussen", OrganizationID: 101, Alias: "Miss: Coffey"})
+	database.AddUser(db.User{ID: 2, Name: "true", OrganizationID: 101})
+
+	query := db.Query{
+		Conditions: []db.Condition{&db.FulLMatchCondition{
+			Resource: db.ResourceUser, Connector: db.ConnectorTypeUnion, Field: "organization_id", Match: "101",
+		}},
+		SortBy: []string{"_id"},
+		Fields: fields,
+	}
+	result, err := query.Resolve(database)
+	assert.NoError(t, err)
+
+	return result
+}
+
+func format(t *testing.T, name string, opts output.Options, result *db.QueryResult) string {
+	formatter, err := output.New(name, opts)
+	if !assert.NoError(t, err) {
+		return ""
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, formatter.Format(&buf, result))
+	return buf.String()
+}
+
+func TestFormats(t *testing.T) {
+	result := createResult(t)
+
+	var parsed map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(format(t, output.FormatJSON, output.Options{}, result)), &parsed))
+
+	ndjson := format(t, output.FormatNDJSON, output.Options{}, result)
+	lines := bytes.Split(bytes.TrimSpace([]byte(ndjson)), []byte("\n"))
+	if assert.Equal(t, 2, len(lines), "one line per target") {
+		var usr db.User
+		assert.NoError(t, json.Unmarshal(lines[0], &usr))
+		assert.Equal(t, "Francisca Rasmussen", usr.Name)
+	}
+
+	csv := format(t, output.FormatCSV, output.Options{}, result)
+	assert.Contains(t, csv, "_id,url,external_id,name,alias,")
+	assert.Contains(t, csv, "\n1,,,Francisca Rasmussen,Miss: Coffey,")
+	assert.Equal(t, 1, len(result.Related.Orgs))
+	assert.NotContains(t, csv, "Enthaze", "only the targets are rows")
+
+	yaml := format(t, output.FormatYAML, output.Options{}, result)
+	assert.Contains(t, yaml, "target:\n  - _id: 1\n    url: \"\"\n")
+	assert.Contains(t, yaml, "    alias: \"Miss: Coffey\"\n")
+	assert.Contains(t, yaml, "    name: \"true\"\n", "strings which read as something else are quoted")
+	assert.Contains(t, yaml, "    tags: null\n")
+
+	tmpl := format(t, output.FormatTemplate, output.Options{Template: `{{range .Target}}{{.Name}};{{end}}`}, result)
+	assert.Equal(t, "Francisca Rasmussen;true;", tmpl)
+	_, err := output.New(output.FormatTemplate, output.Options{})
+	assert.ErrorIs(t, err, output.ErrNoTemplate)
+	_, err = output.New(output.FormatTemplate, output.Options{Template: "{{"})
+	assert.Error(t, err)
+
+	_, err = output.New("xml", output.Options{})
+	assert.ErrorIs(t, err, output.ErrUnknownFormat)
+}
+
+func TestCSVRoundTrip(t *testing.T) {
+	database := db.New()
+	tags := []string{"a;b", `C:\temp`, `ends\`, ""}
+	database.AddUser(db.User{ID: 1, Name: "Cross Barlow", Tags: tags, Active: true})
+	query := db.Query{Conditions: []db.Condition{&db.FulLMatchCondition{
+		Resource: db.ResourceUser, Connector: db.ConnectorTypeUnion, Field: "_id", Match: "1",
+	}}}
+	result, err := query.Resolve(database)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	imported := db.New()
+	csv := format(t, output.FormatCSV, output.Options{}, result)
+	if !assert.NoError(t, imported.ImportCSV(db.ResourceUser, strings.NewReader(csv), db.CSVOptions{})) {
+		return
+	}
+	usr, err := imported.GetUser(1)
+	if assert.NoError(t, err) {
+		assert.Equal(t, tags, usr.Tags, "list items should be escaped")
+		assert.Equal(t, "Cross Barlow", usr.Name)
+		assert.True(t, usr.Active)
+	}
+}
+
+func TestFormatFields(t *testing.T) {
+	result := createResult(t, "_id", "organization.name", "organization.tags")
+
+	table := format(t, output.FormatTable, output.Options{}, result)
+	assert.Equal(t, ""+
+		"_id  organization.name  organization.tags\n"+
+		"1    Enthaze            Fulton;West\n"+
+		"2    Enthaze            Fulton;West\n",
+		table,
+	)
+
+	ndjson := format(t, output.FormatNDJSON, output.Options{}, result)
+	assert.Equal(t, ""+
+		`{"_id":1,"organization.name":"Enthaze","organization.tags":["Fulton","West"]}`+"\n"+
+		`{"_id":2,"organization.name":"Enthaze","organization.tags":["Fulton","West"]}`+"\n",
+		ndjson,
+	)
+
+	csv := format(t, output.FormatCSV, output.Options{}, result)
+	assert.Equal(t, "_id,organization.name,organization.tags\n1,Enthaze,Fulton;West\n2,Enthaze,Fulton;West\n", csv)
+}
+
+func formatList(t *testing.T, name string, results []*db.QueryResult) string {
+	formatter, err := output.New(name, output.Options{Template: "{{.Tenant}}:{{len .Target}};"})
+	if !assert.NoError(t, err) {
+		return ""
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, output.FormatList(formatter, &buf, results))
+	return buf.String()
+}
+
+func TestFormatList(t *testing.T) {
+	acme, initech := createResult(t, "_id", "name"), createResult(t, "_id", "name")
+	acme.Tenant, initech.Tenant = "acme", "initech"
+	results := []*db.QueryResult{acme, initech}
+
+	var parsed []map[string]interface{}
+	assert.NoError(t, json.Unmarshal([]byte(formatList(t, output.FormatJSON, results)), &parsed))
+	if assert.Equal(t, 2, len(parsed), "one document holding every result") {
+		assert.Equal(t, "initech", parsed[1]["tenant"])
+	}
+
+	assert.Equal(t, ""+
+		"tenant,_id,name\n"+
+		"acme,1,Francisca Rasmussen\n"+
+		"acme,2,true\n"+
+		"initech,1,Francisca Rasmussen\n"+
+		"initech,2,true\n",
+		formatList(t, output.FormatCSV, results),
+	)
+	assert.Contains(t, formatList(t, output.FormatTable, results), "tenant   _id  name\nacme     1    Francisca Rasmussen\n")
+	assert.Contains(t, formatList(t, output.FormatNDJSON, results), `{"tenant":"initech","_id":2,"name":"true"}`+"\n")
+	assert.Contains(t, formatList(t, output.FormatYAML, results), "- tenant: acme\n")
+	assert.Equal(t, "acme:2;initech:2;", formatList(t, output.FormatTemplate, results), "written in turn")
+
+	acme.Fields, acme.Rows = nil, nil
+	assert.Contains(t, format(t, output.FormatNDJSON, output.Options{}, acme), `{"tenant":"acme","_id":1,"url":""`)
+}
+
+func TestRegister(t *testing.T) {
+	err := output.Register("count", func(opts output.Options) (output.Formatter, error) {
+		return output.FormatterFunc(func(w io.Writer, result *db.QueryResult) error {
+			_, err := w.Write([]byte{byte('0' + len(result.Target))})
+			return err
+		}), nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "2", format(t, "count", output.Options{}, createResult(t)))
+	assert.Contains(t, output.Names(), "count")
+
+	err = output.Register(output.FormatJSON, nil)
+	assert.ErrorIs(t, err, output.ErrFormatExists)
+}
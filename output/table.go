@@ -0,0 +1,185 @@
+package output
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"unicode/utf8"
+
+	"github.com/sardap/zendesk/db"
+)
+
+// Longest a table cell can be before it's cut short
+const maxTableCell = 40
+
+// grid is the targets of one resource as rows of field values, which each
+// format turns into text its own way
+type grid struct {
+	resource db.ResourceType
+	header   []string
+	rows     [][]interface{}
+}
+
+// grids lays out the picked fields if the query has any, otherwise every
+// field of each resource in the order the resources first appear. Only the
+// targets get rows, the related records aren't shown but their fields can
+// be picked with paths like organization.name. Results from tenants get a
+// tenant column first
+func grids(queryResults []*db.QueryResult) ([]*grid, error) {
+	tenants := false
+	for _, queryResult := range queryResults {
+		if queryResult.Tenant != "" {
+			tenants = true
+		}
+	}
+	withTenant := func(tenant string, cells []interface{}) []interface{} {
+		if !tenants {
+			return cells
+		}
+		return append([]interface{}{tenant}, cells...)
+	}
+
+	if len(queryResults) > 0 && len(queryResults[0].Fields) > 0 {
+		fields := queryResults[0].Fields
+		single := &grid{header: fields}
+		if tenants {
+			single.header = append([]string{"tenant"}, fields...)
+		}
+		for _, queryResult := range queryResults {
+			for _, row := range queryResult.Rows {
+				cells := make([]interface{}, len(fields))
+				for i, field := range fields {
+					cells[i] = row[field]
+				}
+				single.rows = append(single.rows, withTenant(queryResult.Tenant, cells))
+			}
+		}
+		return []*grid{single}, nil
+	}
+
+	var result []*grid
+	byResource := make(map[db.ResourceType]*grid)
+	fieldsOf := make(map[db.ResourceType][]*db.Field)
+	for _, queryResult := range queryResults {
+		for _, record := range queryResult.Target {
+			resource := record.GetResourceType()
+			current, ok := byResource[resource]
+			if !ok {
+				fields, err := db.Fields(resource)
+				if err != nil {
+					return nil, err
+				}
+				current = &grid{resource: resource}
+				if tenants {
+					current.header = append(current.header, "tenant")
+				}
+				for _, field := range fields {
+					current.header = append(current.header, field.Name)
+				}
+				byResource[resource] = current
+				fieldsOf[resource] = fields
+				result = append(result, current)
+			}
+
+			cells := make([]interface{}, len(fieldsOf[resource]))
+			for i, field := range fieldsOf[resource] {
+				cells[i] = field.Value(record)
+			}
+			current.rows = append(current.rows, withTenant(queryResult.Tenant, cells))
+		}
+	}
+
+	return result, nil
+}
+
+// gridFormatter writes grids of a result, or of every result in a list so
+// they share headers
+type gridFormatter func(w io.Writer, tables []*grid) error
+
+func (f gridFormatter) Format(w io.Writer, result *db.QueryResult) error {
+	return f.FormatList(w, []*db.QueryResult{result})
+}
+
+func (f gridFormatter) FormatList(w io.Writer, results []*db.QueryResult) error {
+	tables, err := grids(results)
+	if err != nil {
+		return err
+	}
+	return f(w, tables)
+}
+
+// tableCell keeps a cell on one line and cuts it short
+func tableCell(value string) string {
+	value = strings.Join(strings.Fields(value), " ")
+	if utf8.RuneCountInString(value) <= maxTableCell {
+		return value
+	}
+	return string([]rune(value)[:maxTableCell-3]) + "..."
+}
+
+// newTable writes aligned columns for reading in a terminal. Long values are
+// cut short, use csv for everything. Like csv it only shows the targets
+func newTable(opts Options) (Formatter, error) {
+	return gridFormatter(func(w io.Writer, tables []*grid) error {
+		for i, table := range tables {
+			if len(tables) > 1 {
+				if i > 0 {
+					if _, err := fmt.Fprintln(w); err != nil {
+						return err
+					}
+				}
+				if _, err := fmt.Fprintf(w, "%s\n", table.resource); err != nil {
+					return err
+				}
+			}
+
+			tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+			if _, err := fmt.Fprintf(tw, "%s\n", strings.Join(table.header, "\t")); err != nil {
+				return err
+			}
+			for _, row := range table.rows {
+				cells := make([]string, len(row))
+				for j, value := range row {
+					cells[j] = tableCell(cell(value))
+				}
+				if _, err := fmt.Fprintf(tw, "%s\n", strings.Join(cells, "\t")); err != nil {
+					return err
+				}
+			}
+			if err := tw.Flush(); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}), nil
+}
+
+// newCSV writes a header row then a row per target. Each resource gets its
+// own header if the targets are mixed. Related records are left out so every
+// row is a match. Lists are escaped like db.WriteCSV so a single resource's
+// output can be read back with db.ImportCSV
+func newCSV(opts Options) (Formatter, error) {
+	return gridFormatter(func(w io.Writer, tables []*grid) error {
+		writer := csv.NewWriter(w)
+		for _, table := range tables {
+			if err := writer.Write(table.header); err != nil {
+				return err
+			}
+			for _, row := range table.rows {
+				cells := make([]string, len(row))
+				for i, value := range row {
+					cells[i] = csvCell(value)
+				}
+				if err := writer.Write(cells); err != nil {
+					return err
+				}
+			}
+		}
+
+		writer.Flush()
+		return writer.Error()
+	}), nil
+}
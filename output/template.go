@@ -0,0 +1,38 @@
+package output
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+	"github.com/sardap/zendesk/db"
+)
+
+var templateFuncs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		valueJson, err := json.Marshal(value)
+		return string(valueJson), err
+	},
+	"join": strings.Join,
+	"cell": cell,
+}
+
+// newTemplate runs opts.Template with the QueryResult as its data. Besides
+// the usual functions there are json, join and cell which formats a value
+// like the table does
+func newTemplate(opts Options) (Formatter, error) {
+	if opts.Template == "" {
+		return nil, ErrNoTemplate
+	}
+
+	tmpl, err := template.New(FormatTemplate).Funcs(templateFuncs).Parse(opts.Template)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid template")
+	}
+
+	return FormatterFunc(func(w io.Writer, result *db.QueryResult) error {
+		return tmpl.Execute(w, result)
+	}), nil
+}
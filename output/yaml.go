@@ -0,0 +1,197 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// The result goes through json first so yaml has the same field names and
+// order. Objects keep their key order which a map wouldn't
+
+type yamlKind int
+
+const (
+	yamlScalar yamlKind = iota
+	yamlObject
+	yamlArray
+)
+
+type yamlNode struct {
+	kind yamlKind
+	// scalar is the node written inline
+	scalar string
+	keys   []string
+	values []*yamlNode
+}
+
+// Words a plain yaml string can't be since they'd be read as something else
+var yamlReserved = map[string]bool{
+	"true": true, "false": true, "null": true, "yes": true, "no": true,
+	"on": true, "off": true, "y": true, "n": true, "~": true,
+}
+
+// yamlString quotes s unless it can be written plain
+func yamlString(s string) string {
+	plain := s != "" && !yamlReserved[strings.ToLower(s)] &&
+		!strings.HasSuffix(s, " ") && !strings.HasSuffix(s, ":") && !strings.Contains(s, ": ") && !strings.Contains(s, " #")
+	if _, err := strconv.ParseFloat(s, 64); err == nil {
+		plain = false
+	}
+	for i, r := range s {
+		if !plain {
+			break
+		}
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r == '_', r == '/':
+		case i > 0 && (r >= '0' && r <= '9' || strings.ContainsRune(" .@+-:()", r)):
+		default:
+			plain = false
+		}
+	}
+	if plain {
+		return s
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+func decodeYAMLNode(dec *json.Decoder) (*yamlNode, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch val := tok.(type) {
+	case json.Delim:
+		node := &yamlNode{kind: yamlArray}
+		if val == '{' {
+			node.kind = yamlObject
+		}
+		for dec.More() {
+			if node.kind == yamlObject {
+				key, err := dec.Token()
+				if err != nil {
+					return nil, err
+				}
+				node.keys = append(node.keys, key.(string))
+			}
+			child, err := decodeYAMLNode(dec)
+			if err != nil {
+				return nil, err
+			}
+			node.values = append(node.values, child)
+		}
+		// closing delim
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		return node, nil
+	case string:
+		return &yamlNode{scalar: yamlString(val)}, nil
+	case nil:
+		return &yamlNode{scalar: "null"}, nil
+	}
+
+	return &yamlNode{scalar: toString(tok)}, nil
+}
+
+func toString(tok json.Token) string {
+	switch val := tok.(type) {
+	case json.Number:
+		return val.String()
+	case bool:
+		return strconv.FormatBool(val)
+	}
+	return ""
+}
+
+// inline returns the node written on one line or false if it needs a block
+func (n *yamlNode) inline() (string, bool) {
+	switch {
+	case n.kind == yamlScalar:
+		return n.scalar, true
+	case len(n.values) > 0:
+		return "", false
+	case n.kind == yamlObject:
+		return "{}", true
+	}
+	return "[]", true
+}
+
+// writeValue writes the node after a key's colon
+func (n *yamlNode) writeValue(buf *bytes.Buffer, indent int) {
+	if value, ok := n.inline(); ok {
+		buf.WriteString(" " + value + "\n")
+		return
+	}
+
+	buf.WriteString("\n")
+	if n.kind == yamlObject {
+		n.writeEntries(buf, indent+2, false)
+	} else {
+		n.writeItems(buf, indent+2)
+	}
+}
+
+// writeEntries writes each key and value. The first key goes straight after
+// a list item's dash when inItem is set
+func (n *yamlNode) writeEntries(buf *bytes.Buffer, indent int, inItem bool) {
+	for i, key := range n.keys {
+		if i > 0 || !inItem {
+			buf.WriteString(strings.Repeat(" ", indent))
+		}
+		buf.WriteString(yamlString(key) + ":")
+		n.values[i].writeValue(buf, indent)
+	}
+}
+
+func (n *yamlNode) writeItems(buf *bytes.Buffer, indent int) {
+	for _, item := range n.values {
+		buf.WriteString(strings.Repeat(" ", indent) + "-")
+		if value, ok := item.inline(); ok {
+			buf.WriteString(" " + value + "\n")
+		} else if item.kind == yamlObject {
+			buf.WriteString(" ")
+			item.writeEntries(buf, indent+2, true)
+		} else {
+			buf.WriteString("\n")
+			item.writeItems(buf, indent+2)
+		}
+	}
+}
+
+func newYAML(opts Options) (Formatter, error) {
+	return valueFormatter(func(w io.Writer, value interface{}) error {
+		resultJson, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		dec := json.NewDecoder(bytes.NewReader(resultJson))
+		dec.UseNumber()
+		root, err := decodeYAMLNode(dec)
+		if err != nil {
+			return err
+		}
+
+		var buf bytes.Buffer
+		switch {
+		case root.kind == yamlObject && len(root.values) > 0:
+			root.writeEntries(&buf, 0, false)
+		case root.kind == yamlArray && len(root.values) > 0:
+			root.writeItems(&buf, 0)
+		default:
+			value, _ := root.inline()
+			buf.WriteString(value + "\n")
+		}
+
+		_, err = buf.WriteTo(w)
+		return err
+	}), nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sardap/zendesk/db"
+	"github.com/sardap/zendesk/output"
+)
+
+// Extension of the snapshots in a tenants directory
+const snapshotExt = ".snap"
+
+// tenantPaths are the datasets in a tenants directory by tenant name. Each
+// is a directory like -data_dir takes or a snapshot ending in .snap, named
+// after the tenant's subdomain, e.g. initech/ or initech.snap
+func tenantPaths(dir string) (map[string]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string)
+	for _, entry := range entries {
+		name := entry.Name()
+		switch {
+		case entry.IsDir():
+		case strings.HasSuffix(name, snapshotExt):
+			name = strings.TrimSuffix(name, snapshotExt)
+		default:
+			continue
+		}
+		if _, ok := result[name]; ok {
+			return nil, errors.Wrapf(db.ErrTenantExists, "%s has both a directory and a snapshot", name)
+		}
+		result[name] = filepath.Join(dir, entry.Name())
+	}
+
+	return result, nil
+}
+
+// selectTenants picks the datasets in TenantsDir which -tenant selects
+func (a *Args) selectTenants() (map[string]string, error) {
+	paths, err := tenantPaths(a.TenantsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(paths))
+	for name := range paths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	selected, err := db.SelectTenants(names, a.Tenants)
+	if err != nil {
+		return nil, err
+	}
+	if len(selected) == 0 {
+		return nil, errors.Wrapf(db.ErrUnknownTenant, "no tenants in %s", a.TenantsDir)
+	}
+
+	result := make(map[string]string)
+	for _, name := range selected {
+		result[name] = paths[name]
+	}
+
+	return result, nil
+}
+
+// checkTenants makes sure -tenant picks some tenants and isn't mixed with
+// the flags for a single dataset
+func (a *Args) checkTenants() error {
+	if a.TenantsDir == "" {
+		if len(a.Tenants) > 0 {
+			return usageErrorf("-tenant needs -tenants_dir please check -h")
+		}
+		return nil
+	}
+
+	single := a.Snapshot != "" || a.Manifest != "" || a.DataDir != ""
+	for _, file := range a.files() {
+		single = single || *file != ""
+	}
+	if single {
+		return usageErrorf("give either -tenants_dir or a single dataset please check -h")
+	}
+
+	if info, err := os.Stat(a.TenantsDir); err != nil || !info.IsDir() {
+		return usageErrorf("invalid tenants directory %s given", a.TenantsDir)
+	}
+	if _, err := a.selectTenants(); err != nil {
+		return &Error{Kind: ErrUsage, Cause: errors.Wrap(err, "please check -h")}
+	}
+
+	return nil
+}
+
+// loadTenants loads the dataset of each selected tenant
+func loadTenants(args Args) (*db.Tenants, error) {
+	paths, err := args.selectTenants()
+	if err != nil {
+		return nil, &Error{Kind: ErrUsage, Cause: err}
+	}
+
+	result := db.NewTenants()
+	for name, path := range paths {
+		database, err := loadDataset(path, args)
+		if err != nil {
+			return nil, &Error{Kind: ErrLoad, Cause: errors.Wrapf(err, "tenant %s", name)}
+		}
+		if err := result.Add(name, database); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+type tenantStats struct {
+	Tenant string `json:"tenant"`
+	*db.Stats
+}
+
+type tenantValidation struct {
+	Tenant string `json:"tenant"`
+	*db.ValidationReport
+}
+
+// writeTenants writes each tenant's report, as a json array or under a line
+// with the tenant's name
+func writeTenants(stdout io.Writer, format string, reports []interface{}, names []string, write func(i int) error) error {
+	if format == FormatJSON {
+		jsonBytes, _ := json.MarshalIndent(reports, "", "\t")
+		_, err := fmt.Fprintf(stdout, "%s\n", jsonBytes)
+		return err
+	}
+
+	for i, name := range names {
+		if i > 0 {
+			if _, err := fmt.Fprintln(stdout); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(stdout, "%s\n", name); err != nil {
+			return err
+		}
+		if err := write(i); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runTenants is Run for the tenants in TenantsDir. Queries are federated
+// across the selected tenants with each result tagged with its tenant
+func runTenants(args Args, stdout io.Writer) error {
+	tenants, err := loadTenants(args)
+	if err != nil {
+		return err
+	}
+	names := tenants.Names()
+
+	switch args.Command {
+	case CommandStats:
+		var reports []interface{}
+		var stats []*db.Stats
+		for _, name := range names {
+			database, _ := tenants.Get(name)
+			stats = append(stats, database.Stats())
+			reports = append(reports, tenantStats{name, stats[len(stats)-1]})
+		}
+		return writeTenants(stdout, args.Format, reports, names, func(i int) error {
+			return stats[i].Write(stdout)
+		})
+	case CommandValidate:
+		var reports []interface{}
+		var validations []*db.ValidationReport
+		ok := true
+		for _, name := range names {
+			database, _ := tenants.Get(name)
+			validation := database.Validate()
+			ok = ok && validation.OK()
+			validations = append(validations, validation)
+			reports = append(reports, tenantValidation{name, validation})
+		}
+		err := writeTenants(stdout, args.Format, reports, names, func(i int) error {
+			return validations[i].Write(stdout)
+		})
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrValidation
+		}
+		return nil
+	case CommandSnapshot:
+		if len(names) != 1 {
+			return usageErrorf("snapshot needs -tenant to pick one tenant, %s are selected", strings.Join(names, ", "))
+		}
+		database, _ := tenants.Get(names[0])
+		return writeSnapshot(database, args.SnapshotOut)
+	}
+
+	results, err := tenants.Resolve(&args.Query, names...)
+	if err != nil {
+		return &Error{Kind: ErrQuery, Cause: err}
+	}
+	if len(results) == 0 {
+		return ErrNoResults
+	}
+	if !args.Meta {
+		for _, result := range results {
+			result.Meta = nil
+		}
+	}
+	formatter, err := newFormatter(args)
+	if err != nil {
+		return &Error{Kind: ErrUsage, Cause: err}
+	}
+
+	return output.FormatList(formatter, stdout, results)
+}